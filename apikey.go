@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const maxApiKeyNameLength = 100
+
+// apiKey is an API key as shown to its owner. The key itself is only sent
+// once, when it is created.
+type apiKey struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func newApiKey(key database.ApiKey) apiKey {
+	result := apiKey{
+		Id:        key.Id,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scope:     key.Scope,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.ExpiresAt.IsZero() {
+		result.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		result.LastUsedAt = &key.LastUsedAt
+	}
+	return result
+}
+
+// createApiKey creates an API key for the caller. It can have at most the
+// scopes of the token it is created with, and all of them by default. A
+// key created with an expiring API key expires with it at the latest.
+func (cfg *apiConfig) createApiKey(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name      string     `json:"name"`
+		Scope     string     `json:"scope"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" {
+		respondWithError(w, http.StatusBadRequest, "Name required")
+		return
+	}
+	if len(name) > maxApiKeyNameLength {
+		respondWithError(w, http.StatusBadRequest, "Name is too long")
+		return
+	}
+
+	claims, _ := currentClaims(r)
+	requested := strings.Fields(params.Scope)
+	if len(requested) == 0 {
+		requested = claims.Scopes()
+	}
+	for _, scope := range requested {
+		if !slices.Contains(auth.AllScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Invalid scope "+scope)
+			return
+		}
+		if !claims.HasScope(scope) {
+			respondWithError(w, http.StatusForbidden, "Token lacks scope "+scope)
+			return
+		}
+	}
+
+	var expiresAt time.Time
+	if params.ExpiresAt != nil {
+		expiresAt = params.ExpiresAt.UTC()
+		if !expiresAt.After(time.Now()) {
+			respondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+			return
+		}
+	}
+	if claims.Type == auth.ApiKeyType && claims.ExpiresAt != nil {
+		limit := claims.ExpiresAt.Time.UTC()
+		if expiresAt.IsZero() || expiresAt.After(limit) {
+			expiresAt = limit
+		}
+	}
+
+	key, prefix, hash, err := auth.MakeApiKey()
+	if err != nil {
+		log.Println("Error making API key: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	caller, _ := currentUser(r)
+	stored, err := cfg.db.CreateApiKey(caller.Id, name, prefix, hash, strings.Join(requested, " "), expiresAt)
+	if err != nil {
+		log.Println("Error creating API key: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	result := newApiKey(stored)
+	result.Key = key
+	respondWithJSON(w, http.StatusCreated, result)
+}
+
+// getApiKeys lists the caller's API keys, expired ones included.
+func (cfg *apiConfig) getApiKeys(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	keys, err := cfg.db.GetApiKeys(caller.Id)
+	if err != nil {
+		log.Println("Error getting API keys: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	result := make([]apiKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, newApiKey(key))
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// deleteApiKey revokes one of the caller's API keys.
+func (cfg *apiConfig) deleteApiKey(w http.ResponseWriter, r *http.Request) {
+	keyId, err := strconv.Atoi(chi.URLParam(r, "tokenid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token id")
+		return
+	}
+	caller, _ := currentUser(r)
+	err = cfg.db.DeleteApiKey(keyId, caller.Id)
+	if errors.Is(err, database.ErrApiKeyNotFound) {
+		respondWithError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting API key: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
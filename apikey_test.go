@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+)
+
+func TestCreateApiKeyExpiry(t *testing.T) {
+	cfg := newTestConfig(t)
+	tokens := createTestUser(t, cfg, "a@example.com")
+	user, err := cfg.db.GetUserByEmail("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentExpiry := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	parent, prefix, hash, err := auth.MakeApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.CreateApiKey(user.Id, "parent", prefix, hash, auth.ScopeUsersWrite, parentExpiry); err != nil {
+		t.Fatal(err)
+	}
+	earlier := parentExpiry.Add(-time.Minute)
+	later := parentExpiry.Add(time.Hour)
+
+	handler := cfg.middlewareRequireAuth(http.HandlerFunc(cfg.createApiKey))
+	tests := []struct {
+		name      string
+		token     string
+		expiresAt string
+		want      time.Time
+	}{
+		{"API key without expiry", parent, "", parentExpiry},
+		{"API key with later expiry", parent, later.Format(time.RFC3339), parentExpiry},
+		{"API key with earlier expiry", parent, earlier.Format(time.RFC3339), earlier},
+		{"access token without expiry", tokens.Token, "", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name":"child","scope":"users:write"}`
+			if tt.expiresAt != "" {
+				body = `{"name":"child","scope":"users:write","expires_at":"` + tt.expiresAt + `"}`
+			}
+			created := apiKey{}
+			if code := serve(t, handler, "POST", "/api/tokens", body, tt.token, &created); code != http.StatusCreated {
+				t.Fatalf("Got %d, expected %d", code, http.StatusCreated)
+			}
+			var got time.Time
+			if created.ExpiresAt != nil {
+				got = *created.ExpiresAt
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("Got expiry %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
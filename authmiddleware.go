@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+)
+
+// currentUser returns the user that authenticated the request, if any.
+func currentUser(r *http.Request) (database.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(database.User)
+	return user, ok
+}
+
+// currentClaims returns the claims the request was authenticated with, if
+// any.
+func currentClaims(r *http.Request) (*auth.Claims, bool) {
+	claims, ok := r.Context().Value(claimsContextKey).(*auth.Claims)
+	return claims, ok
+}
+
+// hasScope reports whether the request's access token grants scope.
+func hasScope(r *http.Request, scope string) bool {
+	claims, ok := currentClaims(r)
+	return ok && claims.HasScope(scope)
+}
+
+// scopesFor returns the scopes a user with the given role can be granted.
+func scopesFor(role string) []string {
+	scopes := []string{auth.ScopeChirpsWrite, auth.ScopeUsersWrite}
+	if database.RoleAllows(role, database.RoleModerator) {
+		scopes = append(scopes, auth.ScopeAdmin)
+	}
+	return scopes
+}
+
+// grantScopes returns the scopes of granted that role allows, space
+// separated as in the scope claim.
+func grantScopes(granted []string, role string) string {
+	allowed := scopesFor(role)
+	scopes := []string{}
+	for _, scope := range granted {
+		if slices.Contains(allowed, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// middlewareRequireAuth only lets through requests with a valid, current
+// access token or API key for an existing, unsuspended user, and puts that
+// user in the request context.
+func (cfg *apiConfig) middlewareRequireAuth(next http.Handler) http.Handler {
+	return cfg.middlewareAuth(next, false)
+}
+
+// middlewareOptionalAuth lets requests without an Authorization header
+// through anonymously; the rest are treated as by middlewareRequireAuth.
+func (cfg *apiConfig) middlewareOptionalAuth(next http.Handler) http.Handler {
+	return cfg.middlewareAuth(next, true)
+}
+
+func (cfg *apiConfig) middlewareAuth(next http.Handler, optional bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if optional && r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Token required")
+			return
+		}
+		var claims *auth.Claims
+		var user database.User
+		var userErr error
+		if auth.IsApiKey(token) {
+			claims, err = cfg.apiKeyClaims(token)
+			if err != nil {
+				log.Println("Error getting API key: ", err)
+				respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+				return
+			}
+			// API keys are revoked one by one rather than by generation.
+			if claims != nil {
+				userId, _ := claims.UserId()
+				user, userErr = cfg.db.GetUserById(userId)
+			}
+		} else {
+			claims, err = auth.ValidateJWT(token, cfg.jwtKeys, func(userId int) (int, error) {
+				user, userErr = cfg.db.GetUserById(userId)
+				return user.TokenGeneration, userErr
+			})
+		}
+		if userErr != nil && !errors.Is(userErr, database.ErrUserNotFound) {
+			log.Println("Error getting user: ", userErr)
+			respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+		if errors.Is(err, auth.ErrTokenRevoked) {
+			respondWithError(w, http.StatusUnauthorized, "Token revoked")
+			return
+		}
+		if claims == nil || userErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		if user.Suspended {
+			respondWithError(w, http.StatusForbidden, "Account suspended")
+			return
+		}
+		if claims.Type == auth.ApiKeyType {
+			claims.Scope = grantScopes(claims.Scopes(), user.Role)
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiKeyTouchInterval is how often an API key's last-used time is
+// written. It only needs to be roughly right, and writing it on every
+// request would make every read a write.
+const apiKeyTouchInterval = time.Minute
+
+// apiKeyClaims looks up an API key and returns the claims it stands for,
+// or nil if the key is unknown or has expired. Its scopes are still to be
+// limited to what the user's role allows.
+func (cfg *apiConfig) apiKeyClaims(key string) (*auth.Claims, error) {
+	apiKey, err := cfg.db.GetApiKeyByHash(auth.HashApiKey(key))
+	if errors.Is(err, database.ErrApiKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if apiKey.Expired(now) {
+		return nil, nil
+	}
+	if now.Sub(apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if err := cfg.db.TouchApiKey(apiKey.Id, now); err != nil {
+			log.Println("Error touching API key: ", err)
+		}
+	}
+
+	return auth.ApiKeyClaims(apiKey.UserId, apiKey.Scope, apiKey.ExpiresAt), nil
+}
+
+// middlewareRequireRole only lets through users whose role grants at least
+// role. The stored role is checked rather than the token's claim, so a
+// demotion takes effect at once. It must run after middlewareRequireAuth.
+func (cfg *apiConfig) middlewareRequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := currentUser(r)
+			if !ok {
+				respondWithError(w, http.StatusUnauthorized, "Token required")
+				return
+			}
+			if !database.RoleAllows(user.Role, role) {
+				respondWithError(w, http.StatusForbidden, "Not authorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// middlewareRequireScope only lets through requests whose access token
+// grants scope. It must run after middlewareRequireAuth.
+func (cfg *apiConfig) middlewareRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasScope(r, scope) {
+				respondWithError(w, http.StatusForbidden, "Token lacks scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
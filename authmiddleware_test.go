@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+)
+
+func TestMiddlewareAuth(t *testing.T) {
+	cfg := newTestConfig(t)
+	active := createTestUser(t, cfg, "active@example.com")
+	suspended := createTestUser(t, cfg, "suspended@example.com")
+	user, err := cfg.db.GetUserByEmail("suspended@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.db.CreateChirp("Hello", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.ModerateChirp(chirp.Id, user.Id, database.ActionSuspend); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler echoes the email of the user in the context, if any.
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := currentUser(r)
+		respondWithJSON(w, http.StatusOK, struct {
+			Email string `json:"email"`
+		}{user.Email})
+	})
+
+	tests := []struct {
+		name     string
+		optional bool
+		token    string
+		want     int
+		email    string
+	}{
+		{"no token", false, "", http.StatusUnauthorized, ""},
+		{"invalid token", false, "invalid", http.StatusUnauthorized, ""},
+		{"refresh token", false, active.RefreshToken, http.StatusUnauthorized, ""},
+		{"suspended", false, suspended.Token, http.StatusForbidden, ""},
+		{"user", false, active.Token, http.StatusOK, "active@example.com"},
+		{"optional anonymous", true, "", http.StatusOK, ""},
+		{"optional invalid token", true, "invalid", http.StatusUnauthorized, ""},
+		{"optional user", true, active.Token, http.StatusOK, "active@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := cfg.middlewareRequireAuth(echo)
+			if tt.optional {
+				handler = cfg.middlewareOptionalAuth(echo)
+			}
+			got := struct {
+				Email string `json:"email"`
+			}{}
+			if code := serve(t, handler, "GET", "/", "", tt.token, &got); code != tt.want {
+				t.Fatalf("Got %d, expected %d", code, tt.want)
+			}
+			if got.Email != tt.email {
+				t.Fatalf("Got %q, expected %q", got.Email, tt.email)
+			}
+		})
+	}
+}
+
+func TestGrantScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []string
+		role    string
+		want    string
+	}{
+		{"user", auth.AllScopes, database.RoleUser, "chirps:write users:write"},
+		{"moderator", auth.AllScopes, database.RoleModerator, "chirps:write users:write admin"},
+		{"admin", auth.AllScopes, database.RoleAdmin, "chirps:write users:write admin"},
+		{"subset", []string{auth.ScopeAdmin, auth.ScopeChirpsWrite}, database.RoleAdmin, "admin chirps:write"},
+		{"only disallowed", []string{auth.ScopeAdmin}, database.RoleUser, ""},
+		{"unknown scope", []string{"chirps:read", auth.ScopeUsersWrite}, database.RoleUser, "users:write"},
+		{"none", nil, database.RoleAdmin, ""},
+		{"unknown role", auth.AllScopes, "root", "chirps:write users:write"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := grantScopes(tt.granted, tt.role); got != tt.want {
+				t.Fatalf("Got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequireScope(t *testing.T) {
+	cfg := newTestConfig(t)
+	createTestUser(t, cfg, "a@example.com")
+	limited := testTokens{}
+	body := `{"email":"a@example.com","password":"password","scope":"chirps:write admin"}`
+	if code := serve(t, http.HandlerFunc(cfg.login), "POST", "/api/login", body, "", &limited); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+	full := loginTestUser(t, cfg, "a@example.com", "password")
+
+	user, err := cfg.db.GetUserByEmail("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.SetUserRole(user.Id, database.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	key, prefix, hash, err := auth.MakeApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.CreateApiKey(user.Id, "key", prefix, hash, "admin", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, struct{}{})
+	})
+	requireScope := func(scope string) http.Handler {
+		return cfg.middlewareRequireAuth(cfg.middlewareRequireScope(scope)(ok))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		scope string
+		want  int
+	}{
+		{"granted", limited.Token, auth.ScopeChirpsWrite, http.StatusOK},
+		{"not requested", limited.Token, auth.ScopeUsersWrite, http.StatusForbidden},
+		// The user was no moderator when logging in.
+		{"not allowed at login", limited.Token, auth.ScopeAdmin, http.StatusForbidden},
+		{"all allowed", full.Token, auth.ScopeUsersWrite, http.StatusOK},
+		{"API key", key, auth.ScopeAdmin, http.StatusOK},
+		{"outside API key", key, auth.ScopeChirpsWrite, http.StatusForbidden},
+		{"no token", "", auth.ScopeChirpsWrite, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := serve(t, requireScope(tt.scope), "GET", "/", "", tt.token, nil); code != tt.want {
+				t.Fatalf("Got %d, expected %d", code, tt.want)
+			}
+		})
+	}
+
+	// An API key loses the scopes its user's role no longer allows.
+	if _, err := cfg.db.SetUserRole(user.Id, database.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(t, requireScope(auth.ScopeAdmin), "GET", "/", "", key, nil); code != http.StatusForbidden {
+		t.Fatalf("Got %d, expected %d", code, http.StatusForbidden)
+	}
+	// Without middlewareRequireAuth nothing has been granted.
+	if code := serve(t, cfg.middlewareRequireScope(auth.ScopeChirpsWrite)(ok), "GET", "/", "", full.Token, nil); code != http.StatusForbidden {
+		t.Fatalf("Got %d, expected %d", code, http.StatusForbidden)
+	}
+}
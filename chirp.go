@@ -2,112 +2,194 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
 	"github.com/go-chi/chi/v5"
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	AuthorId int    `json:"author_id"`
-	Body     string `json:"body"`
+	Id           int                `json:"id"`
+	AuthorId     int                `json:"author_id"`
+	Body         string             `json:"body"`
+	InReplyTo    int                `json:"in_reply_to,omitempty"`
+	RechirpOf    int                `json:"rechirp_of,omitempty"`
+	Hashtags     []string           `json:"hashtags,omitempty"`
+	Mentions     []database.Mention `json:"mentions,omitempty"`
+	ReplyCount   int                `json:"reply_count"`
+	LikeCount    int                `json:"like_count"`
+	RechirpCount int                `json:"rechirp_count"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
 }
 
-func (cfg *apiConfig) postChirp(w http.ResponseWriter, r *http.Request) {
-	type params struct {
-		Body string `json:"body"`
+func newChirp(chirp database.Chirp) Chirp {
+	return Chirp{
+		Id:           chirp.Id,
+		AuthorId:     chirp.AuthorId,
+		Body:         chirp.Body,
+		InReplyTo:    chirp.InReplyTo,
+		RechirpOf:    chirp.RechirpOf,
+		Hashtags:     chirp.Hashtags,
+		Mentions:     chirp.Mentions,
+		ReplyCount:   chirp.ReplyCount,
+		LikeCount:    chirp.LikeCount,
+		RechirpCount: chirp.RechirpCount,
+		CreatedAt:    chirp.CreatedAt,
+		UpdatedAt:    chirp.UpdatedAt,
 	}
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Token required")
-		return
+}
+
+const maxChirpLength = 140
+
+var (
+	errChirpTooLong  = errors.New("Chirp is too long")
+	errChirpRejected = errors.New("Chirp contains a forbidden word")
+)
+
+// cleanChirpBody checks the length of a chirp and moderates it against the
+// current word list, returning the masked body and the patterns to flag it
+// for.
+func (cfg *apiConfig) cleanChirpBody(body string) (string, []string, error) {
+	if len(body) > maxChirpLength {
+		return "", nil, errChirpTooLong
 	}
-	subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	words, err := cfg.db.GetModerationWords()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Error validating token")
-		return
+		return "", nil, err
 	}
-	id, err := strconv.Atoi(subject)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid id")
-		return
+	result := database.Moderate(words, body)
+	if len(result.Rejected) > 0 {
+		return "", nil, errChirpRejected
 	}
+	return result.Body, result.Flagged, nil
+}
+
+func (cfg *apiConfig) postChirp(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+	}
+	caller, _ := currentUser(r)
+	id := caller.Id
+
 	decoder := json.NewDecoder(r.Body)
 	toValidate := params{}
-	err = decoder.Decode(&toValidate)
+	err := decoder.Decode(&toValidate)
 	if err != nil {
 		log.Printf("Error decoding chirp body: %s\n", err)
 		respondWithError(w, 500, "Something went wrong")
 		return
 	}
 
-	if len(toValidate.Body) > 140 {
-		respondWithError(w, 400, "Chirp is too long")
+	body, flags, err := cfg.cleanChirpBody(toValidate.Body)
+	if errors.Is(err, errChirpTooLong) || errors.Is(err, errChirpRejected) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error moderating chirp: ", err)
+		respondWithError(w, 500, "Something went wrong")
 		return
 	}
 
-	badwords := map[string]bool{
-		"kerfuffle": true,
-		"sharbert":  true,
-		"fornax":    true,
+	chirp, err := cfg.db.CreateReply(body, id, toValidate.InReplyTo, flags)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Chirp being replied to does not exist")
+		return
 	}
-	chirp, err := cfg.db.CreateChirp(replaceBadWords(toValidate.Body, badwords), id)
 	if err != nil {
-		log.Fatalln("Error creating chirp: ", err)
+		log.Println("Error creating chirp: ", err)
 		respondWithError(w, 500, "Something went wrong")
 		return
 	}
-	respondWithJSON(w, 201, Chirp{
-		Id:       chirp.Id,
-		AuthorId: chirp.AuthorId,
-		Body:     chirp.Body,
-	})
+	respondWithJSON(w, 201, newChirp(chirp))
 }
 
+// getChirps returns one page of chirps, optionally by one author.
 func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
-	dbChirps, err := cfg.db.GetChirps()
-
-	authorId := -1
+	query := database.ChirpQuery{}
 	authorIdParam := r.URL.Query().Get("author_id")
 	if authorIdParam != "" {
-		authorId, err = strconv.Atoi(authorIdParam)
+		var err error
+		query.AuthorId, err = strconv.Atoi(authorIdParam)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error with author id")
+			respondWithError(w, http.StatusBadRequest, "Invalid author id")
 			return
 		}
 	}
+	cfg.respondWithChirpPage(w, r, query)
+}
 
-	chirps := []Chirp{}
-	for _, chirp := range dbChirps {
-		if authorId != -1 && chirp.AuthorId != authorId {
-			continue
-		}
-		chirps = append(chirps, Chirp{
-			Id:       chirp.Id,
-			AuthorId: chirp.AuthorId,
-			Body:     chirp.Body,
+// respondWithChirpPage responds with one page of the chirps matching the
+// filters in query, as picked by the request's pagination parameters. The
+// Link header carries the cursor for the next page, if there is one.
+func (cfg *apiConfig) respondWithChirpPage(w http.ResponseWriter, r *http.Request,
+	query database.ChirpQuery) {
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.AfterId = cursor.AfterId
+	query.Desc = cursor.Desc
+	// One extra chirp tells us whether there is a next page.
+	query.Limit = limit + 1
+
+	dbChirps, err := cfg.db.GetChirpsPage(query)
+	if err != nil {
+		log.Println("Error getting chirps, ", err)
+		respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	if len(dbChirps) > limit {
+		dbChirps = dbChirps[:limit]
+		setNextLink(w, r, pageCursor{
+			AfterId: dbChirps[limit-1].Id,
+			Desc:    cursor.Desc,
 		})
 	}
-	sortFunc := func(i, j int) bool {
-		return chirps[i].Id < chirps[j].Id
+
+	chirps := make([]Chirp, 0, len(dbChirps))
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, newChirp(chirp))
 	}
-	if r.URL.Query().Get("sort") == "desc" {
-		sortFunc = func(i, j int) bool {
-			return chirps[i].Id > chirps[j].Id
-		}
+	respondWithJSON(w, 200, chirps)
+}
+
+// getHashtagChirps returns one page of the chirps tagged with a hashtag.
+func (cfg *apiConfig) getHashtagChirps(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(strings.TrimPrefix(chi.URLParam(r, "tag"), "#"))
+	if tag == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid hashtag")
+		return
 	}
-	sort.Slice(chirps, sortFunc)
+	cfg.respondWithChirpPage(w, r, database.ChirpQuery{Hashtag: tag})
+}
+
+// getMentions returns one page of the chirps mentioning a user, as @<id>.
+func (cfg *apiConfig) getMentions(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "userid"))
 	if err != nil {
-		log.Fatalln("Error getting chirps, ", err)
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
 		return
 	}
-	respondWithJSON(w, 200, chirps)
+	if _, err := cfg.db.GetUserById(userId); errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Println("Error getting user: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	cfg.respondWithChirpPage(w, r, database.ChirpQuery{MentionedUserId: userId})
 }
 
 func (cfg *apiConfig) getChirp(w http.ResponseWriter, r *http.Request) {
@@ -120,78 +202,142 @@ func (cfg *apiConfig) getChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chirp, found, err := cfg.db.GetChirpById(chirpid)
-	if err != nil {
-		log.Fatalln("Error retrieving chirp, ", err)
-		respondWithError(w, 500, "Something went wrong")
+	chirp, ok := cfg.visibleChirp(w, r, chirpid)
+	if !ok {
 		return
 	}
 
-	if !found {
-		respondWithError(w, 404, "Chirp not found")
-		return
+	respondWithJSON(w, 200, newChirp(chirp))
+}
+
+// visibleChirp gets a chirp the caller may see, or responds with an error.
+// Hidden chirps, and rechirps of them, stay visible to moderators only.
+func (cfg *apiConfig) visibleChirp(w http.ResponseWriter, r *http.Request, chirpid int) (database.Chirp, bool) {
+	chirp, found, err := cfg.db.GetChirpById(chirpid)
+	hidden := chirp.Hidden
+	if err == nil && found && chirp.RechirpOf != 0 {
+		var original database.Chirp
+		original, _, err = cfg.db.GetChirpById(chirp.RechirpOf)
+		hidden = hidden || original.Hidden
+	}
+	if err != nil {
+		log.Println("Error retrieving chirp, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return database.Chirp{}, false
 	}
 
-	respondWithJSON(w, 200, chirp)
+	if caller, _ := currentUser(r); !found || hidden &&
+		!(database.RoleAllows(caller.Role, database.RoleModerator) && hasScope(r, auth.ScopeAdmin)) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return database.Chirp{}, false
+	}
+	return chirp, true
 }
 
-func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
-	s := chi.URLParam(r, "chirpid")
+// updateChirp lets the author replace the body of a chirp. The previous
+// body is kept in the chirp's history.
+func (cfg *apiConfig) updateChirp(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Body string `json:"body"`
+	}
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
 
-	chirpid, err := strconv.Atoi(s)
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	decoder := json.NewDecoder(r.Body)
+	toValidate := params{}
+	err = decoder.Decode(&toValidate)
 	if err != nil {
-		log.Println("Error converting chirpid, ", err)
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+	body, flags, err := cfg.cleanChirpBody(toValidate.Body)
+	if errors.Is(err, errChirpTooLong) || errors.Is(err, errChirpRejected) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error moderating chirp: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	// The new body replaces any flags raised by the old one.
+	chirp, err := cfg.db.UpdateChirp(chirpid, userId, body, flags)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp does not exist")
+		return
+	}
+	if errors.Is(err, database.ErrNotAuthor) {
+		respondWithError(w, http.StatusForbidden, "Not authorized")
+		return
+	}
+	if errors.Is(err, database.ErrRechirpEdit) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Token required")
+		log.Println("Error updating chirp: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Error updating chirp")
 		return
 	}
-	subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	respondWithJSON(w, http.StatusOK, newChirp(chirp))
+}
+
+// getChirpHistory lists the previous revisions of a chirp, oldest first.
+func (cfg *apiConfig) getChirpHistory(w http.ResponseWriter, r *http.Request) {
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Error validating token")
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+	if _, ok := cfg.visibleChirp(w, r, chirpid); !ok {
+		return
+	}
+
+	revisions, err := cfg.db.GetChirpHistory(chirpid)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
 		return
 	}
-	userId, err := strconv.Atoi(subject)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid id")
+		log.Println("Error getting chirp history: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
+	respondWithJSON(w, http.StatusOK, revisions)
+}
 
-	chirp, found, err := cfg.db.GetChirpById(chirpid)
+func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
+	s := chi.URLParam(r, "chirpid")
+
+	chirpid, err := strconv.Atoi(s)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting chirp")
+		log.Println("Error converting chirpid, ", err)
+		respondWithError(w, 500, "Something went wrong")
 		return
 	}
-	if !found {
+
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	err = cfg.db.DeleteChirpByAuthor(chirpid, userId)
+	if errors.Is(err, database.ErrChirpNotFound) {
 		respondWithError(w, http.StatusNotFound, "Chirp does not exist")
 		return
 	}
-
-	if chirp.AuthorId != userId {
+	if errors.Is(err, database.ErrNotAuthor) {
 		respondWithError(w, http.StatusForbidden, "Not authorized")
 		return
 	}
-
-	err = cfg.db.DeleteChirp(chirpid)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error deleting chirp")
 		return
 	}
 	respondWithJSON(w, http.StatusOK, struct{}{})
 }
-
-func replaceBadWords(chirp string, badwords map[string]bool) string {
-	words := strings.Split(chirp, " ")
-	cleanedWords := make([]string, 0, len(words))
-	for _, word := range words {
-		if _, found := badwords[strings.ToLower(word)]; found {
-			word = "****"
-		}
-		cleanedWords = append(cleanedWords, word)
-	}
-	return strings.Join(cleanedWords, " ")
-}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHiddenChirp(t *testing.T) {
+	cfg := newTestConfig(t)
+	user := createTestUser(t, cfg, "user@example.com")
+	moderator := createTestUserWithRole(t, cfg, "moderator@example.com", database.RoleModerator)
+	author, err := cfg.db.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := cfg.db.CreateChirp("Hidden", author.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rechirp made before the chirp was hidden hides with it.
+	rechirp, err := cfg.db.Rechirp(hidden.Id, author.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.ModerateChirp(hidden.Id, author.Id, database.ActionHide); err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(cfg.middlewareOptionalAuth)
+	r.Get("/api/chirps/{chirpid}", cfg.getChirp)
+	r.Get("/api/chirps/{chirpid}/history", cfg.getChirpHistory)
+	r.Get("/api/chirps/{chirpid}/likers", cfg.getLikers)
+	r.Post("/api/chirps/{chirpid}/like", cfg.likeChirp)
+	r.Post("/api/chirps/{chirpid}/rechirp", cfg.rechirp)
+	r.Delete("/api/chirps/{chirpid}/rechirp", cfg.unrechirp)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"chirp", "GET", "/api/chirps/%d", user.Token, http.StatusNotFound},
+		{"chirp anonymous", "GET", "/api/chirps/%d", "", http.StatusNotFound},
+		{"history", "GET", "/api/chirps/%d/history", user.Token, http.StatusNotFound},
+		{"history anonymous", "GET", "/api/chirps/%d/history", "", http.StatusNotFound},
+		{"likers", "GET", "/api/chirps/%d/likers", user.Token, http.StatusNotFound},
+		{"like", "POST", "/api/chirps/%d/like", user.Token, http.StatusNotFound},
+		{"rechirp", "POST", "/api/chirps/%d/rechirp", user.Token, http.StatusNotFound},
+		{"unrechirp", "DELETE", "/api/chirps/%d/rechirp", user.Token, http.StatusNotFound},
+		{"chirp as moderator", "GET", "/api/chirps/%d", moderator.Token, http.StatusOK},
+		{"history as moderator", "GET", "/api/chirps/%d/history", moderator.Token, http.StatusOK},
+		{"likers as moderator", "GET", "/api/chirps/%d/likers", moderator.Token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, id := range []int{hidden.Id, rechirp.Id} {
+			t.Run(tt.name+" "+strconv.Itoa(id), func(t *testing.T) {
+				path := fmt.Sprintf(tt.path, id)
+				if code := serve(t, r, tt.method, path, "", tt.token, nil); code != tt.want {
+					t.Fatalf("Got %d, expected %d", code, tt.want)
+				}
+			})
+		}
+	}
+}
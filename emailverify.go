@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+// emailVerificationTTL is how long an email verification link works.
+const emailVerificationTTL = 48 * time.Hour
+
+const maxEmailLength = 254
+
+var errInvalidEmail = errors.New("Invalid email")
+
+// normalizeEmail checks that email is a plain address at a domain, such
+// as a@example.com, and lowercases it.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if len(email) > maxEmailLength {
+		return "", errInvalidEmail
+	}
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errInvalidEmail
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errInvalidEmail
+	}
+	return strings.ToLower(email), nil
+}
+
+// lookupEmail returns the address to look a user up by: email
+// normalized, or just trimmed if it doesn't normalize, so that accounts
+// from before addresses were checked can still be found.
+func lookupEmail(email string) string {
+	if normalized, err := normalizeEmail(email); err == nil {
+		return normalized
+	}
+	return strings.TrimSpace(email)
+}
+
+// sendVerification emails a link verifying email to the user, who is
+// switched over to it once it is followed if it isn't their current
+// address. It fails with database.ErrUserExists if another user has the
+// address.
+func (cfg *apiConfig) sendVerification(userId int, email string) error {
+	token, hash, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateEmailVerification(userId, email, hash, time.Now().UTC().Add(emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+	link := cfg.publicUrl + "/app/verify-email.html?token=" + url.QueryEscape(token)
+	cfg.sendMail(mail.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email",
+		Body: fmt.Sprintf("To confirm that this is the email of your Chirpy account, follow this link "+
+			"within %d hours:\n\n%s\n\nIf you don't have a Chirpy account, you can ignore this email.\n",
+			int(emailVerificationTTL.Hours()), link),
+	})
+	return nil
+}
+
+// verifyEmail verifies the address a token from sendVerification was sent
+// to. verify-email.html posts the token from the link.
+func (cfg *apiConfig) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	type response struct {
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+
+	user, err := cfg.db.VerifyEmail(auth.HashOneTimeToken(params.Token))
+	if errors.Is(err, database.ErrEmailVerificationNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	if errors.Is(err, database.ErrUserExists) {
+		respondWithError(w, http.StatusConflict, "Email already in use")
+		return
+	}
+	if err != nil {
+		log.Println("Error verifying email: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	})
+}
+
+// resendVerification sends the caller a new verification link for the
+// address they are changing to, or else for their unverified one.
+func (cfg *apiConfig) resendVerification(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	email := caller.PendingEmail
+	if email == "" {
+		if caller.EmailVerified {
+			respondWithError(w, http.StatusBadRequest, "Email already verified")
+			return
+		}
+		email = caller.Email
+	}
+	err := cfg.sendVerification(caller.Id, email)
+	if errors.Is(err, database.ErrUserExists) {
+		respondWithError(w, http.StatusConflict, "Email already in use")
+		return
+	}
+	if err != nil {
+		log.Println("Error sending verification: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// middlewareRequireVerifiedEmail keeps users who haven't verified their
+// email from creating or changing content, if the policy asks for it:
+// posting, editing, rechirping and reporting. Deleting and liking stay
+// open, as they can't be used to spread anything.
+func (cfg *apiConfig) middlewareRequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caller, _ := currentUser(r); cfg.requireVerifiedEmail && !caller.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Email not verified")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEmailVerification(t *testing.T) {
+	cfg := newTestConfig(t)
+	tokens := createTestUser(t, cfg, "A@Example.com")
+	msg, token := waitForMail(t, cfg, "a@example.com", "Verify your Chirpy email")
+	if !strings.Contains(msg.Body, cfg.publicUrl+"/app/verify-email.html?token=") {
+		t.Fatalf("Unexpected link in %q", msg.Body)
+	}
+	// The link leads to a page /app serves.
+	if _, err := os.Stat("public/verify-email.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.requireVerifiedEmail = true
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, struct{}{})
+	})
+	requireVerified := cfg.middlewareRequireAuth(cfg.middlewareRequireVerifiedEmail(ok))
+	if code := serve(t, requireVerified, "POST", "/api/chirps", "", tokens.Token, nil); code != http.StatusForbidden {
+		t.Fatalf("Got %d, expected %d", code, http.StatusForbidden)
+	}
+
+	verify := http.HandlerFunc(cfg.verifyEmail)
+	if code := serve(t, verify, "POST", "/api/users/verify", `{"token":"wrong"}`, "", nil); code != http.StatusBadRequest {
+		t.Fatalf("Got %d, expected %d", code, http.StatusBadRequest)
+	}
+	if code := serve(t, verify, "POST", "/api/users/verify", `{"token":"`+token+`"}`, "", nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if code := serve(t, requireVerified, "POST", "/api/chirps", "", tokens.Token, nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+
+	// Lookups by email are normalized like signups.
+	tokens = loginTestUser(t, cfg, " A@EXAMPLE.com", "password")
+	forgot := http.HandlerFunc(cfg.forgotPassword)
+	if code := serve(t, forgot, "POST", "/api/password/forgot", `{"email":"A@example.COM "}`, "", nil); code != http.StatusAccepted {
+		t.Fatalf("Got %d, expected %d", code, http.StatusAccepted)
+	}
+	waitForMail(t, cfg, "a@example.com", "Reset your Chirpy password")
+
+	type user struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		PendingEmail  string `json:"pending_email"`
+	}
+	update := cfg.middlewareRequireAuth(http.HandlerFunc(cfg.updateUser))
+	got := user{}
+	body := `{"email":"b@example.com","password":"password"}`
+	if code := serve(t, update, "PUT", "/api/users", body, tokens.Token, &got); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if got != (user{Email: "a@example.com", EmailVerified: true, PendingEmail: "b@example.com"}) {
+		t.Fatalf("Unexpected user: %+v", got)
+	}
+	_, changeToken := waitForMail(t, cfg, "b@example.com", "Verify your Chirpy email")
+
+	// Sending the current email again takes the change back, and the link
+	// sent for it stops working.
+	got = user{}
+	body = `{"email":"a@example.com","password":"password"}`
+	if code := serve(t, update, "PUT", "/api/users", body, tokens.Token, &got); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+	if got != (user{Email: "a@example.com", EmailVerified: true}) {
+		t.Fatalf("Unexpected user: %+v", got)
+	}
+	if code := serve(t, verify, "POST", "/api/users/verify", `{"token":"`+changeToken+`"}`, "", nil); code != http.StatusBadRequest {
+		t.Fatalf("Got %d, expected %d", code, http.StatusBadRequest)
+	}
+}
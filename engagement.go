@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func (cfg *apiConfig) likeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engage(w, r, func(chirpid, userId int) (any, error) {
+		return struct{}{}, cfg.db.LikeChirp(chirpid, userId)
+	})
+}
+
+func (cfg *apiConfig) unlikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engage(w, r, func(chirpid, userId int) (any, error) {
+		return struct{}{}, cfg.db.UnlikeChirp(chirpid, userId)
+	})
+}
+
+// rechirp responds with the caller's rechirp, which is only created the
+// first time.
+func (cfg *apiConfig) rechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engage(w, r, func(chirpid, userId int) (any, error) {
+		rechirp, err := cfg.db.Rechirp(chirpid, userId)
+		return newChirp(rechirp), err
+	})
+}
+
+func (cfg *apiConfig) unrechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.engage(w, r, func(chirpid, userId int) (any, error) {
+		return struct{}{}, cfg.db.Unrechirp(chirpid, userId)
+	})
+}
+
+// engage runs action for the caller on the chirp in the path and responds
+// with its result. Chirps the caller may not see count as missing.
+func (cfg *apiConfig) engage(w http.ResponseWriter, r *http.Request,
+	action func(chirpid int, userId int) (any, error)) {
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	if _, ok := cfg.visibleChirp(w, r, chirpid); !ok {
+		return
+	}
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	resp, err := action(chirpid, userId)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error engaging with chirp: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// getLikers lists the users who liked a chirp, with the total count.
+func (cfg *apiConfig) getLikers(w http.ResponseWriter, r *http.Request) {
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, ok := cfg.visibleChirp(w, r, chirpid)
+	if !ok {
+		return
+	}
+	// One extra user tells us whether there is a next page.
+	users, err := cfg.db.GetLikers(chirpid, cursor.AfterId, limit+1)
+	if err != nil {
+		log.Println("Error getting likers: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithUserPage(w, r, chirp.LikeCount, users, limit)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func (cfg *apiConfig) follow(w http.ResponseWriter, r *http.Request) {
+	cfg.changeFollow(w, r, cfg.db.Follow)
+}
+
+func (cfg *apiConfig) unfollow(w http.ResponseWriter, r *http.Request) {
+	cfg.changeFollow(w, r, cfg.db.Unfollow)
+}
+
+// changeFollow applies change to the caller and the user in the path.
+func (cfg *apiConfig) changeFollow(w http.ResponseWriter, r *http.Request,
+	change func(followerId int, followeeId int) error) {
+	followeeId, err := strconv.Atoi(chi.URLParam(r, "userid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	err = change(userId, followeeId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if errors.Is(err, database.ErrSelfFollow) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error changing follow: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+func (cfg *apiConfig) getFollowers(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.GetFollowers, func(followers, _ int) int {
+		return followers
+	})
+}
+
+func (cfg *apiConfig) getFollowing(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.GetFollowing, func(_, following int) int {
+		return following
+	})
+}
+
+// listFollows responds with the total count and one page of the users
+// returned by list.
+func (cfg *apiConfig) listFollows(w http.ResponseWriter, r *http.Request,
+	list func(userId int, afterId int, limit int) ([]database.User, error),
+	count func(followers int, following int) int) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "userid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := cfg.db.GetUserById(userId); errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Println("Error getting user: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	followers, following, err := cfg.db.GetFollowCounts(userId)
+	if err != nil {
+		log.Println("Error counting follows: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	// One extra user tells us whether there is a next page.
+	users, err := list(userId, cursor.AfterId, limit+1)
+	if err != nil {
+		log.Println("Error listing follows: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithUserPage(w, r, count(followers, following), users, limit)
+}
+
+// getTimeline returns one page of chirps by the users the caller follows,
+// newest first.
+func (cfg *apiConfig) getTimeline(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbChirps, err := cfg.db.GetChirpsPage(database.ChirpQuery{
+		FollowedBy: userId,
+		AfterId:    cursor.AfterId,
+		Desc:       true,
+		// One extra chirp tells us whether there is a next page.
+		Limit: limit + 1,
+	})
+	if err != nil {
+		log.Println("Error getting timeline: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if len(dbChirps) > limit {
+		dbChirps = dbChirps[:limit]
+		setNextLink(w, r, pageCursor{AfterId: dbChirps[limit-1].Id, Desc: true})
+	}
+
+	chirps := make([]Chirp, 0, len(dbChirps))
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, newChirp(chirp))
+	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// apiKeyPrefix starts every API key, which tells keys apart from JWTs in
+// the Authorization header.
+const apiKeyPrefix = "chirpy_"
+
+// ApiKeyType is the Type of the claims an API key is authenticated with.
+const ApiKeyType = "api_key"
+
+// MakeApiKey returns a new random API key, the prefix it is displayed by
+// and the hash it is stored by.
+func MakeApiKey() (key, prefix, hash string, err error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	key = apiKeyPrefix + secret
+	return key, key[:len(apiKeyPrefix)+6], HashApiKey(key), nil
+}
+
+// ApiKeyClaims returns the claims an API key of user userId stands for. A
+// zero expiresAt means the key doesn't expire.
+func ApiKeyClaims(userId int, scope string, expiresAt time.Time) *Claims {
+	claims := &Claims{Type: ApiKeyType, Scope: scope}
+	claims.Subject = strconv.Itoa(userId)
+	if !expiresAt.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+	}
+	return claims
+}
+
+// IsApiKey reports whether a bearer token is an API key rather than a JWT.
+func IsApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// HashApiKey returns the hash an API key is stored and looked up by. Keys
+// are long and random, so a fast hash is enough.
+func HashApiKey(key string) string {
+	return hashToken(key)
+}
+
+// randomToken returns 32 random bytes, encoded to go in a URL.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -13,10 +16,29 @@ import (
 )
 
 const (
-	AccessType  string = "chirpy-access"
-	RefreshType string = "chirpy-refresh"
+	// Issuer and Audience are the iss and aud claims of every token.
+	Issuer   = "chirpy"
+	Audience = "chirpy-api"
+
+	// AccessType and RefreshType are the values of the typ claim.
+	AccessType  = "access"
+	RefreshType = "refresh"
+
+	// legacyRefreshIssuer is the issuer of refresh tokens from before the
+	// typ claim.
+	legacyRefreshIssuer = "chirpy-refresh"
 )
 
+// Scopes limit what an access token can do. Reading needs no scope.
+const (
+	ScopeChirpsWrite = "chirps:write"
+	ScopeUsersWrite  = "users:write"
+	ScopeAdmin       = "admin"
+)
+
+// AllScopes lists every scope, in the order tokens list them.
+var AllScopes = []string{ScopeChirpsWrite, ScopeUsersWrite, ScopeAdmin}
+
 func HashPassword(password string) (string, error) {
 	result, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -29,16 +51,79 @@ func CheckPassword(hash, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-func MakeJWT(id int, issuedAt, expiresAt time.Time, issuer, jwtSecret string) (string, error) {
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    issuer,
-			IssuedAt:  jwt.NewNumericDate(issuedAt),
-			ExpiresAt: jwt.NewNumericDate(expiresAt),
-			Subject:   fmt.Sprint(id),
-		})
-	return token.SignedString([]byte(jwtSecret))
+// Claims are the claims of the tokens Chirpy issues. Role and Generation
+// are the user's role and token generation when an access token was
+// issued. Family is the family of a refresh token, whose ID is the
+// standard jti claim. Scope lists the scopes granted, space separated.
+type Claims struct {
+	Type       string `json:"typ"`
+	Scope      string `json:"scope,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Generation int    `json:"gen,omitempty"`
+	Family     string `json:"fam,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// UserId returns the ID of the user the token was issued to.
+func (c *Claims) UserId() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// Scopes returns the scopes granted by the token.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes(), scope)
+}
+
+// Legacy reports whether c are the claims of a refresh token from before
+// token families, which has neither a family nor an ID.
+func (c *Claims) Legacy() bool {
+	return c.Issuer == legacyRefreshIssuer
+}
+
+// MakeJWT signs an access token for user id carrying c's Scope, Role and
+// Generation.
+func MakeJWT(id int, c Claims, issuedAt, expiresAt time.Time, keys *Keyring) (string, error) {
+	tokenId, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
+	c.Type = AccessType
+	c.RegisteredClaims = registeredClaims(id, tokenId, issuedAt, expiresAt)
+	return keys.sign(c, issuedAt)
+}
+
+// MakeRefreshJWT makes the refresh token tokenId of the given family. The
+// access tokens it is traded for get at most scope.
+func MakeRefreshJWT(id int, familyId, tokenId, scope string, issuedAt, expiresAt time.Time, keys *Keyring) (string, error) {
+	return keys.sign(Claims{
+		Type:             RefreshType,
+		Scope:            scope,
+		Family:           familyId,
+		RegisteredClaims: registeredClaims(id, tokenId, issuedAt, expiresAt),
+	}, issuedAt)
+}
+
+func registeredClaims(id int, tokenId string, issuedAt, expiresAt time.Time) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    Issuer,
+		Audience:  jwt.ClaimStrings{Audience},
+		ID:        tokenId,
+		IssuedAt:  jwt.NewNumericDate(issuedAt),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		Subject:   fmt.Sprint(id),
+	}
+}
+
+func newTokenId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -70,68 +155,66 @@ func ValidatePolkaKey(headers http.Header, polkaKey string) error {
 	return nil
 }
 
-func ValidateJWT(token, jwtSecret string) (string, error) {
-	parsedToken, err := jwt.ParseWithClaims(
-		token,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) { return []byte(jwtSecret), nil },
-	)
-	if err != nil {
-		return "", err
-	}
+// ErrTokenRevoked is returned for an access token from an older token
+// generation of its user.
+var ErrTokenRevoked = errors.New("token revoked")
 
-	issuer, err := parsedToken.Claims.GetIssuer()
+// ValidateJWT validates an access token and returns its claims. Logging
+// out everywhere bumps a user's token generation, so a token only stays
+// good while its Generation is the one generation returns for the user.
+// Errors from generation are returned as they are.
+func ValidateJWT(token string, keys *Keyring, generation func(userId int) (int, error)) (*Claims, error) {
+	claims, err := parseToken(token, AccessType, keys)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	if issuer != AccessType {
-		return "", errors.New("invalid issuer")
+	userId, err := claims.UserId()
+	if err != nil {
+		return nil, err
 	}
-
-	subject, err := parsedToken.Claims.GetSubject()
+	current, err := generation(userId)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if claims.Generation != current {
+		return nil, ErrTokenRevoked
 	}
-	return subject, err
+	return claims, nil
 }
 
-func RefreshToken(token, jwtSecret string) (string, error) {
-	parsedToken, err := jwt.ParseWithClaims(
-		token,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) { return []byte(jwtSecret), nil },
-	)
+// ValidateRefreshToken validates a refresh token and returns its claims.
+// The caller checks that the token is still the current one of its
+// family, or for a Legacy token that it hasn't been revoked.
+func ValidateRefreshToken(token string, keys *Keyring) (*Claims, error) {
+	parsed, err := parseToken(token, RefreshType, keys)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !parsed.Legacy() && (parsed.Family == "" || parsed.ID == "") {
+		return nil, errors.New("no token family")
 	}
+	return parsed, nil
+}
 
-	issuer, err := parsedToken.Claims.GetIssuer()
+func parseToken(token, typ string, keys *Keyring) (*Claims, error) {
+	parsed := &Claims{}
+	_, err := jwt.ParseWithClaims(token, parsed, keys.keyFunc)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	if issuer != RefreshType {
-		return "", errors.New("invalid issuer")
+	if parsed.Type == "" && parsed.Issuer == legacyRefreshIssuer {
+		// Refresh tokens from before the typ claim told their type by
+		// their issuer, and had no scope limit.
+		parsed.Type = RefreshType
+		parsed.Scope = strings.Join(AllScopes, " ")
+	} else if parsed.Issuer != Issuer || !slices.Contains(parsed.Audience, Audience) {
+		return nil, errors.New("invalid issuer or audience")
 	}
-
-	subject, err := parsedToken.Claims.GetSubject()
-	if err != nil {
-		return "", err
+	if parsed.Type != typ {
+		return nil, fmt.Errorf("not a %s token", typ)
 	}
-
-	id, err := strconv.Atoi(subject)
-	if err != nil {
-		return "", err
+	if parsed.Subject == "" {
+		return nil, errors.New("no subject")
 	}
-
-	now := time.Now().UTC()
-	expiresAt := now.Add(time.Hour)
-	return MakeJWT(
-		id,
-		now,
-		expiresAt,
-		AccessType,
-		jwtSecret,
-	)
+	return parsed, nil
 }
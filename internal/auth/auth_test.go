@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fixedGeneration is a token generation lookup that finds gen for every
+// user.
+func fixedGeneration(gen int) func(int) (int, error) {
+	return func(int) (int, error) { return gen, nil }
+}
+
+func TestClaims(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeyring(t, NewHMACKey("", []byte("secret")))
+	token, err := MakeJWT(42, Claims{Scope: "chirps:write admin", Role: "admin", Generation: 3},
+		now, now.Add(time.Hour), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateJWT(token, keys, fixedGeneration(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := claims.UserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Fatalf("Got %d, expected 42", id)
+	}
+	if !slices.Equal(claims.Scopes(), []string{ScopeChirpsWrite, ScopeAdmin}) {
+		t.Fatalf("Got %v, expected [%s %s]", claims.Scopes(), ScopeChirpsWrite, ScopeAdmin)
+	}
+	if !claims.HasScope(ScopeAdmin) || claims.HasScope(ScopeUsersWrite) {
+		t.Fatalf("Wrong scopes: %q", claims.Scope)
+	}
+	if claims.Role != "admin" || claims.Generation != 3 || claims.ID == "" || claims.Legacy() {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+
+	if scopes := (&Claims{}).Scopes(); len(scopes) != 0 {
+		t.Fatalf("Got %v, expected no scopes", scopes)
+	}
+	if _, err := (&Claims{}).UserId(); err == nil {
+		t.Fatal("Got a user id without a subject")
+	}
+}
+
+func TestValidateJWTGeneration(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeyring(t, NewHMACKey("", []byte("secret")))
+	token, err := MakeJWT(42, Claims{Generation: 2}, now, now.Add(time.Hour), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var looked int
+	if _, err := ValidateJWT(token, keys, func(userId int) (int, error) {
+		looked = userId
+		return 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if looked != 42 {
+		t.Fatalf("Looked up user %d, expected 42", looked)
+	}
+	// Logging out everywhere bumped the generation.
+	if _, err := ValidateJWT(token, keys, fixedGeneration(3)); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrTokenRevoked", err)
+	}
+	lookupErr := errors.New("no such user")
+	if _, err := ValidateJWT(token, keys, func(int) (int, error) { return 0, lookupErr }); !errors.Is(err, lookupErr) {
+		t.Fatalf("Got %v, expected the lookup error", err)
+	}
+}
+
+func TestRefreshClaims(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeyring(t, NewHMACKey("", []byte("secret")))
+	token, err := MakeRefreshJWT(42, "family", "token", ScopeChirpsWrite, now, now.Add(time.Hour), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateRefreshToken(token, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Family != "family" || claims.ID != "token" || claims.Scope != ScopeChirpsWrite || claims.Legacy() {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+	if _, err := ValidateJWT(token, keys, fixedGeneration(0)); err == nil {
+		t.Fatal("Refresh token accepted as an access token")
+	}
+}
+
+// TestParseToken checks which claims make a token be refused, signing each
+// one directly so that any claim can be wrong.
+func TestParseToken(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeyring(t, NewHMACKey("", []byte("secret")))
+	valid := func(typ string) Claims {
+		return Claims{Type: typ, Family: "family", RegisteredClaims: registeredClaims(42, "token", now, now.Add(time.Hour))}
+	}
+	// Refresh tokens from before the typ claim, which had neither a
+	// family nor an ID.
+	legacy := Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    legacyRefreshIssuer,
+		Subject:   "42",
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}}
+
+	tests := []struct {
+		name    string
+		claims  func() Claims
+		typ     string
+		wantErr bool
+	}{
+		{"access", func() Claims { return valid(AccessType) }, AccessType, false},
+		{"refresh", func() Claims { return valid(RefreshType) }, RefreshType, false},
+		{"legacy refresh", func() Claims { return legacy }, RefreshType, false},
+		{"legacy refresh as access", func() Claims { return legacy }, AccessType, true},
+		{"refresh as access", func() Claims { return valid(RefreshType) }, AccessType, true},
+		{"access as refresh", func() Claims { return valid(AccessType) }, RefreshType, true},
+		{"API key type", func() Claims { return valid(ApiKeyType) }, AccessType, true},
+		{"no typ", func() Claims { return valid("") }, AccessType, true},
+		{"wrong issuer", func() Claims {
+			c := valid(AccessType)
+			c.Issuer = "other"
+			return c
+		}, AccessType, true},
+		{"legacy issuer with typ", func() Claims {
+			c := valid(RefreshType)
+			c.Issuer = legacyRefreshIssuer
+			return c
+		}, RefreshType, true},
+		{"wrong audience", func() Claims {
+			c := valid(AccessType)
+			c.Audience = jwt.ClaimStrings{"other"}
+			return c
+		}, AccessType, true},
+		{"no audience", func() Claims {
+			c := valid(AccessType)
+			c.Audience = nil
+			return c
+		}, AccessType, true},
+		{"no subject", func() Claims {
+			c := valid(AccessType)
+			c.Subject = ""
+			return c
+		}, AccessType, true},
+		{"expired", func() Claims {
+			c := valid(AccessType)
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+			return c
+		}, AccessType, true},
+		{"refresh without family", func() Claims {
+			c := valid(RefreshType)
+			c.Family = ""
+			return c
+		}, RefreshType, true},
+		{"refresh without id", func() Claims {
+			c := valid(RefreshType)
+			c.ID = ""
+			return c
+		}, RefreshType, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := keys.sign(tt.claims(), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.typ == RefreshType {
+				_, err = ValidateRefreshToken(token, keys)
+			} else {
+				_, err = ValidateJWT(token, keys, fixedGeneration(0))
+			}
+			if tt.wantErr && err == nil {
+				t.Fatal("Token accepted")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("Token rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestLegacyRefreshClaims(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeyring(t, NewHMACKey("", []byte("secret")))
+	token, err := keys.sign(Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    legacyRefreshIssuer,
+		Subject:   "42",
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateRefreshToken(token, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// They had no scope limit.
+	if !claims.Legacy() || claims.Type != RefreshType || !slices.Equal(claims.Scopes(), AllScopes) {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+}
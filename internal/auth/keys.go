@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a key tokens are signed or verified with. A key signs tokens from
+// NotBefore on and verifies them until NotAfter; a zero time means no
+// limit. Keys loaded from a public key alone only verify.
+type Key struct {
+	Id        string
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	method  jwt.SigningMethod
+	private any
+	public  any
+}
+
+// NewHMACKey returns an HS256 key. Its secret both signs and verifies, so
+// it is never published.
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{Id: id, method: jwt.SigningMethodHS256, private: secret, public: secret}
+}
+
+// ParseKey parses a PEM encoded RSA or Ed25519 key, private or public.
+// RSA keys sign with RS256 and Ed25519 keys with EdDSA.
+func ParseKey(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM data")
+	}
+	key := Key{Id: id}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key.method = jwt.SigningMethodRS256
+		key.private, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case "PRIVATE KEY":
+		// PKCS #8 holds either kind.
+		if key.private, err = jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+			key.method = jwt.SigningMethodEdDSA
+		} else if key.private, err = jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			key.method = jwt.SigningMethodRS256
+		}
+	case "RSA PUBLIC KEY":
+		key.method = jwt.SigningMethodRS256
+		key.public, err = jwt.ParseRSAPublicKeyFromPEM(data)
+	case "PUBLIC KEY":
+		if key.public, err = jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+			key.method = jwt.SigningMethodEdDSA
+		} else if key.public, err = jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+			key.method = jwt.SigningMethodRS256
+		}
+	default:
+		return Key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	switch private := key.private.(type) {
+	case *rsa.PrivateKey:
+		key.public = &private.PublicKey
+	case ed25519.PrivateKey:
+		key.public = private.Public()
+	}
+	return key, nil
+}
+
+// Algorithm returns the JWT algorithm the key is used with.
+func (k Key) Algorithm() string {
+	return k.method.Alg()
+}
+
+func (k Key) verifies(now time.Time) bool {
+	return k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+func (k Key) signs(now time.Time) bool {
+	return k.private != nil && !now.Before(k.NotBefore) && k.verifies(now)
+}
+
+// Keyring holds every key tokens may be signed or verified with. Adding the
+// next key with a NotBefore in the future, and giving the current one a
+// NotAfter past its last tokens' expiry, rotates keys without
+// invalidating any token.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring returns a keyring of keys, which must have distinct IDs. At
+// most one key, typically a legacy HMAC secret, may have an empty ID; it
+// verifies tokens without a kid header.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key.Id] {
+			return nil, fmt.Errorf("duplicate key id %q", key.Id)
+		}
+		seen[key.Id] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// signingKey returns the key with the latest NotBefore that can sign at
+// now. Of keys with the same NotBefore the last one wins.
+func (k *Keyring) signingKey(now time.Time) (Key, error) {
+	var signing *Key
+	for i, key := range k.keys {
+		if key.signs(now) && (signing == nil || !key.NotBefore.Before(signing.NotBefore)) {
+			signing = &k.keys[i]
+		}
+	}
+	if signing == nil {
+		return Key{}, errors.New("no signing key")
+	}
+	return *signing, nil
+}
+
+// verifyingKey returns the key a token with the given kid header was
+// signed with, if it is still valid.
+func (k *Keyring) verifyingKey(id string, now time.Time) (Key, error) {
+	for _, key := range k.keys {
+		if key.Id != id {
+			continue
+		}
+		if !key.verifies(now) {
+			return Key{}, fmt.Errorf("key %q has expired", id)
+		}
+		return key, nil
+	}
+	return Key{}, fmt.Errorf("unknown key %q", id)
+}
+
+func (k *Keyring) sign(c Claims, issuedAt time.Time) (string, error) {
+	key, err := k.signingKey(issuedAt)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method, c)
+	if key.Id != "" {
+		token.Header["kid"] = key.Id
+	}
+	return token.SignedString(key.private)
+}
+
+// keyFunc picks the key to verify a token with by its kid header, refusing
+// tokens signed with any other algorithm than the key's.
+func (k *Keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key, err := k.verifyingKey(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %q is not used with %s", id, token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Id        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N and E are the modulus and exponent of an RSA key.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and X are the curve and public key of an Ed25519 key.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys that still verify tokens, including ones
+// that haven't started signing yet so that verifiers can fetch them in
+// advance. HMAC keys are secret and left out.
+func (k *Keyring) JWKS() []JWK {
+	now := time.Now()
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		if !key.verifies(now) {
+			continue
+		}
+		jwk := JWK{Id: key.Id, Use: "sig", Algorithm: key.Algorithm()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// LoadKeyring builds the keyring from the key manifest at path, a JSON list
+// of entries like
+//
+//	{"kid": "2026-10", "key": "keys/2026-10.pem",
+//	 "not_before": "2026-10-01T00:00:00Z", "not_after": "2027-01-01T00:00:00Z"}
+//
+// where key is a PEM file relative to the manifest and the times are
+// optional. A non-empty secret is added as an HS256 key without an ID, so
+// tokens from before key rotation keep working. Either may be empty, but
+// not both.
+func LoadKeyring(path, secret string) (*Keyring, error) {
+	keys := []Key{}
+	if secret != "" {
+		keys = append(keys, NewHMACKey("", []byte(secret)))
+	}
+	if path != "" {
+		loaded, err := loadKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, loaded...)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys configured")
+	}
+	return NewKeyring(keys...)
+}
+
+func loadKeys(path string) ([]Key, error) {
+	type entry struct {
+		Id        string    `json:"kid"`
+		Key       string    `json:"key"`
+		NotBefore time.Time `json:"not_before"`
+		NotAfter  time.Time `json:"not_after"`
+	}
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []entry{}
+	if err := json.Unmarshal(dat, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	keys := make([]Key, 0, len(entries))
+	for _, e := range entries {
+		if e.Id == "" {
+			return nil, fmt.Errorf("%s: key without kid", path)
+		}
+		keyPath := e.Key
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		pemData, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseKey(e.Id, pemData)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", e.Id, err)
+		}
+		key.NotBefore = e.NotBefore
+		key.NotAfter = e.NotAfter
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
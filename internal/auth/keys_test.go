@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testRSAKey is generated once, as RSA key generation is slow.
+var testRSAKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func rsaPrivatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRSAKey)})
+}
+
+func publicPEM(t *testing.T, public any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func ed25519PrivatePEM(t *testing.T) (ed25519.PublicKey, []byte) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func parseTestKey(t *testing.T, id string, data []byte) Key {
+	t.Helper()
+	key, err := ParseKey(id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestSigningKey(t *testing.T) {
+	now := time.Now()
+	current := NewHMACKey("current", []byte("a"))
+	current.NotAfter = now.Add(10 * 24 * time.Hour)
+	next := NewHMACKey("next", []byte("b"))
+	next.NotBefore = now.Add(5 * 24 * time.Hour)
+	_, edPEM := ed25519PrivatePEM(t)
+	verifyOnly := parseTestKey(t, "public", publicPEM(t, &testRSAKey.PublicKey))
+	keyring := newTestKeyring(t, current, next, verifyOnly, parseTestKey(t, "old", edPEM))
+	keyring.keys[3].NotAfter = now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want string
+	}{
+		{"before rotation", now, "current"},
+		{"during overlap", now.Add(6 * 24 * time.Hour), "next"},
+		{"after current expires", now.Add(11 * 24 * time.Hour), "next"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := keyring.signingKey(tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Id != tt.want {
+				t.Fatalf("Got %q, expected %q", key.Id, tt.want)
+			}
+		})
+	}
+
+	if _, err := newTestKeyring(t, verifyOnly).signingKey(now); err == nil {
+		t.Fatal("Signed with a public key")
+	}
+	if _, err := NewKeyring(current, current); err == nil {
+		t.Fatal("Accepted duplicate key ids")
+	}
+}
+
+func TestVerifyingKey(t *testing.T) {
+	now := time.Now()
+	_, edPEM := ed25519PrivatePEM(t)
+	rsaKey := parseTestKey(t, "rsa", rsaPrivatePEM())
+	edKey := parseTestKey(t, "ed", edPEM)
+	legacy := NewHMACKey("", []byte("secret"))
+	expired := rsaKey
+	expired.NotAfter = now.Add(-time.Minute)
+	// A key that hasn't started signing already verifies.
+	early := edKey
+	early.NotBefore = now.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		signer  Key
+		keyring []Key
+		wantErr bool
+	}{
+		{"RSA", rsaKey, []Key{legacy, rsaKey, edKey}, false},
+		{"Ed25519", edKey, []Key{legacy, rsaKey, edKey}, false},
+		{"no kid", legacy, []Key{legacy, rsaKey}, false},
+		{"public key only", rsaKey, []Key{parseTestKey(t, "rsa", publicPEM(t, &testRSAKey.PublicKey))}, false},
+		{"not yet signing", edKey, []Key{early}, false},
+		{"unknown kid", edKey, []Key{legacy, rsaKey}, true},
+		{"no kid without legacy key", legacy, []Key{rsaKey}, true},
+		{"expired key", rsaKey, []Key{expired}, true},
+		{"kid of another key", parseTestKey(t, "rsa", edPEM), []Key{rsaKey}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MakeJWT(1, Claims{}, now, now.Add(time.Hour), newTestKeyring(t, tt.signer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ValidateJWT(token, newTestKeyring(t, tt.keyring...), fixedGeneration(0))
+			if tt.wantErr && err == nil {
+				t.Fatal("Token accepted")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("Token rejected: %v", err)
+			}
+		})
+	}
+}
+
+// TestAlgorithmMismatch checks that a token can't pick how it is verified:
+// signing HS256 with the published RSA public key as the secret must not
+// pass as an RS256 token.
+func TestAlgorithmMismatch(t *testing.T) {
+	now := time.Now()
+	public := publicPEM(t, &testRSAKey.PublicKey)
+	keyring := newTestKeyring(t, parseTestKey(t, "rsa", public))
+	claims := Claims{Type: AccessType, RegisteredClaims: registeredClaims(1, "id", now, now.Add(time.Hour))}
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    any
+	}{
+		{"HS256 with public key PEM", jwt.SigningMethodHS256, public},
+		{"HS256 with public key DER", jwt.SigningMethodHS256, x509.MarshalPKCS1PublicKey(&testRSAKey.PublicKey)},
+		{"PS256 with RSA key", jwt.SigningMethodPS256, testRSAKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := jwt.NewWithClaims(tt.method, claims)
+			token.Header["kid"] = "rsa"
+			signed, err := token.SignedString(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ValidateJWT(signed, keyring, fixedGeneration(0)); err == nil {
+				t.Fatal("Token accepted")
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	now := time.Now()
+	edPublic, edPEM := ed25519PrivatePEM(t)
+	expired := parseTestKey(t, "expired", rsaPrivatePEM())
+	expired.NotAfter = now.Add(-time.Minute)
+	next := parseTestKey(t, "next", edPEM)
+	next.NotBefore = now.Add(time.Hour)
+	keyring := newTestKeyring(t,
+		NewHMACKey("", []byte("secret")),
+		parseTestKey(t, "rsa", rsaPrivatePEM()),
+		parseTestKey(t, "ed", edPEM),
+		expired,
+		next,
+	)
+
+	want := []JWK{
+		{
+			KeyType:   "RSA",
+			Id:        "rsa",
+			Use:       "sig",
+			Algorithm: "RS256",
+			N:         base64.RawURLEncoding.EncodeToString(testRSAKey.N.Bytes()),
+			E:         "AQAB",
+		},
+		{
+			KeyType:   "OKP",
+			Id:        "ed",
+			Use:       "sig",
+			Algorithm: "EdDSA",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(edPublic),
+		},
+		{
+			KeyType:   "OKP",
+			Id:        "next",
+			Use:       "sig",
+			Algorithm: "EdDSA",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(edPublic),
+		},
+	}
+	got := keyring.JWKS()
+	if len(got) != len(want) {
+		t.Fatalf("Got %d keys, expected %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Got %+v, expected %+v", got[i], want[i])
+		}
+	}
+
+	// The encoding is the key itself.
+	n, err := base64.RawURLEncoding.DecodeString(got[0].N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(big.Int).SetBytes(n).Cmp(testRSAKey.N) != 0 {
+		t.Fatal("Modulus doesn't match")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	_, edPEM := ed25519PrivatePEM(t)
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"ed.pem":   edPEM,
+		"bad.pem":  []byte("not a key"),
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")}),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		manifest string
+		secret   string
+		wantErr  bool
+	}{
+		{"manifest", `[{"kid": "ed", "key": "ed.pem", "not_before": "2026-10-01T00:00:00Z"}]`, "", false},
+		{"manifest and secret", `[{"kid": "ed", "key": "ed.pem"}]`, "secret", false},
+		{"secret only", "", "secret", false},
+		{"nothing", "", "", true},
+		{"invalid JSON", `[{"kid": "ed",`, "", true},
+		{"invalid time", `[{"kid": "ed", "key": "ed.pem", "not_after": "soon"}]`, "", true},
+		{"no kid", `[{"key": "ed.pem"}]`, "", true},
+		{"duplicate kid", `[{"kid": "ed", "key": "ed.pem"}, {"kid": "ed", "key": "ed.pem"}]`, "", true},
+		{"missing key file", `[{"kid": "ed", "key": "missing.pem"}]`, "", true},
+		{"not PEM", `[{"kid": "ed", "key": "bad.pem"}]`, "", true},
+		{"unsupported PEM block", `[{"kid": "ed", "key": "cert.pem"}]`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.manifest != "" {
+				path = filepath.Join(dir, "keys.json")
+				if err := os.WriteFile(path, []byte(tt.manifest), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := LoadKeyring(path, tt.secret)
+			if tt.wantErr && err == nil {
+				t.Fatal("Got no error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if _, err := LoadKeyring(filepath.Join(dir, "missing.json"), "secret"); err == nil {
+		t.Fatal("Loaded a missing manifest")
+	}
+}
@@ -0,0 +1,17 @@
+package auth
+
+// MakeOneTimeToken returns a random token to email to a user, such as a
+// password reset token, and the hash it is stored by.
+func MakeOneTimeToken() (token, hash string, err error) {
+	token, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashOneTimeToken(token), nil
+}
+
+// HashOneTimeToken returns the hash a token from MakeOneTimeToken is
+// stored and looked up by.
+func HashOneTimeToken(token string) string {
+	return hashToken(token)
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrApiKeyNotFound = errors.New("API key not found")
+
+// ApiKey is a long-lived key a user creates for scripts and bots. Only a
+// hash of its secret is stored; Prefix is kept in the clear so users can
+// tell their keys apart.
+type ApiKey struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Hash      string    `json:"hash"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is zero for keys that never expire, and LastUsedAt for
+	// keys never used.
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Expired reports whether the key has expired at now.
+func (k ApiKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
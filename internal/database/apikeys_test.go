@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testApiKeys(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot, err := db.CreateApiKey(user.Id, "bot", "abcd", "hash1", "chirps:write", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	script, err := db.CreateApiKey(user.Id, "script", "efgh", "hash2", "", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.Name != "bot" || bot.Scope != "chirps:write" || !bot.ExpiresAt.IsZero() || !bot.LastUsedAt.IsZero() {
+		t.Fatalf("Unexpected key: %+v", bot)
+	}
+	if !script.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Key expires at %v, expected %v", script.ExpiresAt, expiresAt)
+	}
+	if script.Expired(time.Now()) || !script.Expired(expiresAt) {
+		t.Fatal("Wrong expiry")
+	}
+
+	got, err := db.GetApiKeyByHash("hash1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != bot.Id {
+		t.Fatalf("Got key %d, expected %d", got.Id, bot.Id)
+	}
+	if _, err := db.GetApiKeyByHash("missing"); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Fatalf("Got %v, expected ErrApiKeyNotFound", err)
+	}
+
+	usedAt := time.Now().UTC().Truncate(time.Second)
+	if err := db.TouchApiKey(bot.Id, usedAt); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.GetApiKeys(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Id != bot.Id || keys[1].Id != script.Id {
+		t.Fatalf("Unexpected keys: %+v", keys)
+	}
+	if !keys[0].LastUsedAt.Equal(usedAt) {
+		t.Fatalf("Key last used at %v, expected %v", keys[0].LastUsedAt, usedAt)
+	}
+
+	if err := db.DeleteApiKey(bot.Id, other.Id); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Fatalf("Got %v, expected ErrApiKeyNotFound", err)
+	}
+	if err := db.DeleteApiKey(bot.Id, user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetApiKeyByHash("hash1"); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Fatalf("Got %v, expected ErrApiKeyNotFound", err)
+	}
+	if err := db.TouchApiKey(bot.Id, usedAt); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Fatalf("Got %v, expected ErrApiKeyNotFound", err)
+	}
+	keys, err = db.GetApiKeys(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Id != script.Id {
+		t.Fatalf("Unexpected keys after deleting: %+v", keys)
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	db, _ := newTestDB(t)
+	testApiKeys(t, db)
+}
+
+func TestSQLiteApiKeys(t *testing.T) {
+	testApiKeys(t, newTestSQLiteDB(t))
+}
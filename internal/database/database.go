@@ -1,9 +1,11 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"slices"
 	"sync"
 	"time"
 )
@@ -12,241 +14,864 @@ type Chirp struct {
 	Id       int    `json:"id"`
 	AuthorId int    `json:"author_id"`
 	Body     string `json:"body"`
+	// InReplyTo is the ID of the chirp this one replies to, or 0.
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// RechirpOf is the ID of the chirp this one shares, or 0. A rechirp
+	// has no body of its own.
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	// Hashtags and Mentions are parsed from Body whenever it is set.
+	Hashtags []string  `json:"hashtags,omitempty"`
+	Mentions []Mention `json:"mentions,omitempty"`
+	// Flags lists the moderation patterns that flagged the chirp for
+	// review.
+	Flags []string `json:"flags,omitempty"`
+	// Hidden chirps were hidden by a moderator and are left out of
+	// listings and search.
+	Hidden    bool      `json:"hidden,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// The counts are derived on read and never stored.
+	ReplyCount   int `json:"-"`
+	LikeCount    int `json:"-"`
+	RechirpCount int `json:"-"`
+}
+
+// ChirpRevision is a previous body of an edited chirp.
+type ChirpRevision struct {
+	Revision int    `json:"revision"`
+	Body     string `json:"body"`
+	// CreatedAt is when this body was written.
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Role        string    `json:"role"`
+	Suspended   bool      `json:"suspended,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// TokenGeneration is bumped to invalidate every access token issued
+	// to the user so far.
+	TokenGeneration int `json:"token_generation,omitempty"`
+
+	// PendingEmail is an address the user is changing to. Email stays in
+	// use until PendingEmail is verified and replaces it.
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	PendingEmail  string `json:"pending_email,omitempty"`
 }
 
+var (
+	ErrUserExists    = errors.New("User already exists with email")
+	ErrUserNotFound  = errors.New("User not found")
+	ErrChirpNotFound = errors.New("Chirp not found")
+	ErrNotAuthor     = errors.New("Not the author of the chirp")
+	ErrSelfFollow    = errors.New("Users can't follow themselves")
+	ErrRechirpEdit   = errors.New("Rechirps can't be edited")
+)
+
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path     string
+	mux      *sync.RWMutex
+	data     DBStructure
+	journal  *os.File
+	seq      int
+	pending  int
+	recovery *Recovery
 }
 
 type DBStructure struct {
-	Chirps      map[int]Chirp        `json:"chirps"`
-	Users       map[int]User         `json:"users"`
-	Revocations map[string]time.Time `json:"revocations"`
+	// SchemaVersion is the version of the last migration applied.
+	SchemaVersion int                  `json:"schema_version"`
+	Chirps        map[int]Chirp        `json:"chirps"`
+	Users         map[int]User         `json:"users"`
+	Revocations   map[string]time.Time `json:"revocations"`
+	// ChirpRevisions holds the previous revisions of edited chirps, oldest
+	// first, keyed by chirp ID.
+	ChirpRevisions map[int][]ChirpRevision `json:"chirp_revisions"`
+	// Follows maps a user ID to the IDs of the users they follow, in
+	// ascending order.
+	Follows map[int][]int `json:"follows"`
+	// Likes maps a chirp ID to the IDs of the users who liked it, in
+	// ascending order.
+	Likes map[int][]int `json:"likes"`
+	// ModerationWords is the word list chirps are checked against.
+	ModerationWords map[int]ModerationWord `json:"moderation_words"`
+	// Reports and ModerationActions make up the moderation queue and its
+	// history.
+	Reports           map[int]Report           `json:"reports"`
+	ModerationActions map[int]ModerationAction `json:"moderation_actions"`
+	// RefreshFamilies tracks the refresh tokens handed out, keyed by
+	// family ID.
+	RefreshFamilies map[string]RefreshFamily `json:"refresh_families"`
+	ApiKeys         map[int]ApiKey           `json:"api_keys"`
+	// PasswordResets holds each user's outstanding password reset, keyed
+	// by user ID.
+	PasswordResets map[int]PasswordReset `json:"password_resets"`
+	// EmailVerifications holds each user's outstanding email
+	// verification, keyed by user ID.
+	EmailVerifications map[int]EmailVerification `json:"email_verifications"`
+	// Sequences holds the last ID handed out per entity. IDs are never
+	// reused, even after the entity is deleted.
+	Sequences map[string]int `json:"sequences"`
+	// JournalSeq is the sequence number of the last journal entry
+	// folded into this snapshot.
+	JournalSeq int `json:"journal_seq"`
+
+	idx indexes
 }
 
+// compactThreshold is the number of journal entries after which the
+// journal is folded into a new snapshot.
+const compactThreshold = 1000
+
+// NewDB opens the snapshot at path, creating it if needed, and replays
+// every journal entry written after it into memory. If the snapshot is
+// corrupt the newest valid previous generation is used instead, and
+// Recovery describes what happened. Pending migrations are applied
+// before it returns.
 func NewDB(path string) (*DB, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return db, err
+	}
+	err = db.MigrateUp(false, io.Discard)
+	return db, err
+}
+
+func openDB(path string) (*DB, error) {
 	db := &DB{
 		path: path,
 		mux:  &sync.RWMutex{},
 	}
 
-	err := db.ensureDB()
+	err := db.loadSnapshot()
+	if err != nil {
+		return db, err
+	}
+	db.data.buildIndexes()
+	if db.data.SchemaVersion > latestSchemaVersion() {
+		return db, fmt.Errorf("database schema version %d is newer than the latest known version %d",
+			db.data.SchemaVersion, latestSchemaVersion())
+	}
+	db.seq = db.data.JournalSeq
+	err = db.openJournal()
 	return db, err
 }
 
-func (db *DB) ensureDB() error {
-	if _, err := os.Stat(db.path); os.IsNotExist(err) {
-		return db.writeDB(DBStructure{
-			Chirps:      make(map[int]Chirp),
-			Users:       make(map[int]User),
-			Revocations: make(map[string]time.Time),
-		})
-	} else if err != nil {
+// Close folds the journal into the snapshot and releases the journal file.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.journal == nil {
+		return nil
+	}
+	err := db.compact()
+	if closeErr := db.journal.Close(); err == nil {
+		err = closeErr
+	}
+	db.journal = nil
+	return err
+}
+
+// Compact writes the in-memory state to a new snapshot and empties the
+// journal.
+func (db *DB) Compact() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	if db.pending == 0 {
+		return nil
+	}
+	return db.flush()
+}
+
+// flush unconditionally writes a new snapshot and empties the journal.
+func (db *DB) flush() error {
+	db.data.JournalSeq = db.seq
+	if err := db.writeDB(db.data); err != nil {
+		return err
+	}
+	if err := db.journal.Truncate(0); err != nil {
 		return err
 	}
+	if _, err := db.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	db.pending = 0
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	dat, err := os.ReadFile(db.path)
-	if err != nil {
-		return DBStructure{}, err
+func emptyDBStructure() DBStructure {
+	dbstruct := DBStructure{
+		Chirps:            make(map[int]Chirp),
+		Users:             make(map[int]User),
+		Revocations:       make(map[string]time.Time),
+		ChirpRevisions:    make(map[int][]ChirpRevision),
+		Follows:           make(map[int][]int),
+		Likes:             make(map[int][]int),
+		Reports:           make(map[int]Report),
+		ModerationActions: make(map[int]ModerationAction),
+		RefreshFamilies:   make(map[string]RefreshFamily),
+		ApiKeys:           make(map[int]ApiKey),
+		PasswordResets:    make(map[int]PasswordReset),
+		Sequences:         make(map[string]int),
+
+		EmailVerifications: make(map[int]EmailVerification),
+		// A new database already has the latest shape.
+		SchemaVersion: latestSchemaVersion(),
 	}
+	// It starts with the words chirps were always checked against.
+	addModerationWords(&dbstruct)
+	return dbstruct
+}
 
-	structure := DBStructure{}
-	err = json.Unmarshal(dat, &structure)
-	if err != nil {
-		return DBStructure{}, err
-	}
-	return structure, nil
+const (
+	seqChirps          = "chirps"
+	seqUsers           = "users"
+	seqModerationWords = "moderation_words"
+	seqReports         = "reports"
+	seqModActions      = "moderation_actions"
+	seqApiKeys         = "api_keys"
+)
+
+// nextId returns the ID the next entity of the given kind will get. The
+// sequence itself advances when the entity is committed.
+func (dbstruct *DBStructure) nextId(name string) int {
+	return dbstruct.Sequences[name] + 1
 }
 
-func (db *DB) writeDB(dbstruct DBStructure) error {
-	dat, err := json.Marshal(dbstruct)
-	if err != nil {
-		return err
+// advanceSequence makes sure the sequence for name is at least id.
+func (dbstruct *DBStructure) advanceSequence(name string, id int) {
+	ensureMap(&dbstruct.Sequences)
+	if id > dbstruct.Sequences[name] {
+		dbstruct.Sequences[name] = id
 	}
-	err = os.WriteFile(db.path, dat, 0600)
-	return err
 }
 
 func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.CreateChirp(body, authorId)
+		return err
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	id := len(dbstruct.Chirps) + 1
+	return chirp, nil
+}
 
-	newChirp := Chirp{
-		Id:       id,
-		AuthorId: authorId,
-		Body:     body,
+func (db *DB) CreateReply(body string, authorId int, inReplyTo int, flags []string) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.CreateReply(body, authorId, inReplyTo, flags)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
-	dbstruct.Chirps[id] = newChirp
+	return chirp, nil
+}
+
+func (db *DB) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.Chirps()
+		return nil
+	})
+	return chirps, err
+}
+
+func (db *DB) GetChirpById(id int) (Chirp, bool, error) {
+	var chirp Chirp
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		chirp, found = tx.Chirp(id)
+		return nil
+	})
+	return chirp, found, err
+}
+
+func (db *DB) DeleteChirp(id int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteChirp(id)
+	})
+}
 
-	err = db.writeDB(dbstruct)
+// UpdateChirp replaces the body and flags of a chirp written by authorId,
+// keeping the previous body as a revision.
+func (db *DB) UpdateChirp(id int, authorId int, body string, flags []string) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var found bool
+		chirp, found = tx.Chirp(id)
+		if !found {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorId != authorId {
+			return ErrNotAuthor
+		}
+		var err error
+		chirp, err = tx.EditChirp(id, body, flags)
+		return err
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
+	return chirp, nil
+}
 
-	return newChirp, nil
+func (db *DB) LikeChirp(id int, userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.LikeChirp(id, userId)
+	})
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) UnlikeChirp(id int, userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.UnlikeChirp(id, userId)
+	})
+}
+
+func (db *DB) GetLikers(id int, afterId int, limit int) ([]User, error) {
+	var users []User
+	err := db.View(func(tx *Tx) error {
+		users = tx.Likers(id, afterId, limit)
+		return nil
+	})
+	return users, err
+}
+
+func (db *DB) Rechirp(id int, userId int) (Chirp, error) {
+	var rechirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		rechirp, err = tx.Rechirp(id, userId)
+		return err
+	})
 	if err != nil {
-		return nil, err
-	}
-	chirps := make([]Chirp, 0, len(dbstruct.Chirps))
-	for _, chirp := range dbstruct.Chirps {
-		chirps = append(chirps, chirp)
+		return Chirp{}, err
 	}
-	return chirps, nil
+	return rechirp, nil
 }
 
-func (db *DB) GetChirpById(id int) (Chirp, bool, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) Unrechirp(id int, userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Unrechirp(id, userId)
+	})
+}
+
+func (db *DB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	var revisions []ChirpRevision
+	err := db.View(func(tx *Tx) error {
+		if _, found := tx.Chirp(id); !found {
+			return ErrChirpNotFound
+		}
+		revisions = tx.ChirpHistory(id)
+		return nil
+	})
+	return revisions, err
+}
+
+// DeleteChirpByAuthor deletes the chirp only if it was written by
+// authorId, checking and deleting in one transaction.
+func (db *DB) DeleteChirpByAuthor(id int, authorId int) error {
+	return db.Update(func(tx *Tx) error {
+		chirp, found := tx.Chirp(id)
+		if !found {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorId != authorId {
+			return ErrNotAuthor
+		}
+		return tx.DeleteChirp(id)
+	})
+}
+
+func (db *DB) CreateUser(email string, password string) (User, error) {
+	var user User
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		user, err = tx.CreateUser(email, password)
+		return err
+	})
 	if err != nil {
-		return Chirp{}, false, err
+		return User{}, err
 	}
+	return user, nil
+}
 
-	chirp, found := dbstruct.Chirps[id]
-	if !found {
-		return Chirp{}, false, nil
-	}
-	return chirp, true, nil
+func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	var chirps []Chirp
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.ChirpsByAuthor(authorId)
+		return nil
+	})
+	return chirps, err
 }
 
-func (db *DB) DeleteChirp(id int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) GetChirpAncestors(id int) ([]Chirp, error) {
+	var ancestors []Chirp
+	err := db.View(func(tx *Tx) error {
+		chirp, found := tx.Chirp(id)
+		if !found {
+			return ErrChirpNotFound
+		}
+		// A chirp can only reply to an older one, so this can't loop.
+		for chirp.InReplyTo != 0 {
+			parent, found := tx.Chirp(chirp.InReplyTo)
+			if !found {
+				break
+			}
+			ancestors = append(ancestors, parent)
+			chirp = parent
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	delete(dbstruct.Chirps, id)
-	db.writeDB(dbstruct)
-	return nil
+	slices.Reverse(ancestors)
+	return ancestors, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) GetChirpsPage(q ChirpQuery) ([]Chirp, error) {
+	var chirps []Chirp
+	err := db.View(func(tx *Tx) error {
+		chirps = tx.ChirpsPage(q)
+		return nil
+	})
+	return chirps, err
+}
+
+func (db *DB) Follow(followerId int, followeeId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Follow(followerId, followeeId)
+	})
+}
+
+func (db *DB) Unfollow(followerId int, followeeId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Unfollow(followerId, followeeId)
+	})
+}
+
+func (db *DB) GetFollowers(userId int, afterId int, limit int) ([]User, error) {
+	var users []User
+	err := db.View(func(tx *Tx) error {
+		users = tx.Followers(userId, afterId, limit)
+		return nil
+	})
+	return users, err
+}
+
+func (db *DB) GetFollowing(userId int, afterId int, limit int) ([]User, error) {
+	var users []User
+	err := db.View(func(tx *Tx) error {
+		users = tx.Following(userId, afterId, limit)
+		return nil
+	})
+	return users, err
+}
+
+func (db *DB) GetFollowCounts(userId int) (followers int, following int, err error) {
+	err = db.View(func(tx *Tx) error {
+		followers, following = tx.FollowCounts(userId)
+		return nil
+	})
+	return followers, following, err
+}
+
+func (db *DB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	var chirps []Chirp
+	err := db.View(func(tx *Tx) error {
+		var err error
+		chirps, err = tx.SearchChirps(q)
+		return err
+	})
+	return chirps, err
+}
+
+func (db *DB) GetModerationWords() ([]ModerationWord, error) {
+	var words []ModerationWord
+	err := db.View(func(tx *Tx) error {
+		words = tx.ModerationWords()
+		return nil
+	})
+	return words, err
+}
+
+func (db *DB) CreateModerationWord(pattern string, mode string) (ModerationWord, error) {
+	var word ModerationWord
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		word, err = tx.PutModerationWord(ModerationWord{Pattern: pattern, Mode: mode})
+		return err
+	})
 	if err != nil {
-		return User{}, err
+		return ModerationWord{}, err
 	}
+	return word, nil
+}
 
-	if _, found := findUserByEmail(dbstruct.Users, email); found {
-		return User{}, errors.New("User already exists with email")
+func (db *DB) UpdateModerationWord(id int, pattern string, mode string) (ModerationWord, error) {
+	var word ModerationWord
+	err := db.Update(func(tx *Tx) error {
+		if _, found := tx.db.data.ModerationWords[id]; !found {
+			return ErrModerationWordNotFound
+		}
+		var err error
+		word, err = tx.PutModerationWord(ModerationWord{Id: id, Pattern: pattern, Mode: mode})
+		return err
+	})
+	if err != nil {
+		return ModerationWord{}, err
 	}
+	return word, nil
+}
 
-	id := len(dbstruct.Users) + 1
+func (db *DB) DeleteModerationWord(id int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteModerationWord(id)
+	})
+}
 
-	newUser := User{
-		Id:       id,
-		Email:    email,
-		Password: password,
+func (db *DB) CreateReport(chirpId int, reporterId int, reason string) (Report, error) {
+	var report Report
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		report, err = tx.CreateReport(chirpId, reporterId, reason)
+		return err
+	})
+	if err != nil {
+		return Report{}, err
 	}
+	return report, nil
+}
 
-	dbstruct.Users[id] = newUser
+func (db *DB) GetReportQueue(afterChirpId int, limit int) ([]ReportedChirp, error) {
+	var queue []ReportedChirp
+	err := db.View(func(tx *Tx) error {
+		queue = tx.ReportQueue(afterChirpId, limit)
+		return nil
+	})
+	return queue, err
+}
 
-	err = db.writeDB(dbstruct)
-	return newUser, err
+func (db *DB) ModerateChirp(chirpId int, moderatorId int, action string) (ModerationAction, error) {
+	var record ModerationAction
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		record, err = tx.ModerateChirp(chirpId, moderatorId, action)
+		return err
+	})
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	return record, nil
 }
 
-func findUserByEmail(users map[int]User, email string) (User, bool) {
-	for _, user := range users {
-		if user.Email == email {
-			return user, true
-		}
+func (db *DB) GetModerationActions(afterId int, limit int) ([]ModerationAction, error) {
+	var actions []ModerationAction
+	err := db.View(func(tx *Tx) error {
+		actions = tx.ModerationActions(afterId, limit)
+		return nil
+	})
+	return actions, err
+}
+
+func (db *DB) GetUserById(id int) (User, error) {
+	var user User
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		user, found = tx.User(id)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if !found {
+		return User{}, ErrUserNotFound
 	}
-	return User{}, false
+	return user, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	dbstruct, err := db.loadDB()
+	var user User
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		user, found = tx.UserByEmail(email)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-
-	user, found := findUserByEmail(dbstruct.Users, email)
 	if !found {
-		return User{}, errors.New("User not found")
+		return User{}, ErrUserNotFound
 	}
-
 	return user, nil
 }
 
 func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+	var user User
+	err := db.Update(func(tx *Tx) error {
+		var found bool
+		user, found = tx.User(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		if emailKey(email) != emailKey(user.Email) {
+			user.EmailVerified = false
+		}
+		user.Email = email
+		user.Password = password
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user, ok := dbstruct.Users[id]
-	if !ok {
-		return User{}, errors.New("User not found")
+	return user, nil
+}
+
+func (db *DB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
 	}
-	user.Email = email
-	user.Password = password
-	dbstruct.Users[id] = user
-	err = db.writeDB(dbstruct)
-	return user, err
+	var user User
+	err := db.Update(func(tx *Tx) error {
+		var found bool
+		user, found = tx.User(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		user.Role = role
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
 }
 
 func (db *DB) UpgradeUser(id int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+	return db.Update(func(tx *Tx) error {
+		user, found := tx.User(id)
+		if !found {
+			return ErrUserNotFound
+		}
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
+}
+
+func (db *DB) CreateRefreshFamily(userId int, userAgent string, ip string) (RefreshFamily, error) {
+	var family RefreshFamily
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		family, err = tx.CreateRefreshFamily(userId, userAgent, ip)
+		return err
+	})
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+func (db *DB) RotateRefreshToken(familyId string, tokenId string) (RefreshFamily, error) {
+	var family RefreshFamily
+	var reused bool
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		family, err = tx.RotateRefreshToken(familyId, tokenId)
+		// The family has been revoked, which must be committed.
+		reused = errors.Is(err, ErrRefreshTokenReused)
+		if reused {
+			return nil
+		}
+		return err
+	})
+	if err == nil && reused {
+		err = ErrRefreshTokenReused
+	}
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+func (db *DB) GetRefreshFamily(id string) (RefreshFamily, error) {
+	var family RefreshFamily
+	err := db.View(func(tx *Tx) error {
+		var found bool
+		family, found = tx.RefreshFamily(id)
+		if !found {
+			return ErrRefreshFamilyNotFound
+		}
+		return nil
+	})
 	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+func (db *DB) GetActiveRefreshFamilies(userId int) ([]RefreshFamily, error) {
+	var families []RefreshFamily
+	err := db.View(func(tx *Tx) error {
+		families = tx.ActiveRefreshFamilies(userId)
+		return nil
+	})
+	return families, err
+}
+
+func (db *DB) RevokeRefreshFamily(familyId string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeRefreshFamily(familyId)
+	})
+}
+
+func (db *DB) RevokeUserTokens(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeUserTokens(userId)
+	})
+}
+
+func (db *DB) AdoptLegacyRefreshToken(token string, userId int, userAgent string,
+	ip string) (RefreshFamily, error) {
+	var family RefreshFamily
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		family, err = tx.AdoptLegacyRefreshToken(token, userId, userAgent, ip)
 		return err
+	})
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+func (db *DB) RevokeLegacyRefreshToken(token string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeLegacyRefreshToken(token)
+	})
+}
+
+func (db *DB) CreateApiKey(userId int, name string, prefix string, hash string, scope string,
+	expiresAt time.Time) (ApiKey, error) {
+	var key ApiKey
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		key, err = tx.CreateApiKey(userId, name, prefix, hash, scope, expiresAt)
+		return err
+	})
+	if err != nil {
+		return ApiKey{}, err
+	}
+	return key, nil
+}
+
+func (db *DB) GetApiKeys(userId int) ([]ApiKey, error) {
+	var keys []ApiKey
+	err := db.View(func(tx *Tx) error {
+		keys = tx.ApiKeys(userId)
+		return nil
+	})
+	return keys, err
+}
+
+func (db *DB) GetApiKeyByHash(hash string) (ApiKey, error) {
+	var key ApiKey
+	err := db.View(func(tx *Tx) error {
+		var found bool
+		key, found = tx.ApiKeyByHash(hash)
+		if !found {
+			return ErrApiKeyNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return ApiKey{}, err
 	}
-	user, ok := dbstruct.Users[id]
-	if !ok {
-		return errors.New("User not found")
+	return key, nil
+}
+
+func (db *DB) TouchApiKey(id int, usedAt time.Time) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.TouchApiKey(id, usedAt)
+	})
+}
+
+func (db *DB) DeleteApiKey(id int, userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteApiKey(id, userId)
+	})
+}
+
+func (db *DB) CreatePasswordReset(userId int, hash string, expiresAt time.Time) (PasswordReset, error) {
+	var reset PasswordReset
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		reset, err = tx.CreatePasswordReset(userId, hash, expiresAt)
+		return err
+	})
+	if err != nil {
+		return PasswordReset{}, err
 	}
-	user.IsChirpyRed = true
-	dbstruct.Users[id] = user
-	return db.writeDB(dbstruct)
+	return reset, nil
 }
 
-func (db *DB) IsTokenRevoked(token string) (bool, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) ResetPassword(hash string, password string) (User, error) {
+	var user User
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		user, err = tx.ResetPassword(hash, password)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return User{}, err
 	}
-	_, found := dbstruct.Revocations[token]
-	return found, nil
+	return user, nil
 }
 
-func (db *DB) RevokeToken(token string, revocationTime time.Time) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	dbstruct, err := db.loadDB()
+func (db *DB) CreateEmailVerification(userId int, email string, hash string,
+	expiresAt time.Time) (EmailVerification, error) {
+	var verification EmailVerification
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		verification, err = tx.CreateEmailVerification(userId, email, hash, expiresAt)
+		return err
+	})
 	if err != nil {
+		return EmailVerification{}, err
+	}
+	return verification, nil
+}
+
+func (db *DB) VerifyEmail(hash string) (User, error) {
+	var user User
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		user, err = tx.VerifyEmail(hash)
 		return err
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return user, nil
+}
 
-	dbstruct.Revocations[token] = revocationTime
-	return db.writeDB(dbstruct)
+func (db *DB) CancelEmailChange(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.CancelEmailChange(userId)
+	})
 }
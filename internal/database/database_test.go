@@ -1,26 +1,33 @@
 package database
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
+func newTestDB(t *testing.T) (*DB, string) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, filename
+}
+
 func TestCreateDB(t *testing.T) {
-	filename := "database.json"
-	NewDB(filename)
-	defer os.Remove(filename)
+	_, filename := newTestDB(t)
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		t.Fatal("File was not created")
 	}
 }
 
 func TestCreateChirp(t *testing.T) {
-	filename := "database.json"
-	db, err := NewDB(filename)
-	defer os.Remove(filename)
-	if err != nil {
-		t.Fatal(err)
-	}
+	db, _ := newTestDB(t)
 	chirp, err := db.CreateChirp("Test", 1)
 	if err != nil {
 		t.Fatal(err)
@@ -31,13 +38,8 @@ func TestCreateChirp(t *testing.T) {
 }
 
 func TestGetChirps(t *testing.T) {
-	filename := "database.json"
-	db, err := NewDB(filename)
-	defer os.Remove(filename)
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = db.CreateChirp("Test1", 1)
+	db, _ := newTestDB(t)
+	_, err := db.CreateChirp("Test1", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,3 +57,501 @@ func TestGetChirps(t *testing.T) {
 		t.Fatal("Wrong amount of chirps")
 	}
 }
+
+func TestChirpIdsNotReused(t *testing.T) {
+	db, filename := newTestDB(t)
+	for i := 0; i < 3; i++ {
+		if _, err := db.CreateChirp("Test", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		deleteId int
+		wantId   int
+	}{
+		{deleteId: 3, wantId: 4},
+		{deleteId: 2, wantId: 5},
+		{deleteId: 5, wantId: 6},
+	}
+	for _, step := range steps {
+		if err := db.DeleteChirp(step.deleteId); err != nil {
+			t.Fatal(err)
+		}
+		chirp, err := db.CreateChirp("Test", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chirp.Id != step.wantId {
+			t.Fatalf("Got id %d after deleting %d, expected %d", chirp.Id, step.deleteId, step.wantId)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.DeleteChirp(6); err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := reopened.CreateChirp("Test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 7 {
+		t.Fatalf("Got id %d after reopening, expected 7", chirp.Id)
+	}
+	chirps, _ := reopened.GetChirps()
+	if len(chirps) != 3 {
+		t.Fatalf("Got %d chirps, expected 3", len(chirps))
+	}
+}
+
+func TestRepairSequences(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"chirps":{"1":{"id":1,"author_id":1,"body":"a"},"4":{"id":4,"author_id":1,"body":"b"}},` +
+		`"users":{"2":{"id":2,"email":"walt@breakingbad.com","password":"hash"}},"revocations":{}}`
+	if err := os.WriteFile(filename, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	snapshot, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Sequences[seqChirps] != 4 || snapshot.Sequences[seqUsers] != 2 {
+		t.Fatalf("Sequences were not repaired on disk: %v", snapshot.Sequences)
+	}
+
+	chirp, err := db.CreateChirp("Test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 5 {
+		t.Fatalf("Got chirp id %d, expected 5", chirp.Id)
+	}
+	user, err := db.CreateUser("jesse@breakingbad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != 3 {
+		t.Fatalf("Got user id %d, expected 3", user.Id)
+	}
+}
+
+func testChirpHistory(t *testing.T, db Store) {
+	t.Helper()
+	chirp, err := db.CreateChirp("Tpyo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Fatalf("Unexpected timestamps on new chirp: %+v", chirp)
+	}
+
+	if _, err := db.UpdateChirp(chirp.Id, 2, "Hijacked", nil); !errors.Is(err, ErrNotAuthor) {
+		t.Fatalf("Got %v, expected ErrNotAuthor", err)
+	}
+	if _, err := db.UpdateChirp(chirp.Id+1, 1, "Missing", nil); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+	if _, err := db.UpdateChirp(chirp.Id, 1, "Typo", nil); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.UpdateChirp(chirp.Id, 1, "Typo!", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Body != "Typo!" || !updated.CreatedAt.Equal(chirp.CreatedAt) {
+		t.Fatalf("Unexpected chirp after update: %+v", updated)
+	}
+
+	history, err := db.GetChirpHistory(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Body != "Tpyo" || history[1].Body != "Typo" ||
+		history[0].Revision != 1 || history[1].Revision != 2 {
+		t.Fatalf("Unexpected history: %+v", history)
+	}
+	if !history[0].CreatedAt.Equal(chirp.CreatedAt) {
+		t.Fatalf("First revision created at %v, expected %v", history[0].CreatedAt, chirp.CreatedAt)
+	}
+
+	if err := db.DeleteChirp(chirp.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetChirpHistory(chirp.Id); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+}
+
+func TestChirpHistory(t *testing.T) {
+	db, _ := newTestDB(t)
+	testChirpHistory(t, db)
+}
+
+func TestSQLiteChirpHistory(t *testing.T) {
+	testChirpHistory(t, newTestSQLiteDB(t))
+}
+
+func testReplies(t *testing.T, db Store) {
+	t.Helper()
+	root, err := db.CreateChirp("Root", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := db.CreateReply("Reply", 2, root.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := db.CreateReply("Nested", 1, reply.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateReply("Second reply", 3, root.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateReply("Orphan", 1, 100, nil); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+
+	if nested.InReplyTo != reply.Id {
+		t.Fatalf("Reply stored in reply to %d, expected %d", nested.InReplyTo, reply.Id)
+	}
+	root, _, err = db.GetChirpById(root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ReplyCount != 2 {
+		t.Fatalf("Root has %d replies, expected 2", root.ReplyCount)
+	}
+
+	replies, err := db.GetChirpsPage(ChirpQuery{InReplyTo: root.Id, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[0].Id != reply.Id || replies[0].ReplyCount != 1 {
+		t.Fatalf("Unexpected replies: %+v", replies)
+	}
+
+	ancestors, err := db.GetChirpAncestors(nested.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 || ancestors[0].Id != root.Id || ancestors[1].Id != reply.Id {
+		t.Fatalf("Unexpected ancestors: %+v", ancestors)
+	}
+
+	// A deleted chirp ends the chain of ancestors.
+	if err := db.DeleteChirp(reply.Id); err != nil {
+		t.Fatal(err)
+	}
+	ancestors, err = db.GetChirpAncestors(nested.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 0 {
+		t.Fatalf("Unexpected ancestors after delete: %+v", ancestors)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	db, _ := newTestDB(t)
+	testReplies(t, db)
+}
+
+func TestSQLiteReplies(t *testing.T) {
+	testReplies(t, newTestSQLiteDB(t))
+}
+
+func testFollows(t *testing.T, db Store) {
+	t.Helper()
+	users := []User{}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		user, err := db.CreateUser(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	a, b, c := users[0].Id, users[1].Id, users[2].Id
+
+	for _, followee := range []int{b, c, b} {
+		if err := db.Follow(a, followee); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Follow(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Follow(a, a); !errors.Is(err, ErrSelfFollow) {
+		t.Fatalf("Got %v, expected ErrSelfFollow", err)
+	}
+	if err := db.Follow(a, 100); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+
+	followers, following, err := db.GetFollowCounts(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if followers != 0 || following != 2 {
+		t.Fatalf("Got %d followers and %d following, expected 0 and 2", followers, following)
+	}
+	followerList, err := db.GetFollowers(b, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followerList) != 2 || followerList[0].Id != a || followerList[1].Id != c {
+		t.Fatalf("Unexpected followers: %+v", followerList)
+	}
+	followingList, err := db.GetFollowing(a, b, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followingList) != 1 || followingList[0].Id != c {
+		t.Fatalf("Unexpected following: %+v", followingList)
+	}
+
+	// The timeline interleaves the chirps of everyone a follows, newest
+	// first.
+	for _, authorId := range []int{b, a, c, b, c} {
+		if _, err := db.CreateChirp("Test", authorId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timelineIds := func(q ChirpQuery) string {
+		t.Helper()
+		chirps, err := db.GetChirpsPage(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, chirp := range chirps {
+			ids = append(ids, chirp.Id)
+		}
+		return fmt.Sprint(ids)
+	}
+	if got := timelineIds(ChirpQuery{FollowedBy: a, Desc: true, Limit: 3}); got != "[5 4 3]" {
+		t.Fatalf("Got timeline %s, expected [5 4 3]", got)
+	}
+	if got := timelineIds(ChirpQuery{FollowedBy: a, Desc: true, AfterId: 3, Limit: 3}); got != "[1]" {
+		t.Fatalf("Got timeline %s, expected [1]", got)
+	}
+
+	if err := db.Unfollow(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unfollow(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if got := timelineIds(ChirpQuery{FollowedBy: a, Desc: true, Limit: 10}); got != "[4 1]" {
+		t.Fatalf("Got timeline %s after unfollowing, expected [4 1]", got)
+	}
+}
+
+func TestFollows(t *testing.T) {
+	db, filename := newTestDB(t)
+	testFollows(t, db)
+
+	// The follower index is rebuilt from the snapshot.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	followers, err := reopened.GetFollowers(2, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 2 {
+		t.Fatalf("Got %d followers after reopening, expected 2", len(followers))
+	}
+}
+
+func TestSQLiteFollows(t *testing.T) {
+	testFollows(t, newTestSQLiteDB(t))
+}
+
+func testLikesAndRechirps(t *testing.T, db Store) {
+	t.Helper()
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, err := db.CreateUser(email, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chirp, err := db.CreateChirp("Like me", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userId := range []int{3, 2, 3} {
+		if err := db.LikeChirp(chirp.Id, userId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.LikeChirp(100, 2); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+	likers, err := db.GetLikers(chirp.Id, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(likers) != 2 || likers[0].Id != 2 || likers[1].Id != 3 {
+		t.Fatalf("Unexpected likers: %+v", likers)
+	}
+
+	rechirp, err := db.Rechirp(chirp.Id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rechirp.RechirpOf != chirp.Id || rechirp.AuthorId != 2 {
+		t.Fatalf("Unexpected rechirp: %+v", rechirp)
+	}
+	// Rechirping again, directly or through the rechirp, changes nothing.
+	for _, id := range []int{chirp.Id, rechirp.Id} {
+		again, err := db.Rechirp(id, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Id != rechirp.Id {
+			t.Fatalf("Rechirped again as %d, expected %d", again.Id, rechirp.Id)
+		}
+	}
+	if _, err := db.UpdateChirp(rechirp.Id, 2, "Edited", nil); !errors.Is(err, ErrRechirpEdit) {
+		t.Fatalf("Got %v, expected ErrRechirpEdit", err)
+	}
+
+	chirp, _, err = db.GetChirpById(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.LikeCount != 2 || chirp.RechirpCount != 1 {
+		t.Fatalf("Got %d likes and %d rechirps, expected 2 and 1", chirp.LikeCount, chirp.RechirpCount)
+	}
+	byAuthor, err := db.GetChirpsPage(ChirpQuery{AuthorId: 2, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byAuthor) != 1 || byAuthor[0].Id != rechirp.Id {
+		t.Fatalf("Unexpected chirps by the rechirper: %+v", byAuthor)
+	}
+
+	if err := db.UnlikeChirp(chirp.Id, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unrechirp(chirp.Id, 2); err != nil {
+		t.Fatal(err)
+	}
+	chirp, _, err = db.GetChirpById(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.LikeCount != 1 || chirp.RechirpCount != 0 {
+		t.Fatalf("Got %d likes and %d rechirps, expected 1 and 0", chirp.LikeCount, chirp.RechirpCount)
+	}
+
+	// Deleting a chirp takes its rechirps with it.
+	rechirp, err = db.Rechirp(chirp.Id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteChirp(chirp.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := db.GetChirpById(rechirp.Id); err != nil || found {
+		t.Fatalf("Rechirp survived deleting the original: found %v, error %v", found, err)
+	}
+}
+
+func TestLikesAndRechirps(t *testing.T) {
+	db, _ := newTestDB(t)
+	testLikesAndRechirps(t, db)
+}
+
+func TestSQLiteLikesAndRechirps(t *testing.T) {
+	testLikesAndRechirps(t, newTestSQLiteDB(t))
+}
+
+func testHashtagsAndMentions(t *testing.T, db Store) {
+	t.Helper()
+	chirp, err := db.CreateChirp("Learning #Go with @alice #go", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(chirp.Hashtags) != "[go]" || len(chirp.Mentions) != 1 ||
+		chirp.Mentions[0] != (Mention{Name: "alice"}) {
+		t.Fatalf("Unexpected entities: %+v %+v", chirp.Hashtags, chirp.Mentions)
+	}
+	if _, err := db.CreateReply("#rust is nice too", 2, chirp.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := func(tag string) int {
+		t.Helper()
+		chirps, err := db.GetChirpsPage(ChirpQuery{Hashtag: tag, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(chirps)
+	}
+	if tagged("go") != 1 || tagged("rust") != 1 {
+		t.Fatalf("Got %d chirps tagged go and %d tagged rust, expected 1 each", tagged("go"), tagged("rust"))
+	}
+
+	// Editing a chirp reparses it.
+	updated, err := db.UpdateChirp(chirp.Id, 1, "Learning #Rust", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(updated.Hashtags) != "[rust]" || updated.Mentions != nil {
+		t.Fatalf("Unexpected entities after edit: %+v %+v", updated.Hashtags, updated.Mentions)
+	}
+	if tagged("go") != 0 || tagged("rust") != 2 {
+		t.Fatalf("Got %d chirps tagged go and %d tagged rust after edit, expected 0 and 2",
+			tagged("go"), tagged("rust"))
+	}
+
+	// Users are mentioned by ID, and only existing ones resolve.
+	user, err := db.CreateUser("alice@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mentioning, err := db.CreateChirp(fmt.Sprintf("Hi @%d and @%d", user.Id, user.Id+100), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mentioning.Mentions) != 2 || mentioning.Mentions[0].UserId != user.Id ||
+		mentioning.Mentions[1].UserId != 0 {
+		t.Fatalf("Unexpected mentions: %+v", mentioning.Mentions)
+	}
+	mentions, err := db.GetChirpsPage(ChirpQuery{MentionedUserId: user.Id, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mentions) != 1 || mentions[0].Id != mentioning.Id {
+		t.Fatalf("Got %d chirps mentioning user %d, expected chirp %d", len(mentions), user.Id, mentioning.Id)
+	}
+}
+
+func TestHashtagsAndMentions(t *testing.T) {
+	db, _ := newTestDB(t)
+	testHashtagsAndMentions(t, db)
+}
+
+func TestSQLiteHashtagsAndMentions(t *testing.T) {
+	testHashtagsAndMentions(t, newTestSQLiteDB(t))
+}
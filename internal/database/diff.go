@@ -0,0 +1,72 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxDiffCells bounds the LCS table; beyond it the changed region is
+// printed as a plain removal followed by an addition.
+const maxDiffCells = 4_000_000
+
+// writeLineDiff writes a line-based diff of before and after to w, with
+// "-" and "+" marking removed and added lines.
+func writeLineDiff(w io.Writer, before, after string) {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			fmt.Fprintln(w, "-"+line)
+		}
+		for _, line := range b {
+			fmt.Fprintln(w, "+"+line)
+		}
+		return
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintln(w, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintln(w, "-"+a[i])
+			i++
+		default:
+			fmt.Fprintln(w, "+"+b[j])
+			j++
+		}
+	}
+}
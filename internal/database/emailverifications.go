@@ -0,0 +1,22 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrEmailVerificationNotFound covers unknown, used and expired
+// verification tokens alike.
+var ErrEmailVerificationNotFound = errors.New("Email verification not found")
+
+// EmailVerification is an outstanding request to confirm that a user owns
+// Email, either the address they signed up with or one they are changing
+// to. Only a hash of the token emailed to them is stored, and a user has
+// at most one: asking again replaces it.
+type EmailVerification struct {
+	UserId    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
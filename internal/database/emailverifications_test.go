@@ -0,0 +1,159 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testEmailVerifications(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Fatal("New user is verified")
+	}
+
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	if _, err := db.CreateEmailVerification(user.Id, "A@example.com", "signup", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := db.VerifyEmail("signup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.EmailVerified || verified.Email != "a@example.com" || verified.PendingEmail != "" {
+		t.Fatalf("Unexpected user: %+v", verified)
+	}
+	if _, err := db.VerifyEmail("signup"); !errors.Is(err, ErrEmailVerificationNotFound) {
+		t.Fatalf("Got %v, expected ErrEmailVerificationNotFound", err)
+	}
+
+	// Changing to another user's address is refused up front.
+	if _, err := db.CreateEmailVerification(user.Id, "B@example.com", "taken", expiresAt); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Got %v, expected ErrUserExists", err)
+	}
+
+	// A new address stays pending until verified.
+	if _, err := db.CreateEmailVerification(user.Id, "c@example.com", "change", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "a@example.com" || got.PendingEmail != "c@example.com" || !got.EmailVerified {
+		t.Fatalf("Unexpected user with pending email: %+v", got)
+	}
+	if _, err := db.GetUserByEmail("c@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+	verified, err = db.VerifyEmail("change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Email != "c@example.com" || verified.PendingEmail != "" || !verified.EmailVerified {
+		t.Fatalf("Unexpected user after change: %+v", verified)
+	}
+
+	// Whoever verifies an address first gets it.
+	if _, err := db.CreateEmailVerification(other.Id, "d@example.com", "other", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateEmailVerification(user.Id, "d@example.com", "race", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("race"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("other"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Got %v, expected ErrUserExists", err)
+	}
+
+	// Asking to verify the current address again drops a pending change.
+	if _, err := db.CreateEmailVerification(other.Id, "e@example.com", "pending", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateEmailVerification(other.Id, "b@example.com", "current", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("pending"); !errors.Is(err, ErrEmailVerificationNotFound) {
+		t.Fatalf("Got %v, expected ErrEmailVerificationNotFound", err)
+	}
+	got, err = db.GetUserById(other.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PendingEmail != "" {
+		t.Fatalf("Pending email is %q, expected none", got.PendingEmail)
+	}
+
+	if _, err := db.CreateEmailVerification(other.Id, "b@example.com", "expired", time.Now().UTC().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("expired"); !errors.Is(err, ErrEmailVerificationNotFound) {
+		t.Fatalf("Got %v, expected ErrEmailVerificationNotFound", err)
+	}
+
+	// Cancelling a change drops the pending email and its verification,
+	// but leaves one of the current address alone.
+	if _, err := db.CreateEmailVerification(other.Id, "g@example.com", "cancelled", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CancelEmailChange(other.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("cancelled"); !errors.Is(err, ErrEmailVerificationNotFound) {
+		t.Fatalf("Got %v, expected ErrEmailVerificationNotFound", err)
+	}
+	got, err = db.GetUserById(other.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PendingEmail != "" || got.Email != "b@example.com" {
+		t.Fatalf("Unexpected user after cancelling: %+v", got)
+	}
+	if _, err := db.CreateEmailVerification(other.Id, "b@example.com", "kept", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CancelEmailChange(other.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyEmail("kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CancelEmailChange(100); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+
+	// Changing the email directly drops the verification.
+	updated, err := db.UpdateUser(user.Id, "D@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.EmailVerified {
+		t.Fatal("Changing the case of the email dropped the verification")
+	}
+	updated, err = db.UpdateUser(user.Id, "f@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.EmailVerified {
+		t.Fatal("New email is verified")
+	}
+}
+
+func TestEmailVerifications(t *testing.T) {
+	db, _ := newTestDB(t)
+	testEmailVerifications(t, db)
+}
+
+func TestSQLiteEmailVerifications(t *testing.T) {
+	testEmailVerifications(t, newTestSQLiteDB(t))
+}
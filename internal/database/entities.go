@@ -0,0 +1,63 @@
+package database
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mention is an @name in a chirp body.
+type Mention struct {
+	Name string `json:"name"`
+	// UserId is the mentioned user, or 0 if the name doesn't resolve.
+	UserId int `json:"user_id,omitempty"`
+}
+
+var (
+	// A tag or name must start the body or follow a character that can't
+	// be part of one, so emails and URLs aren't picked up.
+	// Letters and digits of any script count, so #café is one tag.
+	hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#@/])#([\p{L}\p{N}_]{1,100})`)
+	mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#@/])@([\p{L}\p{N}_]{1,30})`)
+)
+
+// parseEntities extracts the hashtags and mentioned names of a chirp body,
+// lower-cased and without duplicates, in order of appearance.
+func parseEntities(body string) (hashtags []string, mentions []string) {
+	return matchUnique(hashtagPattern, body), matchUnique(mentionPattern, body)
+}
+
+func matchUnique(pattern *regexp.Regexp, body string) []string {
+	var found []string
+	seen := map[string]bool{}
+	for _, match := range pattern.FindAllStringSubmatch(body, -1) {
+		word := strings.ToLower(match[1])
+		if !seen[word] {
+			seen[word] = true
+			found = append(found, word)
+		}
+	}
+	return found
+}
+
+// resolveMentions looks up the users behind mentioned names. Users don't
+// have usernames yet, so a user is mentioned by their ID, as in @42; other
+// names, and IDs userExists doesn't know, are left unresolved.
+func resolveMentions(names []string, userExists func(id int) bool) []Mention {
+	var mentions []Mention
+	for _, name := range names {
+		mention := Mention{Name: name}
+		if id, err := strconv.Atoi(name); err == nil && strconv.Itoa(id) == name && id > 0 && userExists(id) {
+			mention.UserId = id
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions
+}
+
+// parseBody sets the hashtags and mentions of chirp from its body.
+func (chirp *Chirp) parseBody(userExists func(id int) bool) {
+	hashtags, names := parseEntities(chirp.Body)
+	chirp.Hashtags = hashtags
+	chirp.Mentions = resolveMentions(names, userExists)
+}
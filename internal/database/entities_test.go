@@ -0,0 +1,37 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEntities(t *testing.T) {
+	tests := []struct {
+		body     string
+		hashtags string
+		mentions string
+	}{
+		{"#Go is fun #go #rust", "[go rust]", "[]"},
+		{"cc @Alice and @bob_2, not bob@example.com", "[]", "[alice bob_2]"},
+		{"See example.com/#anchor or ##double", "[]", "[]"},
+		{"(#tag) @@twice", "[tag]", "[]"},
+		{"Un #café à #Zürich, pas caf#é", "[café zürich]", "[]"},
+	}
+	for _, test := range tests {
+		hashtags, mentions := parseEntities(test.body)
+		if got := fmt.Sprint(append([]string{}, hashtags...)); got != test.hashtags {
+			t.Errorf("Hashtags of %q: got %s, expected %s", test.body, got, test.hashtags)
+		}
+		if got := fmt.Sprint(append([]string{}, mentions...)); got != test.mentions {
+			t.Errorf("Mentions of %q: got %s, expected %s", test.body, got, test.mentions)
+		}
+	}
+}
+
+func TestResolveMentions(t *testing.T) {
+	exists := func(id int) bool { return id == 42 }
+	mentions := resolveMentions([]string{"42", "7", "042", "alice"}, exists)
+	if got := fmt.Sprint(mentions); got != "[{42 42} {7 0} {042 0} {alice 0}]" {
+		t.Fatalf("Got mentions %s", got)
+	}
+}
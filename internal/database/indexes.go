@@ -0,0 +1,403 @@
+package database
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// indexes are lookup tables derived from DBStructure. They are never
+// persisted: buildIndexes recreates them after loading, and mutation.apply
+// keeps them current.
+type indexes struct {
+	// usersByEmail maps a lower-cased email to the user ID.
+	usersByEmail map[string]int
+	// chirpIds holds every chirp ID in ascending order.
+	chirpIds []int
+	// chirpsByAuthor maps an author ID to the IDs of their chirps, in
+	// ascending order.
+	chirpsByAuthor map[int][]int
+	// repliesByParent maps a chirp ID to the IDs of its direct replies, in
+	// ascending order.
+	repliesByParent map[int][]int
+	// followers maps a user ID to the IDs of their followers, in ascending
+	// order. It is the reverse of DBStructure.Follows.
+	followers map[int][]int
+	// rechirpsByOriginal maps a chirp ID to the IDs of its rechirps, in
+	// ascending order.
+	rechirpsByOriginal map[int][]int
+	// chirpsByHashtag and chirpsByMention map a hashtag and a mentioned
+	// user ID to the IDs of their chirps, in ascending order.
+	chirpsByHashtag map[string][]int
+	chirpsByMention map[int][]int
+	// words is the inverted index for search. It maps a word to the chirps
+	// containing it, and those to the word's positions in the chirp body.
+	words map[string]map[int][]int
+	// flaggedChirps holds the IDs of chirps flagged for review in
+	// ascending order.
+	flaggedChirps []int
+	// openReports maps a chirp ID to the IDs of its open reports, in
+	// ascending order.
+	openReports map[int][]int
+	// activeFamilies maps a user ID to the IDs of their unrevoked refresh
+	// token families.
+	activeFamilies map[int]map[string]bool
+	// apiKeysByHash maps the hash of an API key to its ID, and
+	// apiKeysByUser a user ID to the IDs of their keys in ascending order.
+	apiKeysByHash map[string]int
+	apiKeysByUser map[int][]int
+	// passwordResetsByHash maps the hash of a password reset token to the
+	// ID of its user.
+	passwordResetsByHash map[string]int
+	// emailVerificationsByHash does the same for email verifications.
+	emailVerificationsByHash map[string]int
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+func (dbstruct *DBStructure) buildIndexes() {
+	dbstruct.idx = indexes{
+		usersByEmail:       make(map[string]int),
+		chirpsByAuthor:     make(map[int][]int),
+		repliesByParent:    make(map[int][]int),
+		followers:          make(map[int][]int),
+		rechirpsByOriginal: make(map[int][]int),
+		chirpsByHashtag:    make(map[string][]int),
+		chirpsByMention:    make(map[int][]int),
+		words:              make(map[string]map[int][]int),
+		openReports:        make(map[int][]int),
+		activeFamilies:     make(map[int]map[string]bool),
+		apiKeysByHash:      make(map[string]int),
+		apiKeysByUser:      make(map[int][]int),
+
+		passwordResetsByHash:     make(map[string]int),
+		emailVerificationsByHash: make(map[string]int),
+	}
+
+	// Older files may hold emails differing only in case; the oldest
+	// account keeps the address.
+	ids := make([]int, 0, len(dbstruct.Users))
+	for id := range dbstruct.Users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		key := emailKey(dbstruct.Users[id].Email)
+		if _, taken := dbstruct.idx.usersByEmail[key]; !taken {
+			dbstruct.idx.usersByEmail[key] = id
+		}
+	}
+
+	for _, chirp := range dbstruct.Chirps {
+		dbstruct.indexChirp(chirp)
+	}
+
+	for _, report := range dbstruct.Reports {
+		dbstruct.indexReport(report)
+	}
+
+	for _, family := range dbstruct.RefreshFamilies {
+		dbstruct.indexRefreshFamily(family)
+	}
+
+	for _, key := range dbstruct.ApiKeys {
+		dbstruct.indexApiKey(key)
+	}
+
+	for _, reset := range dbstruct.PasswordResets {
+		dbstruct.idx.passwordResetsByHash[reset.Hash] = reset.UserId
+	}
+	for _, verification := range dbstruct.EmailVerifications {
+		dbstruct.idx.emailVerificationsByHash[verification.Hash] = verification.UserId
+	}
+
+	for followerId, followeeIds := range dbstruct.Follows {
+		for _, followeeId := range followeeIds {
+			dbstruct.idx.followers[followeeId] = insertSorted(
+				dbstruct.idx.followers[followeeId], followerId)
+		}
+	}
+}
+
+func (dbstruct *DBStructure) indexUser(user User) {
+	dbstruct.idx.usersByEmail[emailKey(user.Email)] = user.Id
+}
+
+func (dbstruct *DBStructure) unindexUser(user User) {
+	key := emailKey(user.Email)
+	if dbstruct.idx.usersByEmail[key] == user.Id {
+		delete(dbstruct.idx.usersByEmail, key)
+	}
+}
+
+func (dbstruct *DBStructure) indexChirp(chirp Chirp) {
+	dbstruct.idx.chirpIds = insertSorted(dbstruct.idx.chirpIds, chirp.Id)
+	dbstruct.idx.chirpsByAuthor[chirp.AuthorId] = insertSorted(
+		dbstruct.idx.chirpsByAuthor[chirp.AuthorId], chirp.Id)
+	if chirp.InReplyTo != 0 {
+		dbstruct.idx.repliesByParent[chirp.InReplyTo] = insertSorted(
+			dbstruct.idx.repliesByParent[chirp.InReplyTo], chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		dbstruct.idx.rechirpsByOriginal[chirp.RechirpOf] = insertSorted(
+			dbstruct.idx.rechirpsByOriginal[chirp.RechirpOf], chirp.Id)
+	}
+	for _, tag := range chirp.Hashtags {
+		dbstruct.idx.chirpsByHashtag[tag] = insertSorted(dbstruct.idx.chirpsByHashtag[tag], chirp.Id)
+	}
+	for _, mention := range chirp.Mentions {
+		if mention.UserId != 0 {
+			dbstruct.idx.chirpsByMention[mention.UserId] = insertSorted(
+				dbstruct.idx.chirpsByMention[mention.UserId], chirp.Id)
+		}
+	}
+	dbstruct.indexBody(chirp)
+	if len(chirp.Flags) > 0 {
+		dbstruct.idx.flaggedChirps = insertSorted(dbstruct.idx.flaggedChirps, chirp.Id)
+	}
+}
+
+func (dbstruct *DBStructure) unindexChirp(chirp Chirp) {
+	dbstruct.idx.chirpIds = removeSorted(dbstruct.idx.chirpIds, chirp.Id)
+	removeFromIndex(dbstruct.idx.chirpsByAuthor, chirp.AuthorId, chirp.Id)
+	if chirp.InReplyTo != 0 {
+		removeFromIndex(dbstruct.idx.repliesByParent, chirp.InReplyTo, chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		removeFromIndex(dbstruct.idx.rechirpsByOriginal, chirp.RechirpOf, chirp.Id)
+	}
+	for _, tag := range chirp.Hashtags {
+		removeFromIndex(dbstruct.idx.chirpsByHashtag, tag, chirp.Id)
+	}
+	for _, mention := range chirp.Mentions {
+		if mention.UserId != 0 {
+			removeFromIndex(dbstruct.idx.chirpsByMention, mention.UserId, chirp.Id)
+		}
+	}
+	dbstruct.unindexBody(chirp)
+	dbstruct.idx.flaggedChirps = removeSorted(dbstruct.idx.flaggedChirps, chirp.Id)
+}
+
+func (dbstruct *DBStructure) indexReport(report Report) {
+	if report.ActionId == 0 {
+		dbstruct.idx.openReports[report.ChirpId] = insertSorted(
+			dbstruct.idx.openReports[report.ChirpId], report.Id)
+	}
+}
+
+func (dbstruct *DBStructure) unindexReport(report Report) {
+	removeFromIndex(dbstruct.idx.openReports, report.ChirpId, report.Id)
+}
+
+func (dbstruct *DBStructure) indexRefreshFamily(family RefreshFamily) {
+	if family.Revoked {
+		return
+	}
+	if dbstruct.idx.activeFamilies[family.UserId] == nil {
+		dbstruct.idx.activeFamilies[family.UserId] = make(map[string]bool)
+	}
+	dbstruct.idx.activeFamilies[family.UserId][family.Id] = true
+}
+
+func (dbstruct *DBStructure) unindexRefreshFamily(family RefreshFamily) {
+	delete(dbstruct.idx.activeFamilies[family.UserId], family.Id)
+	if len(dbstruct.idx.activeFamilies[family.UserId]) == 0 {
+		delete(dbstruct.idx.activeFamilies, family.UserId)
+	}
+}
+
+func (dbstruct *DBStructure) indexApiKey(key ApiKey) {
+	dbstruct.idx.apiKeysByHash[key.Hash] = key.Id
+	dbstruct.idx.apiKeysByUser[key.UserId] = insertSorted(dbstruct.idx.apiKeysByUser[key.UserId], key.Id)
+}
+
+func (dbstruct *DBStructure) unindexApiKey(key ApiKey) {
+	delete(dbstruct.idx.apiKeysByHash, key.Hash)
+	removeFromIndex(dbstruct.idx.apiKeysByUser, key.UserId, key.Id)
+}
+
+// removeFromIndex removes id from the list stored under key, dropping the
+// key once its list is empty.
+func removeFromIndex[K comparable](index map[K][]int, key K, id int) {
+	ids := removeSorted(index[key], id)
+	if len(ids) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = ids
+	}
+}
+
+// insertSorted adds id to the ascending slice ids unless already present.
+// New IDs come from a sequence, so this is nearly always an append.
+func insertSorted(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeSorted(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// userByEmail looks up a user by email, ignoring case.
+func (dbstruct *DBStructure) userExists(id int) bool {
+	_, found := dbstruct.Users[id]
+	return found
+}
+
+func (dbstruct *DBStructure) userByEmail(email string) (User, bool) {
+	id, found := dbstruct.idx.usersByEmail[emailKey(email)]
+	if !found {
+		return User{}, false
+	}
+	return dbstruct.Users[id], true
+}
+
+// chirp returns a chirp with its derived fields filled in.
+func (dbstruct *DBStructure) chirp(id int) (Chirp, bool) {
+	chirp, found := dbstruct.Chirps[id]
+	if !found {
+		return Chirp{}, false
+	}
+	chirp.ReplyCount = len(dbstruct.idx.repliesByParent[id])
+	chirp.LikeCount = len(dbstruct.Likes[id])
+	chirp.RechirpCount = len(dbstruct.idx.rechirpsByOriginal[id])
+	return chirp, true
+}
+
+func (dbstruct *DBStructure) likes(chirpId int, userId int) bool {
+	ids := dbstruct.Likes[chirpId]
+	i := sort.SearchInts(ids, userId)
+	return i < len(ids) && ids[i] == userId
+}
+
+// rechirpBy returns userId's rechirp of chirp id, if there is one.
+func (dbstruct *DBStructure) rechirpBy(id int, userId int) (Chirp, bool) {
+	for _, rechirpId := range dbstruct.idx.rechirpsByOriginal[id] {
+		if rechirp := dbstruct.Chirps[rechirpId]; rechirp.AuthorId == userId {
+			return dbstruct.chirp(rechirpId)
+		}
+	}
+	return Chirp{}, false
+}
+
+// chirpsByAuthor returns the author's chirps ordered by ID.
+func (dbstruct *DBStructure) chirpsByAuthor(authorId int) []Chirp {
+	ids := dbstruct.idx.chirpsByAuthor[authorId]
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirp, _ := dbstruct.chirp(id)
+		chirps = append(chirps, chirp)
+	}
+	return chirps
+}
+
+func (dbstruct *DBStructure) follows(followerId int, followeeId int) bool {
+	ids := dbstruct.Follows[followerId]
+	i := sort.SearchInts(ids, followeeId)
+	return i < len(ids) && ids[i] == followeeId
+}
+
+// usersAfter returns at most limit users from the ascending IDs ids,
+// starting after afterId.
+func (dbstruct *DBStructure) usersAfter(ids []int, afterId int, limit int) []User {
+	ids = ids[sort.SearchInts(ids, afterId+1):]
+	users := make([]User, 0, min(limit, len(ids)))
+	for _, id := range ids[:min(limit, len(ids))] {
+		users = append(users, dbstruct.Users[id])
+	}
+	return users
+}
+
+// chirpPage returns at most q.Limit chirps matching q. It walks the most
+// selective ordered index from the cursor onwards, so only the chirps it
+// returns or skips are read.
+func (dbstruct *DBStructure) chirpPage(q ChirpQuery) []Chirp {
+	if q.FollowedBy != 0 {
+		return dbstruct.timelinePage(q)
+	}
+
+	var ids []int
+	switch {
+	case q.InReplyTo != 0:
+		ids = dbstruct.idx.repliesByParent[q.InReplyTo]
+	case q.MentionedUserId != 0:
+		ids = dbstruct.idx.chirpsByMention[q.MentionedUserId]
+	case q.Hashtag != "":
+		ids = dbstruct.idx.chirpsByHashtag[q.Hashtag]
+	case q.Flagged:
+		ids = dbstruct.idx.flaggedChirps
+	case q.AuthorId != 0:
+		ids = dbstruct.idx.chirpsByAuthor[q.AuthorId]
+	default:
+		ids = dbstruct.idx.chirpIds
+	}
+
+	// The index covers one filter; the others are checked per chirp.
+	matches := func(chirp Chirp) bool {
+		return (q.IncludeHidden || !chirp.Hidden) &&
+			(q.AuthorId == 0 || chirp.AuthorId == q.AuthorId) &&
+			(q.InReplyTo == 0 || chirp.InReplyTo == q.InReplyTo) &&
+			(q.Hashtag == "" || slices.Contains(chirp.Hashtags, q.Hashtag)) &&
+			(!q.Flagged || len(chirp.Flags) > 0) &&
+			(q.MentionedUserId == 0 || slices.ContainsFunc(chirp.Mentions, func(m Mention) bool {
+				return m.UserId == q.MentionedUserId
+			}))
+	}
+
+	chirps := make([]Chirp, 0, min(q.Limit, len(ids)))
+	if q.Desc {
+		end := len(ids)
+		if q.AfterId != 0 {
+			end = sort.SearchInts(ids, q.AfterId)
+		}
+		for i := end - 1; i >= 0 && len(chirps) < q.Limit; i-- {
+			if chirp, _ := dbstruct.chirp(ids[i]); matches(chirp) {
+				chirps = append(chirps, chirp)
+			}
+		}
+	} else {
+		start := 0
+		if q.AfterId != 0 {
+			start = sort.SearchInts(ids, q.AfterId+1)
+		}
+		for i := start; i < len(ids) && len(chirps) < q.Limit; i++ {
+			if chirp, _ := dbstruct.chirp(ids[i]); matches(chirp) {
+				chirps = append(chirps, chirp)
+			}
+		}
+	}
+	return chirps
+}
+
+// timelinePage merges the chirps of the users q.FollowedBy follows. Only
+// the first q.Limit chirps past the cursor of each author can make it
+// into the page, so no more than that is read per author.
+func (dbstruct *DBStructure) timelinePage(q ChirpQuery) []Chirp {
+	chirps := []Chirp{}
+	for _, authorId := range dbstruct.Follows[q.FollowedBy] {
+		authorQuery := q
+		authorQuery.FollowedBy = 0
+		authorQuery.AuthorId = authorId
+		chirps = append(chirps, dbstruct.chirpPage(authorQuery)...)
+	}
+
+	slices.SortFunc(chirps, func(a, b Chirp) int {
+		if q.Desc {
+			return b.Id - a.Id
+		}
+		return a.Id - b.Id
+	})
+	return chirps[:min(q.Limit, len(chirps))]
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestEmailIndex(t *testing.T) {
+	db, filename := newTestDB(t)
+	user, err := db.CreateUser("Walt@BreakingBad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser("walt@breakingbad.com", "hash"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Got %v, expected ErrUserExists", err)
+	}
+	if got, err := db.GetUserByEmail("WALT@breakingbad.com"); err != nil || got.Id != user.Id {
+		t.Fatalf("Case-insensitive lookup failed: %+v, %v", got, err)
+	}
+
+	if _, err := db.UpdateUser(user.Id, "heisenberg@breakingbad.com", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserByEmail("walt@breakingbad.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Old email still indexed: %v", err)
+	}
+
+	other, err := db.CreateUser("jesse@breakingbad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateUser(other.Id, "Heisenberg@breakingbad.com", "hash"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Got %v, expected ErrUserExists", err)
+	}
+
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got, err := reopened.GetUserByEmail("heisenberg@breakingbad.com"); err != nil || got.Id != user.Id {
+		t.Fatalf("Index was not rebuilt on load: %+v, %v", got, err)
+	}
+}
+
+func TestAuthorIndex(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, authorId := range []int{1, 2, 1, 1} {
+		if _, err := db.CreateChirp("Test", authorId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteChirp(3); err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *Tx) error {
+		tx.DeleteChirp(1)
+		return errors.New("abort")
+	})
+
+	chirps, err := db.GetChirpsByAuthor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[0].Id != 1 || chirps[1].Id != 4 {
+		t.Fatalf("Unexpected chirps for author 1: %+v", chirps)
+	}
+	chirps, _ = db.GetChirpsByAuthor(3)
+	if len(chirps) != 0 {
+		t.Fatalf("Unexpected chirps for author 3: %+v", chirps)
+	}
+}
+
+func TestSQLiteIndexes(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	user, err := db.CreateUser("Walt@BreakingBad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser("walt@breakingbad.com", "hash"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Got %v, expected ErrUserExists", err)
+	}
+	if got, err := db.GetUserById(user.Id); err != nil || got.Email != user.Email {
+		t.Fatalf("Lookup by id failed: %+v, %v", got, err)
+	}
+
+	for _, authorId := range []int{1, 2, 1} {
+		if _, err := db.CreateChirp("Test", authorId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chirps, err := db.GetChirpsByAuthor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[0].Id != 1 || chirps[1].Id != 3 {
+		t.Fatalf("Unexpected chirps for author 1: %+v", chirps)
+	}
+}
+
+func testChirpsPage(t *testing.T, db Store) {
+	t.Helper()
+	for _, authorId := range []int{1, 2, 1, 1, 2, 1} {
+		if _, err := db.CreateChirp("Test", authorId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pageIds := func(q ChirpQuery) []int {
+		t.Helper()
+		chirps, err := db.GetChirpsPage(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, chirp := range chirps {
+			ids = append(ids, chirp.Id)
+		}
+		return ids
+	}
+	expect := func(got []int, want ...int) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Got page %v, expected %v", got, want)
+		}
+	}
+
+	expect(pageIds(ChirpQuery{Limit: 2}), 1, 2)
+	expect(pageIds(ChirpQuery{AfterId: 2, Limit: 2}), 3, 4)
+	expect(pageIds(ChirpQuery{Desc: true, Limit: 4}), 6, 5, 4, 3)
+	expect(pageIds(ChirpQuery{AuthorId: 1, AfterId: 1, Limit: 2}), 3, 4)
+	expect(pageIds(ChirpQuery{AuthorId: 1, Desc: true, AfterId: 4, Limit: 5}), 3, 1)
+
+	// Deleting the cursor's chirp and inserting new ones doesn't shift
+	// the following pages.
+	if err := db.DeleteChirp(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp("Test", 1); err != nil {
+		t.Fatal(err)
+	}
+	expect(pageIds(ChirpQuery{AfterId: 2, Limit: 3}), 3, 4, 5)
+	expect(pageIds(ChirpQuery{Desc: true, AfterId: 3, Limit: 3}), 1)
+	expect(pageIds(ChirpQuery{AfterId: 7, Limit: 3}))
+}
+
+func TestChirpsPage(t *testing.T) {
+	db, _ := newTestDB(t)
+	testChirpsPage(t, db)
+}
+
+func TestSQLiteChirpsPage(t *testing.T) {
+	testChirpsPage(t, newTestSQLiteDB(t))
+}
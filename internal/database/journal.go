@@ -0,0 +1,444 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	opPutChirp         = "put_chirp"
+	opDeleteChirp      = "delete_chirp"
+	opPutUser          = "put_user"
+	opDeleteUser       = "delete_user"
+	opRevokeToken      = "revoke_token"
+	opDeleteRevocation = "delete_revocation"
+	opPutRevisions     = "put_revisions"
+	opFollow           = "follow"
+	opUnfollow         = "unfollow"
+	opLike             = "like"
+	opUnlike           = "unlike"
+	opPutLikes         = "put_likes"
+	opPutModWord       = "put_moderation_word"
+	opDeleteModWord    = "delete_moderation_word"
+	opPutReport        = "put_report"
+	opDeleteReport     = "delete_report"
+	opPutModAction     = "put_moderation_action"
+	opDeleteModAction  = "delete_moderation_action"
+	opPutRefreshFamily = "put_refresh_family"
+	opDeleteRefFamily  = "delete_refresh_family"
+	opPutApiKey        = "put_api_key"
+	opDeleteApiKey     = "delete_api_key"
+	opPutPassReset     = "put_password_reset"
+	opDeletePassReset  = "delete_password_reset"
+	opPutEmailVerif    = "put_email_verification"
+	opDeleteEmailVerif = "delete_email_verification"
+)
+
+// mutation is a single change to the data. Only the fields relevant to Op
+// are set.
+type mutation struct {
+	Op        string     `json:"op"`
+	Id        int        `json:"id,omitempty"`
+	Chirp     *Chirp     `json:"chirp,omitempty"`
+	User      *User      `json:"user,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Revisions replaces the whole revision history of chirp Id; an
+	// empty history removes it.
+	Revisions []ChirpRevision `json:"revisions,omitempty"`
+	// Followee is the user that user Id starts or stops following.
+	Followee int `json:"followee,omitempty"`
+	// UserId is the user liking or unliking chirp Id.
+	UserId int `json:"user_id,omitempty"`
+	// Likes replaces all likes of chirp Id; an empty list removes them.
+	Likes            []int             `json:"likes,omitempty"`
+	ModerationWord   *ModerationWord   `json:"moderation_word,omitempty"`
+	Report           *Report           `json:"report,omitempty"`
+	ModerationAction *ModerationAction `json:"moderation_action,omitempty"`
+	RefreshFamily    *RefreshFamily    `json:"refresh_family,omitempty"`
+	ApiKey           *ApiKey           `json:"api_key,omitempty"`
+	PasswordReset    *PasswordReset    `json:"password_reset,omitempty"`
+
+	EmailVerification *EmailVerification `json:"email_verification,omitempty"`
+}
+
+// journalEntry is one committed transaction. Its mutations are replayed
+// together or, if the line is torn, not at all.
+type journalEntry struct {
+	Seq int        `json:"seq"`
+	Ops []mutation `json:"ops"`
+}
+
+// ensureMap makes the map *m points to if it is nil. Journal entries may be
+// replayed onto a snapshot older than the tables they write to, before the
+// migrations adding those tables have run.
+func ensureMap[K comparable, V any](m *map[K]V) {
+	if *m == nil {
+		*m = make(map[K]V)
+	}
+}
+
+func (m mutation) apply(dbstruct *DBStructure) error {
+	switch m.Op {
+	case opPutChirp:
+		if prev, ok := dbstruct.Chirps[m.Chirp.Id]; ok {
+			dbstruct.unindexChirp(prev)
+		}
+		dbstruct.Chirps[m.Chirp.Id] = *m.Chirp
+		dbstruct.indexChirp(*m.Chirp)
+		dbstruct.advanceSequence(seqChirps, m.Chirp.Id)
+	case opDeleteChirp:
+		if prev, ok := dbstruct.Chirps[m.Id]; ok {
+			dbstruct.unindexChirp(prev)
+		}
+		delete(dbstruct.Chirps, m.Id)
+	case opPutUser:
+		if prev, ok := dbstruct.Users[m.User.Id]; ok {
+			dbstruct.unindexUser(prev)
+		}
+		dbstruct.Users[m.User.Id] = *m.User
+		dbstruct.indexUser(*m.User)
+		dbstruct.advanceSequence(seqUsers, m.User.Id)
+	case opDeleteUser:
+		if prev, ok := dbstruct.Users[m.Id]; ok {
+			dbstruct.unindexUser(prev)
+		}
+		delete(dbstruct.Users, m.Id)
+	case opRevokeToken:
+		dbstruct.Revocations[m.Token] = *m.RevokedAt
+	case opDeleteRevocation:
+		delete(dbstruct.Revocations, m.Token)
+	case opPutRevisions:
+		if len(m.Revisions) == 0 {
+			delete(dbstruct.ChirpRevisions, m.Id)
+		} else {
+			ensureMap(&dbstruct.ChirpRevisions)
+			dbstruct.ChirpRevisions[m.Id] = m.Revisions
+		}
+	case opFollow:
+		ensureMap(&dbstruct.Follows)
+		dbstruct.Follows[m.Id] = insertSorted(dbstruct.Follows[m.Id], m.Followee)
+		dbstruct.idx.followers[m.Followee] = insertSorted(dbstruct.idx.followers[m.Followee], m.Id)
+	case opUnfollow:
+		removeFromIndex(dbstruct.Follows, m.Id, m.Followee)
+		removeFromIndex(dbstruct.idx.followers, m.Followee, m.Id)
+	case opLike:
+		ensureMap(&dbstruct.Likes)
+		dbstruct.Likes[m.Id] = insertSorted(dbstruct.Likes[m.Id], m.UserId)
+	case opUnlike:
+		removeFromIndex(dbstruct.Likes, m.Id, m.UserId)
+	case opPutLikes:
+		if len(m.Likes) == 0 {
+			delete(dbstruct.Likes, m.Id)
+		} else {
+			ensureMap(&dbstruct.Likes)
+			dbstruct.Likes[m.Id] = m.Likes
+		}
+	case opPutModWord:
+		ensureMap(&dbstruct.ModerationWords)
+		dbstruct.ModerationWords[m.ModerationWord.Id] = *m.ModerationWord
+		dbstruct.advanceSequence(seqModerationWords, m.ModerationWord.Id)
+	case opDeleteModWord:
+		delete(dbstruct.ModerationWords, m.Id)
+	case opPutReport:
+		ensureMap(&dbstruct.Reports)
+		if prev, ok := dbstruct.Reports[m.Report.Id]; ok {
+			dbstruct.unindexReport(prev)
+		}
+		dbstruct.Reports[m.Report.Id] = *m.Report
+		dbstruct.indexReport(*m.Report)
+		dbstruct.advanceSequence(seqReports, m.Report.Id)
+	case opDeleteReport:
+		if prev, ok := dbstruct.Reports[m.Id]; ok {
+			dbstruct.unindexReport(prev)
+		}
+		delete(dbstruct.Reports, m.Id)
+	case opPutModAction:
+		ensureMap(&dbstruct.ModerationActions)
+		dbstruct.ModerationActions[m.ModerationAction.Id] = *m.ModerationAction
+		dbstruct.advanceSequence(seqModActions, m.ModerationAction.Id)
+	case opDeleteModAction:
+		delete(dbstruct.ModerationActions, m.Id)
+	case opPutRefreshFamily:
+		ensureMap(&dbstruct.RefreshFamilies)
+		if prev, ok := dbstruct.RefreshFamilies[m.RefreshFamily.Id]; ok {
+			dbstruct.unindexRefreshFamily(prev)
+		}
+		dbstruct.RefreshFamilies[m.RefreshFamily.Id] = *m.RefreshFamily
+		dbstruct.indexRefreshFamily(*m.RefreshFamily)
+	case opDeleteRefFamily:
+		if prev, ok := dbstruct.RefreshFamilies[m.Token]; ok {
+			dbstruct.unindexRefreshFamily(prev)
+		}
+		delete(dbstruct.RefreshFamilies, m.Token)
+	case opPutApiKey:
+		ensureMap(&dbstruct.ApiKeys)
+		if prev, ok := dbstruct.ApiKeys[m.ApiKey.Id]; ok {
+			dbstruct.unindexApiKey(prev)
+		}
+		dbstruct.ApiKeys[m.ApiKey.Id] = *m.ApiKey
+		dbstruct.indexApiKey(*m.ApiKey)
+		dbstruct.advanceSequence(seqApiKeys, m.ApiKey.Id)
+	case opDeleteApiKey:
+		if prev, ok := dbstruct.ApiKeys[m.Id]; ok {
+			dbstruct.unindexApiKey(prev)
+		}
+		delete(dbstruct.ApiKeys, m.Id)
+	case opPutPassReset:
+		ensureMap(&dbstruct.PasswordResets)
+		if prev, ok := dbstruct.PasswordResets[m.PasswordReset.UserId]; ok {
+			delete(dbstruct.idx.passwordResetsByHash, prev.Hash)
+		}
+		dbstruct.PasswordResets[m.PasswordReset.UserId] = *m.PasswordReset
+		dbstruct.idx.passwordResetsByHash[m.PasswordReset.Hash] = m.PasswordReset.UserId
+	case opDeletePassReset:
+		if prev, ok := dbstruct.PasswordResets[m.Id]; ok {
+			delete(dbstruct.idx.passwordResetsByHash, prev.Hash)
+		}
+		delete(dbstruct.PasswordResets, m.Id)
+	case opPutEmailVerif:
+		ensureMap(&dbstruct.EmailVerifications)
+		if prev, ok := dbstruct.EmailVerifications[m.EmailVerification.UserId]; ok {
+			delete(dbstruct.idx.emailVerificationsByHash, prev.Hash)
+		}
+		dbstruct.EmailVerifications[m.EmailVerification.UserId] = *m.EmailVerification
+		dbstruct.idx.emailVerificationsByHash[m.EmailVerification.Hash] = m.EmailVerification.UserId
+	case opDeleteEmailVerif:
+		if prev, ok := dbstruct.EmailVerifications[m.Id]; ok {
+			delete(dbstruct.idx.emailVerificationsByHash, prev.Hash)
+		}
+		delete(dbstruct.EmailVerifications, m.Id)
+	default:
+		return fmt.Errorf("unknown journal op %q", m.Op)
+	}
+	return nil
+}
+
+// inverse returns the mutation that undoes m, given the state before m is
+// applied. Sequences are not covered; they are restored separately.
+func (m mutation) inverse(dbstruct *DBStructure) mutation {
+	switch m.Op {
+	case opPutChirp, opDeleteChirp:
+		id := m.Id
+		if m.Chirp != nil {
+			id = m.Chirp.Id
+		}
+		if prev, ok := dbstruct.Chirps[id]; ok {
+			return mutation{Op: opPutChirp, Chirp: &prev}
+		}
+		return mutation{Op: opDeleteChirp, Id: id}
+	case opPutUser, opDeleteUser:
+		id := m.Id
+		if m.User != nil {
+			id = m.User.Id
+		}
+		if prev, ok := dbstruct.Users[id]; ok {
+			return mutation{Op: opPutUser, User: &prev}
+		}
+		return mutation{Op: opDeleteUser, Id: id}
+	case opRevokeToken, opDeleteRevocation:
+		if prev, ok := dbstruct.Revocations[m.Token]; ok {
+			return mutation{Op: opRevokeToken, Token: m.Token, RevokedAt: &prev}
+		}
+		return mutation{Op: opDeleteRevocation, Token: m.Token}
+	case opPutRevisions:
+		return mutation{Op: opPutRevisions, Id: m.Id, Revisions: dbstruct.ChirpRevisions[m.Id]}
+	case opFollow, opUnfollow:
+		if dbstruct.follows(m.Id, m.Followee) {
+			return mutation{Op: opFollow, Id: m.Id, Followee: m.Followee}
+		}
+		return mutation{Op: opUnfollow, Id: m.Id, Followee: m.Followee}
+	case opLike, opUnlike:
+		if dbstruct.likes(m.Id, m.UserId) {
+			return mutation{Op: opLike, Id: m.Id, UserId: m.UserId}
+		}
+		return mutation{Op: opUnlike, Id: m.Id, UserId: m.UserId}
+	case opPutLikes:
+		return mutation{Op: opPutLikes, Id: m.Id, Likes: dbstruct.Likes[m.Id]}
+	case opPutModWord, opDeleteModWord:
+		id := m.Id
+		if m.ModerationWord != nil {
+			id = m.ModerationWord.Id
+		}
+		if prev, ok := dbstruct.ModerationWords[id]; ok {
+			return mutation{Op: opPutModWord, ModerationWord: &prev}
+		}
+		return mutation{Op: opDeleteModWord, Id: id}
+	case opPutReport, opDeleteReport:
+		id := m.Id
+		if m.Report != nil {
+			id = m.Report.Id
+		}
+		if prev, ok := dbstruct.Reports[id]; ok {
+			return mutation{Op: opPutReport, Report: &prev}
+		}
+		return mutation{Op: opDeleteReport, Id: id}
+	case opPutModAction, opDeleteModAction:
+		id := m.Id
+		if m.ModerationAction != nil {
+			id = m.ModerationAction.Id
+		}
+		if prev, ok := dbstruct.ModerationActions[id]; ok {
+			return mutation{Op: opPutModAction, ModerationAction: &prev}
+		}
+		return mutation{Op: opDeleteModAction, Id: id}
+	case opPutRefreshFamily, opDeleteRefFamily:
+		id := m.Token
+		if m.RefreshFamily != nil {
+			id = m.RefreshFamily.Id
+		}
+		if prev, ok := dbstruct.RefreshFamilies[id]; ok {
+			return mutation{Op: opPutRefreshFamily, RefreshFamily: &prev}
+		}
+		return mutation{Op: opDeleteRefFamily, Token: id}
+	case opPutApiKey, opDeleteApiKey:
+		id := m.Id
+		if m.ApiKey != nil {
+			id = m.ApiKey.Id
+		}
+		if prev, ok := dbstruct.ApiKeys[id]; ok {
+			return mutation{Op: opPutApiKey, ApiKey: &prev}
+		}
+		return mutation{Op: opDeleteApiKey, Id: id}
+	case opPutPassReset, opDeletePassReset:
+		id := m.Id
+		if m.PasswordReset != nil {
+			id = m.PasswordReset.UserId
+		}
+		if prev, ok := dbstruct.PasswordResets[id]; ok {
+			return mutation{Op: opPutPassReset, PasswordReset: &prev}
+		}
+		return mutation{Op: opDeletePassReset, Id: id}
+	case opPutEmailVerif, opDeleteEmailVerif:
+		id := m.Id
+		if m.EmailVerification != nil {
+			id = m.EmailVerification.UserId
+		}
+		if prev, ok := dbstruct.EmailVerifications[id]; ok {
+			return mutation{Op: opPutEmailVerif, EmailVerification: &prev}
+		}
+		return mutation{Op: opDeleteEmailVerif, Id: id}
+	}
+	return mutation{}
+}
+
+func (db *DB) journalPath() string {
+	return db.path + ".journal"
+}
+
+// openJournal replays the journal on top of the loaded snapshot and
+// leaves it open for appending. A torn final line, left behind by a
+// crash during append, is discarded.
+func (db *DB) openJournal() error {
+	f, err := os.OpenFile(db.journalPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	valid, err := db.replay(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if torn := info.Size() - valid; torn > 0 {
+		if db.recovery == nil {
+			db.recovery = &Recovery{}
+		}
+		db.recovery.DiscardedJournalBytes = torn
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	db.journal = f
+	return nil
+}
+
+// replay applies every complete entry newer than the snapshot and returns
+// the offset just past the last one.
+func (db *DB) replay(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Anything without a trailing newline was never fully written.
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		entry := journalEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if _, peekErr := reader.Peek(1); errors.Is(peekErr, io.EOF) {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("corrupt journal entry at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		if entry.Seq <= db.seq {
+			continue
+		}
+		for _, m := range entry.Ops {
+			if err := m.apply(&db.data); err != nil {
+				return 0, err
+			}
+		}
+		db.seq = entry.Seq
+		db.pending++
+	}
+}
+
+// appendJournal durably appends ops to the journal as a single entry.
+// Callers must hold the write lock and have already applied ops in
+// memory.
+func (db *DB) appendJournal(ops []mutation) error {
+	entry := journalEntry{Seq: db.seq + 1, Ops: ops}
+	dat, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	offset, err := db.journal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = db.journal.Write(append(dat, '\n'))
+	if err == nil {
+		err = db.journal.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the entry made it to disk so the next
+		// append doesn't land behind a torn line.
+		db.journal.Truncate(offset)
+		db.journal.Seek(offset, io.SeekStart)
+		return err
+	}
+	db.seq = entry.Seq
+	db.pending++
+
+	if db.pending >= compactThreshold {
+		// The entry is already durable in the journal, so a failed
+		// compaction only delays the next snapshot.
+		if err := db.compact(); err != nil {
+			log.Println("Error compacting database: ", err)
+		}
+	}
+	return nil
+}
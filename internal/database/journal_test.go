@@ -0,0 +1,143 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	db, filename := newTestDB(t)
+	if _, err := db.CreateChirp("Test1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser("walt@breakingbad.com", "hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen without closing, as if the process had crashed.
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if _, found, _ := reopened.GetChirpById(1); !found {
+		t.Fatal("Chirp was not replayed from the journal")
+	}
+	if _, err := reopened.GetUserByEmail("walt@breakingbad.com"); err != nil {
+		t.Fatal("User was not replayed from the journal: ", err)
+	}
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	db, filename := newTestDB(t)
+	if _, err := db.CreateChirp("Test1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(db.journalPath(), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"op":"put_chirp","chirp":{"id":2,"au`)
+	f.Close()
+
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	chirps, _ := reopened.GetChirps()
+	if len(chirps) != 1 {
+		t.Fatalf("Got %d chirps, expected 1", len(chirps))
+	}
+	if _, err := reopened.CreateChirp("Test2", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	chirps, _ = again.GetChirps()
+	if len(chirps) != 2 {
+		t.Fatalf("Got %d chirps, expected 2", len(chirps))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db, filename := newTestDB(t)
+	if _, err := db.CreateChirp("Test1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(db.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("Journal has %d bytes after compaction", info.Size())
+	}
+
+	snapshot, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Chirps) != 1 || snapshot.JournalSeq != 1 {
+		t.Fatalf("Unexpected snapshot %+v", snapshot)
+	}
+
+	if _, err := db.CreateChirp("Test2", 1); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	chirps, _ := reopened.GetChirps()
+	if len(chirps) != 2 {
+		t.Fatalf("Got %d chirps, expected 2", len(chirps))
+	}
+}
+
+func TestJournalReplayOntoOldSnapshot(t *testing.T) {
+	// A snapshot from before follows, likes and revisions, as when an old
+	// generation is recovered, with a journal written after them.
+	filename := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"chirps":{"1":{"id":1,"body":"Test","author_id":1}},"users":{},"revocations":{}}`
+	if err := os.WriteFile(filename, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	journal := `{"seq":1,"ops":[{"op":"follow","id":1,"followee":2},{"op":"like","id":1,"user_id":2},` +
+		`{"op":"put_revisions","id":1,"revisions":[{"body":"Old"}]},` +
+		`{"op":"put_report","report":{"id":1,"chirp_id":1,"reporter_id":2,"reason":"spam"}}]}` + "\n"
+	if err := os.WriteFile(filename+".journal", []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if following := db.data.Follows[1]; len(following) != 1 || following[0] != 2 {
+		t.Fatalf("Got follows %v, expected [2]", following)
+	}
+	if likes := db.data.Likes[1]; len(likes) != 1 || likes[0] != 2 {
+		t.Fatalf("Got likes %v, expected [2]", likes)
+	}
+	if len(db.data.ChirpRevisions[1]) != 1 {
+		t.Fatal("Revisions were not replayed")
+	}
+	if _, found := db.data.Reports[1]; !found {
+		t.Fatal("Report was not replayed")
+	}
+}
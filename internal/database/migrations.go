@@ -0,0 +1,476 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Migration upgrades a DBStructure from Version-1 to Version, and Down
+// reverses it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(*DBStructure) error
+	Down    func(*DBStructure) error
+}
+
+// migrations is the ordered registry of schema changes. Versions must be
+// consecutive starting at 1; append new migrations to the end.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "add id sequences",
+		Up:      addSequences,
+		Down:    dropSequences,
+	},
+	{
+		Version: 2,
+		Name:    "add timestamps and chirp revisions",
+		Up:      addTimestamps,
+		Down:    dropTimestamps,
+	},
+	{
+		Version: 3,
+		Name:    "add follows",
+		Up:      addFollows,
+		Down:    dropFollows,
+	},
+	{
+		Version: 4,
+		Name:    "add likes",
+		Up:      addLikes,
+		Down:    dropLikes,
+	},
+	{
+		Version: 5,
+		Name:    "parse hashtags and mentions",
+		Up:      addEntities,
+		Down:    dropEntities,
+	},
+	{
+		Version: 6,
+		Name:    "add moderation words",
+		Up:      addModerationWords,
+		Down:    dropModerationWords,
+	},
+	{
+		Version: 7,
+		Name:    "add reports and moderation actions",
+		Up:      addReports,
+		Down:    dropReports,
+	},
+	{
+		Version: 8,
+		Name:    "add user roles",
+		Up:      addRoles,
+		Down:    dropRoles,
+	},
+	{
+		Version: 9,
+		Name:    "track refresh token families",
+		Up:      addRefreshFamilies,
+		Down:    dropRefreshFamilies,
+	},
+	{
+		Version: 10,
+		Name:    "add api keys",
+		Up:      addApiKeys,
+		Down:    dropApiKeys,
+	},
+	{
+		Version: 11,
+		Name:    "add password resets",
+		Up:      addPasswordResets,
+		Down:    dropPasswordResets,
+	},
+	{
+		Version: 12,
+		Name:    "add email verifications",
+		Up:      addEmailVerifications,
+		Down:    dropEmailVerifications,
+	},
+	{
+		Version: 13,
+		Name:    "resolve mentions of user ids",
+		Up:      addEntities,
+		Down:    unresolveMentions,
+	},
+}
+
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus reports whether a single migration has been applied.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+// Migrator is implemented by stores with a versioned schema.
+type Migrator interface {
+	MigrationStatus() ([]MigrationStatus, error)
+	// MigrateUp applies every pending migration. With dryRun set nothing is
+	// written and the changes are printed to w instead.
+	MigrateUp(dryRun bool, w io.Writer) error
+	// MigrateDown reverts the last steps applied migrations.
+	MigrateDown(steps int, dryRun bool, w io.Writer) error
+	Close() error
+}
+
+var (
+	_ Migrator = (*DB)(nil)
+	_ Migrator = (*SQLiteDB)(nil)
+)
+
+// OpenMigrator opens the store at path without applying any migrations.
+func OpenMigrator(driver, path string) (Migrator, error) {
+	switch driver {
+	case DriverJSON:
+		return openDB(path)
+	case DriverSQLite:
+		return openSQLiteDB(path)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+			Applied: m.Version <= db.data.SchemaVersion,
+		})
+	}
+	return statuses, nil
+}
+
+func (db *DB) MigrateUp(dryRun bool, w io.Writer) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	migrated, err := cloneDBStructure(db.data)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= migrated.SchemaVersion {
+			continue
+		}
+		if err := m.Up(&migrated); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		migrated.SchemaVersion = m.Version
+		fmt.Fprintf(w, "up %d: %s\n", m.Version, m.Name)
+	}
+	return db.finishMigration(migrated, dryRun, w)
+}
+
+func (db *DB) MigrateDown(steps int, dryRun bool, w io.Writer) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	migrated, err := cloneDBStructure(db.data)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.Version > migrated.SchemaVersion {
+			continue
+		}
+		if err := m.Down(&migrated); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		migrated.SchemaVersion = m.Version - 1
+		fmt.Fprintf(w, "down %d: %s\n", m.Version, m.Name)
+		steps--
+	}
+	return db.finishMigration(migrated, dryRun, w)
+}
+
+// finishMigration either prints the difference between the current and
+// migrated data or makes the migrated data current and snapshots it.
+// Callers must hold the write lock.
+func (db *DB) finishMigration(migrated DBStructure, dryRun bool, w io.Writer) error {
+	if migrated.SchemaVersion == db.data.SchemaVersion {
+		return nil
+	}
+	if dryRun {
+		before, err := json.MarshalIndent(db.data, "", "  ")
+		if err != nil {
+			return err
+		}
+		after, err := json.MarshalIndent(migrated, "", "  ")
+		if err != nil {
+			return err
+		}
+		writeLineDiff(w, string(before), string(after))
+		return nil
+	}
+	db.data = migrated
+	db.data.buildIndexes()
+	return db.flush()
+}
+
+func cloneDBStructure(dbstruct DBStructure) (DBStructure, error) {
+	dat, err := json.Marshal(dbstruct)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	clone := DBStructure{}
+	err = json.Unmarshal(dat, &clone)
+	return clone, err
+}
+
+// addSequences seeds the sequences of a database written before they
+// existed, when IDs were derived from the number of entities.
+func addSequences(dbstruct *DBStructure) error {
+	for id, chirp := range dbstruct.Chirps {
+		dbstruct.advanceSequence(seqChirps, max(id, chirp.Id))
+	}
+	for id, user := range dbstruct.Users {
+		dbstruct.advanceSequence(seqUsers, max(id, user.Id))
+	}
+	if dbstruct.Sequences == nil {
+		dbstruct.Sequences = make(map[string]int)
+	}
+	return nil
+}
+
+func dropSequences(dbstruct *DBStructure) error {
+	dbstruct.Sequences = nil
+	return nil
+}
+
+// addTimestamps stamps existing chirps and users with the time of the
+// migration, since when they were really created is unknown.
+func addTimestamps(dbstruct *DBStructure) error {
+	now := time.Now().UTC()
+	for id, chirp := range dbstruct.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+			chirp.UpdatedAt = now
+			dbstruct.Chirps[id] = chirp
+		}
+	}
+	for id, user := range dbstruct.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+			user.UpdatedAt = now
+			dbstruct.Users[id] = user
+		}
+	}
+	if dbstruct.ChirpRevisions == nil {
+		dbstruct.ChirpRevisions = make(map[int][]ChirpRevision)
+	}
+	return nil
+}
+
+func dropTimestamps(dbstruct *DBStructure) error {
+	for id, chirp := range dbstruct.Chirps {
+		chirp.CreatedAt = time.Time{}
+		chirp.UpdatedAt = time.Time{}
+		dbstruct.Chirps[id] = chirp
+	}
+	for id, user := range dbstruct.Users {
+		user.CreatedAt = time.Time{}
+		user.UpdatedAt = time.Time{}
+		dbstruct.Users[id] = user
+	}
+	dbstruct.ChirpRevisions = nil
+	return nil
+}
+
+func addFollows(dbstruct *DBStructure) error {
+	if dbstruct.Follows == nil {
+		dbstruct.Follows = make(map[int][]int)
+	}
+	return nil
+}
+
+func dropFollows(dbstruct *DBStructure) error {
+	dbstruct.Follows = nil
+	return nil
+}
+
+func addLikes(dbstruct *DBStructure) error {
+	if dbstruct.Likes == nil {
+		dbstruct.Likes = make(map[int][]int)
+	}
+	return nil
+}
+
+// dropLikes also drops rechirps, which older versions would show as empty
+// chirps.
+func dropLikes(dbstruct *DBStructure) error {
+	dbstruct.Likes = nil
+	for id, chirp := range dbstruct.Chirps {
+		if chirp.RechirpOf != 0 {
+			delete(dbstruct.Chirps, id)
+		}
+	}
+	return nil
+}
+
+func addEntities(dbstruct *DBStructure) error {
+	for id, chirp := range dbstruct.Chirps {
+		chirp.parseBody(dbstruct.userExists)
+		dbstruct.Chirps[id] = chirp
+	}
+	return nil
+}
+
+func dropEntities(dbstruct *DBStructure) error {
+	for id, chirp := range dbstruct.Chirps {
+		chirp.Hashtags = nil
+		chirp.Mentions = nil
+		dbstruct.Chirps[id] = chirp
+	}
+	return nil
+}
+
+func addModerationWords(dbstruct *DBStructure) error {
+	if dbstruct.ModerationWords == nil {
+		dbstruct.ModerationWords = defaultModerationWords()
+		for id := range dbstruct.ModerationWords {
+			dbstruct.advanceSequence(seqModerationWords, id)
+		}
+	}
+	return nil
+}
+
+func dropModerationWords(dbstruct *DBStructure) error {
+	dbstruct.ModerationWords = nil
+	delete(dbstruct.Sequences, seqModerationWords)
+	for id, chirp := range dbstruct.Chirps {
+		chirp.Flags = nil
+		dbstruct.Chirps[id] = chirp
+	}
+	return nil
+}
+
+func addReports(dbstruct *DBStructure) error {
+	if dbstruct.Reports == nil {
+		dbstruct.Reports = make(map[int]Report)
+	}
+	if dbstruct.ModerationActions == nil {
+		dbstruct.ModerationActions = make(map[int]ModerationAction)
+	}
+	return nil
+}
+
+// dropReports also unhides chirps and lifts suspensions, which older
+// versions can't enforce.
+func dropReports(dbstruct *DBStructure) error {
+	dbstruct.Reports = nil
+	dbstruct.ModerationActions = nil
+	delete(dbstruct.Sequences, seqReports)
+	delete(dbstruct.Sequences, seqModActions)
+	for id, chirp := range dbstruct.Chirps {
+		chirp.Hidden = false
+		dbstruct.Chirps[id] = chirp
+	}
+	for id, user := range dbstruct.Users {
+		user.Suspended = false
+		dbstruct.Users[id] = user
+	}
+	return nil
+}
+
+func addRoles(dbstruct *DBStructure) error {
+	for id, user := range dbstruct.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			dbstruct.Users[id] = user
+		}
+	}
+	return nil
+}
+
+func dropRoles(dbstruct *DBStructure) error {
+	for id, user := range dbstruct.Users {
+		user.Role = ""
+		dbstruct.Users[id] = user
+	}
+	return nil
+}
+
+// addRefreshFamilies keeps Revocations, which still records the revoked
+// refresh tokens from before families until they have all expired.
+func addRefreshFamilies(dbstruct *DBStructure) error {
+	if dbstruct.RefreshFamilies == nil {
+		dbstruct.RefreshFamilies = make(map[string]RefreshFamily)
+	}
+	return nil
+}
+
+func dropRefreshFamilies(dbstruct *DBStructure) error {
+	dbstruct.RefreshFamilies = nil
+	return nil
+}
+
+func addApiKeys(dbstruct *DBStructure) error {
+	if dbstruct.ApiKeys == nil {
+		dbstruct.ApiKeys = make(map[int]ApiKey)
+	}
+	return nil
+}
+
+func dropApiKeys(dbstruct *DBStructure) error {
+	dbstruct.ApiKeys = nil
+	delete(dbstruct.Sequences, seqApiKeys)
+	return nil
+}
+
+func addPasswordResets(dbstruct *DBStructure) error {
+	if dbstruct.PasswordResets == nil {
+		dbstruct.PasswordResets = make(map[int]PasswordReset)
+	}
+	return nil
+}
+
+func dropPasswordResets(dbstruct *DBStructure) error {
+	dbstruct.PasswordResets = nil
+	return nil
+}
+
+// addEmailVerifications marks existing users verified, so that turning on
+// REQUIRE_VERIFIED_EMAIL doesn't lock them out.
+func addEmailVerifications(dbstruct *DBStructure) error {
+	if dbstruct.EmailVerifications == nil {
+		dbstruct.EmailVerifications = make(map[int]EmailVerification)
+	}
+	for id, user := range dbstruct.Users {
+		user.EmailVerified = true
+		dbstruct.Users[id] = user
+	}
+	return nil
+}
+
+func dropEmailVerifications(dbstruct *DBStructure) error {
+	dbstruct.EmailVerifications = nil
+	for id, user := range dbstruct.Users {
+		user.EmailVerified = false
+		user.PendingEmail = ""
+		dbstruct.Users[id] = user
+	}
+	return nil
+}
+
+func unresolveMentions(dbstruct *DBStructure) error {
+	for id, chirp := range dbstruct.Chirps {
+		for i := range chirp.Mentions {
+			chirp.Mentions[i].UserId = 0
+		}
+		dbstruct.Chirps[id] = chirp
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrationVersionsAreConsecutive(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("Migration %q has version %d, expected %d", m.Name, m.Version, i+1)
+		}
+	}
+	for i, m := range sqliteMigrations {
+		if m.Version != i+1 {
+			t.Fatalf("SQLite migration %q has version %d, expected %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func TestNewDBMigrates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"chirps":{},"users":{"1":{"id":1,"email":"a@example.com","password":"hash"}},"revocations":{}}`
+	if err := os.WriteFile(filename, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	snapshot, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.SchemaVersion != latestSchemaVersion() {
+		t.Fatalf("Schema version is %d, expected %d", snapshot.SchemaVersion, latestSchemaVersion())
+	}
+	// Users from before email verification count as verified.
+	user, err := db.GetUserById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Fatal("Existing user migrated as unverified")
+	}
+}
+
+func TestMigrateDownDryRun(t *testing.T) {
+	db, _ := newTestDB(t)
+
+	out := &bytes.Buffer{}
+	if err := db.MigrateDown(1, true, out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf(`-  "schema_version": %d,`, latestSchemaVersion())) {
+		t.Fatalf("Dry run did not print the diff:\n%s", out)
+	}
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[len(statuses)-1].Applied {
+		t.Fatal("Dry run reverted the migration")
+	}
+
+	if err := db.MigrateDown(len(migrations), false, out); err != nil {
+		t.Fatal(err)
+	}
+	if db.data.SchemaVersion != 0 {
+		t.Fatalf("Schema version is %d after migrating down", db.data.SchemaVersion)
+	}
+	if err := db.MigrateUp(false, out); err != nil {
+		t.Fatal(err)
+	}
+	if db.data.SchemaVersion != latestSchemaVersion() {
+		t.Fatalf("Schema version is %d after migrating up", db.data.SchemaVersion)
+	}
+}
+
+func TestSQLiteMigrateDownUp(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	out := &bytes.Buffer{}
+	if err := db.MigrateDown(len(sqliteMigrations), false, out); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.schemaVersion(); version != 0 {
+		t.Fatalf("Schema version is %d after migrating down", version)
+	}
+	if err := db.MigrateUp(false, out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp("Test", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteMigrateEmailVerifications(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	user, err := db.CreateUser("a@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Fatal("New user is verified")
+	}
+
+	// Roll back to before email verification was added.
+	out := &bytes.Buffer{}
+	if err := db.MigrateDown(2, false, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MigrateUp(false, out); err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Fatal("Existing user migrated as unverified")
+	}
+}
+
+func TestSQLiteMigrationBackfill(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	chirp, err := db.CreateChirp("Hello #World", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Roll back to before the hashtag tables were added.
+	out := &bytes.Buffer{}
+	if err := db.MigrateDown(len(sqliteMigrations)-6, false, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MigrateUp(false, out); err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirpsPage(ChirpQuery{Hashtag: "world", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Id != chirp.Id {
+		t.Fatalf("Unexpected chirps after backfill: %+v", chirps)
+	}
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Moderation modes say what happens to a chirp containing a word.
+const (
+	// ModeMask replaces the word with asterisks.
+	ModeMask = "mask"
+	// ModeReject refuses the chirp.
+	ModeReject = "reject"
+	// ModeFlag accepts the chirp but flags it for review.
+	ModeFlag = "flag"
+)
+
+var (
+	ErrModerationWordExists   = errors.New("Moderation word already exists")
+	ErrModerationWordNotFound = errors.New("Moderation word not found")
+	ErrInvalidModerationWord  = errors.New(
+		"Pattern must be letters and digits with an optional * at either end, and mode one of mask, reject or flag")
+)
+
+// ModerationWord is an entry of the moderation word list. Pattern is a
+// lower-case word, optionally with a * at the start or end to match any
+// prefix or suffix, so "fornax*" also matches "fornaxes".
+type ModerationWord struct {
+	Id        int       `json:"id"`
+	Pattern   string    `json:"pattern"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// defaultModerationWords returns the words masked before the list could be
+// edited.
+func defaultModerationWords() map[int]ModerationWord {
+	words := make(map[int]ModerationWord)
+	for i, pattern := range []string{"kerfuffle", "sharbert", "fornax"} {
+		words[i+1] = ModerationWord{Id: i + 1, Pattern: pattern, Mode: ModeMask}
+	}
+	return words
+}
+
+// normalizeModerationWord lower-cases the pattern and checks that it and
+// the mode are valid.
+func normalizeModerationWord(pattern string, mode string) (string, error) {
+	pattern = strings.ToLower(pattern)
+	word := strings.TrimSuffix(strings.TrimPrefix(pattern, "*"), "*")
+	if word == "" || strings.IndexFunc(word, isNotWordRune) != -1 {
+		return "", ErrInvalidModerationWord
+	}
+	switch mode {
+	case ModeMask, ModeReject, ModeFlag:
+		return pattern, nil
+	}
+	return "", ErrInvalidModerationWord
+}
+
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func (w ModerationWord) matches(word string) bool {
+	pattern := strings.TrimSuffix(strings.TrimPrefix(w.Pattern, "*"), "*")
+	anyPrefix := strings.HasPrefix(w.Pattern, "*")
+	anySuffix := strings.HasSuffix(w.Pattern, "*")
+	switch {
+	case anyPrefix && anySuffix:
+		return strings.Contains(word, pattern)
+	case anyPrefix:
+		return strings.HasSuffix(word, pattern)
+	case anySuffix:
+		return strings.HasPrefix(word, pattern)
+	}
+	return word == pattern
+}
+
+// ModerationResult is the outcome of checking a chirp body against the
+// word list.
+type ModerationResult struct {
+	// Body has the words in mask mode replaced.
+	Body string
+	// Rejected and Flagged list the patterns in those modes that matched.
+	Rejected []string
+	Flagged  []string
+}
+
+// Moderate checks every word of body against words. Words are runs of
+// letters and digits compared case-insensitively, so surrounding
+// punctuation and line breaks don't hide them.
+func Moderate(words []ModerationWord, body string) ModerationResult {
+	result := ModerationResult{}
+	seen := map[string]bool{}
+	masked := strings.Builder{}
+
+	rest := body
+	for rest != "" {
+		start := strings.IndexFunc(rest, func(r rune) bool { return !isNotWordRune(r) })
+		if start == -1 {
+			masked.WriteString(rest)
+			break
+		}
+		masked.WriteString(rest[:start])
+		rest = rest[start:]
+		end := strings.IndexFunc(rest, isNotWordRune)
+		if end == -1 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		rest = rest[end:]
+
+		mask := false
+		for _, w := range words {
+			if !w.matches(strings.ToLower(word)) {
+				continue
+			}
+			switch w.Mode {
+			case ModeMask:
+				mask = true
+			case ModeReject:
+				if !seen[w.Pattern] {
+					result.Rejected = append(result.Rejected, w.Pattern)
+				}
+			case ModeFlag:
+				if !seen[w.Pattern] {
+					result.Flagged = append(result.Flagged, w.Pattern)
+				}
+			}
+			seen[w.Pattern] = true
+		}
+		if mask {
+			masked.WriteString("****")
+		} else {
+			masked.WriteString(word)
+		}
+	}
+	result.Body = masked.String()
+	return result
+}
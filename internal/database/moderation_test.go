@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestModerate(t *testing.T) {
+	words := []ModerationWord{
+		{Pattern: "kerfuffle", Mode: ModeMask},
+		{Pattern: "fornax*", Mode: ModeMask},
+		{Pattern: "*spam*", Mode: ModeFlag},
+		{Pattern: "scam", Mode: ModeReject},
+	}
+	tests := []struct {
+		body     string
+		want     string
+		rejected string
+		flagged  string
+	}{
+		{"What a Kerfuffle!\nFORNAXES everywhere", "What a ****!\n**** everywhere", "[]", "[]"},
+		{"kerfuffled is fine", "kerfuffled is fine", "[]", "[]"},
+		{"No spammers, no Scam. Antispam", "No spammers, no Scam. Antispam", "[scam]", "[*spam*]"},
+		{"Ünïcode kerfuffle—fine", "Ünïcode ****—fine", "[]", "[]"},
+	}
+	for _, test := range tests {
+		result := Moderate(words, test.body)
+		if result.Body != test.want {
+			t.Errorf("Moderating %q gave %q, expected %q", test.body, result.Body, test.want)
+		}
+		if got := fmt.Sprint(append([]string{}, result.Rejected...)); got != test.rejected {
+			t.Errorf("Moderating %q rejected %s, expected %s", test.body, got, test.rejected)
+		}
+		if got := fmt.Sprint(append([]string{}, result.Flagged...)); got != test.flagged {
+			t.Errorf("Moderating %q flagged %s, expected %s", test.body, got, test.flagged)
+		}
+	}
+}
+
+func testModerationWords(t *testing.T, db Store) {
+	t.Helper()
+	words, err := db.GetModerationWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 3 || words[0].Pattern != "kerfuffle" || words[0].Mode != ModeMask {
+		t.Fatalf("Unexpected default words: %+v", words)
+	}
+
+	word, err := db.CreateModerationWord("Spam*", ModeFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if word.Id != 4 || word.Pattern != "spam*" {
+		t.Fatalf("Unexpected word: %+v", word)
+	}
+	if _, err := db.CreateModerationWord("spam*", ModeReject); !errors.Is(err, ErrModerationWordExists) {
+		t.Fatalf("Got %v, expected ErrModerationWordExists", err)
+	}
+	for _, bad := range [][2]string{{"sp am", ModeMask}, {"*", ModeMask}, {"spam", "ban"}} {
+		if _, err := db.CreateModerationWord(bad[0], bad[1]); !errors.Is(err, ErrInvalidModerationWord) {
+			t.Fatalf("Got %v for %q, expected ErrInvalidModerationWord", err, bad)
+		}
+	}
+
+	word, err = db.UpdateModerationWord(word.Id, "spam*", ModeReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if word.Mode != ModeReject {
+		t.Fatalf("Unexpected word after update: %+v", word)
+	}
+	if _, err := db.UpdateModerationWord(word.Id, "fornax", ModeMask); !errors.Is(err, ErrModerationWordExists) {
+		t.Fatalf("Got %v, expected ErrModerationWordExists", err)
+	}
+	if _, err := db.UpdateModerationWord(100, "ham", ModeMask); !errors.Is(err, ErrModerationWordNotFound) {
+		t.Fatalf("Got %v, expected ErrModerationWordNotFound", err)
+	}
+	if err := db.DeleteModerationWord(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteModerationWord(1); !errors.Is(err, ErrModerationWordNotFound) {
+		t.Fatalf("Got %v, expected ErrModerationWordNotFound", err)
+	}
+
+	chirp, err := db.CreateReply("Buy now", 1, 0, []string{"buy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(chirp.Flags) != "[buy]" {
+		t.Fatalf("Unexpected flags: %v", chirp.Flags)
+	}
+	flagged, err := db.GetChirpsPage(ChirpQuery{Flagged: true, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 || fmt.Sprint(flagged[0].Flags) != "[buy]" {
+		t.Fatalf("Unexpected flagged chirps: %+v", flagged)
+	}
+	// An edit replaces the flags.
+	if chirp, err = db.UpdateChirp(chirp.Id, 1, "Hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Flags != nil {
+		t.Fatalf("Unexpected flags after edit: %v", chirp.Flags)
+	}
+	if flagged, _ := db.GetChirpsPage(ChirpQuery{Flagged: true, Limit: 10}); len(flagged) != 0 {
+		t.Fatalf("Unexpected flagged chirps after clearing: %+v", flagged)
+	}
+}
+
+func TestModerationWords(t *testing.T) {
+	db, _ := newTestDB(t)
+	testModerationWords(t, db)
+}
+
+func TestSQLiteModerationWords(t *testing.T) {
+	testModerationWords(t, newTestSQLiteDB(t))
+}
@@ -0,0 +1,20 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrPasswordResetNotFound covers unknown, used and expired reset tokens
+// alike.
+var ErrPasswordResetNotFound = errors.New("Password reset not found")
+
+// PasswordReset is an outstanding request to reset a user's password. Only
+// a hash of the token emailed to the user is stored, and a user has at most
+// one: asking again replaces it.
+type PasswordReset struct {
+	UserId    int       `json:"user_id"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
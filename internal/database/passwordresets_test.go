@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testPasswordResets(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, err := db.CreateRefreshFamily(user.Id, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateApiKey(user.Id, "key", "chirpy_abc", "keyhash", "chirps:write", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("b@example.com", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateApiKey(other.Id, "key", "chirpy_def", "otherhash", "chirps:write", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	if _, err := db.CreatePasswordReset(user.Id+100, "hash", expiresAt); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+	if _, err := db.CreatePasswordReset(user.Id, "first", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	// Asking again replaces the first reset.
+	if _, err := db.CreatePasswordReset(user.Id, "second", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResetPassword("first", "new"); !errors.Is(err, ErrPasswordResetNotFound) {
+		t.Fatalf("Got %v, expected ErrPasswordResetNotFound", err)
+	}
+
+	reset, err := db.ResetPassword("second", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.Id != user.Id || reset.Password != "new" {
+		t.Fatalf("Unexpected user: %+v", reset)
+	}
+	if reset.TokenGeneration != user.TokenGeneration+1 {
+		t.Fatalf("Token generation is %d, expected %d", reset.TokenGeneration, user.TokenGeneration+1)
+	}
+	got, err := db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "new" {
+		t.Fatalf("Password is %q, expected %q", got.Password, "new")
+	}
+	family, err = db.GetRefreshFamily(family.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !family.Revoked {
+		t.Fatal("Session survived the password reset")
+	}
+	if keys, err := db.GetApiKeys(user.Id); err != nil || len(keys) != 0 {
+		t.Fatalf("Got %v, %v, expected no API keys", keys, err)
+	}
+	if _, err := db.GetApiKeyByHash("keyhash"); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Fatalf("Got %v, expected ErrApiKeyNotFound", err)
+	}
+	if keys, err := db.GetApiKeys(other.Id); err != nil || len(keys) != 1 {
+		t.Fatalf("Got %v, %v, expected the other user's API key", keys, err)
+	}
+
+	// A reset works only once.
+	if _, err := db.ResetPassword("second", "newer"); !errors.Is(err, ErrPasswordResetNotFound) {
+		t.Fatalf("Got %v, expected ErrPasswordResetNotFound", err)
+	}
+
+	if _, err := db.CreatePasswordReset(user.Id, "expired", time.Now().UTC().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResetPassword("expired", "newer"); !errors.Is(err, ErrPasswordResetNotFound) {
+		t.Fatalf("Got %v, expected ErrPasswordResetNotFound", err)
+	}
+}
+
+func TestPasswordResets(t *testing.T) {
+	db, _ := newTestDB(t)
+	testPasswordResets(t, db)
+}
+
+func TestSQLitePasswordResets(t *testing.T) {
+	testPasswordResets(t, newTestSQLiteDB(t))
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// Moderator actions on a reported or flagged chirp.
+const (
+	// ActionDismiss closes the reports without touching the chirp.
+	ActionDismiss = "dismiss"
+	// ActionHide keeps the chirp but takes it out of every public listing.
+	ActionHide = "hide"
+	// ActionDelete deletes the chirp.
+	ActionDelete = "delete"
+	// ActionSuspend suspends the chirp's author.
+	ActionSuspend = "suspend"
+)
+
+var (
+	ErrAlreadyReported         = errors.New("Chirp already reported")
+	ErrInvalidModerationAction = errors.New("Action must be one of dismiss, hide, delete or suspend")
+)
+
+// Report is a user's complaint about a chirp. It stays open until a
+// moderator acts on the chirp.
+type Report struct {
+	Id         int       `json:"id"`
+	ChirpId    int       `json:"chirp_id"`
+	ReporterId int       `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	// ActionId is the moderation action that closed the report, or 0
+	// while it is open.
+	ActionId int `json:"action_id,omitempty"`
+}
+
+// ModerationAction records a moderator acting on a chirp. Actions are
+// never changed or deleted, and keep the chirp's author and body so the
+// record survives the chirp.
+type ModerationAction struct {
+	Id          int       `json:"id"`
+	ChirpId     int       `json:"chirp_id"`
+	AuthorId    int       `json:"author_id"`
+	ChirpBody   string    `json:"chirp_body"`
+	ModeratorId int       `json:"moderator_id"`
+	Action      string    `json:"action"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ReportedChirp is an entry of the moderation queue: a chirp with its open
+// reports, oldest first. Chirp is nil if its author has since deleted it.
+type ReportedChirp struct {
+	ChirpId int
+	Chirp   *Chirp
+	Reports []Report
+}
+
+func validModerationAction(action string) bool {
+	switch action {
+	case ActionDismiss, ActionHide, ActionDelete, ActionSuspend:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func testReports(t *testing.T, db Store) {
+	t.Helper()
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, err := db.CreateUser(email, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := db.CreateChirp("Rude", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateChirp("Ruder", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ chirpId, reporterId int }{
+		{second.Id, 2}, {first.Id, 3}, {first.Id, 2},
+	} {
+		if _, err := db.CreateReport(r.chirpId, r.reporterId, "abuse"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.CreateReport(first.Id, 2, "again"); !errors.Is(err, ErrAlreadyReported) {
+		t.Fatalf("Got %v, expected ErrAlreadyReported", err)
+	}
+	if _, err := db.CreateReport(100, 2, "abuse"); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+
+	queue, err := db.GetReportQueue(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].ChirpId != first.Id || queue[0].Chirp == nil ||
+		len(queue[0].Reports) != 2 || queue[0].Reports[0].ReporterId != 3 ||
+		len(queue[1].Reports) != 1 {
+		t.Fatalf("Unexpected queue: %+v", queue)
+	}
+	if queue, _ := db.GetReportQueue(first.Id, 10); len(queue) != 1 || queue[0].ChirpId != second.Id {
+		t.Fatalf("Unexpected second page: %+v", queue)
+	}
+
+	if _, err := db.ModerateChirp(first.Id, 3, "ban"); !errors.Is(err, ErrInvalidModerationAction) {
+		t.Fatalf("Got %v, expected ErrInvalidModerationAction", err)
+	}
+	action, err := db.ModerateChirp(first.Id, 3, ActionHide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.AuthorId != 1 || action.ChirpBody != "Rude" || action.ModeratorId != 3 {
+		t.Fatalf("Unexpected action: %+v", action)
+	}
+	chirp, _, _ := db.GetChirpById(first.Id)
+	if !chirp.Hidden {
+		t.Fatal("Chirp not hidden")
+	}
+	page, err := db.GetChirpsPage(ChirpQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Id != second.Id {
+		t.Fatalf("Hidden chirp listed: %+v", page)
+	}
+	if page, _ := db.GetChirpsPage(ChirpQuery{IncludeHidden: true, Limit: 10}); len(page) != 2 {
+		t.Fatalf("Hidden chirp not included: %+v", page)
+	}
+	// The reports are closed, so the same user may report again.
+	if _, err := db.CreateReport(first.Id, 2, "still rude"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ModerateChirp(first.Id, 3, ActionDismiss); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports on a chirp its author deleted can still be dismissed.
+	if err := db.DeleteChirp(second.Id); err != nil {
+		t.Fatal(err)
+	}
+	if queue, _ := db.GetReportQueue(0, 10); len(queue) != 1 || queue[0].Chirp != nil {
+		t.Fatalf("Unexpected queue after delete: %+v", queue)
+	}
+	if _, err := db.ModerateChirp(second.Id, 3, ActionHide); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+	if _, err := db.ModerateChirp(second.Id, 3, ActionDismiss); err != nil {
+		t.Fatal(err)
+	}
+	if queue, _ := db.GetReportQueue(0, 10); len(queue) != 0 {
+		t.Fatalf("Unexpected queue after dismissing: %+v", queue)
+	}
+
+	if _, err := db.ModerateChirp(first.Id, 3, ActionSuspend); err != nil {
+		t.Fatal(err)
+	}
+	if author, _ := db.GetUserById(1); !author.Suspended {
+		t.Fatal("Author not suspended")
+	}
+	if _, err := db.ModerateChirp(first.Id, 3, ActionDelete); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := db.GetChirpById(first.Id); found {
+		t.Fatal("Chirp not deleted")
+	}
+
+	actions, err := db.GetModerationActions(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ActionHide, ActionDismiss, ActionDismiss, ActionSuspend, ActionDelete}
+	if len(actions) != len(want) {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	for i, action := range actions {
+		if action.Action != want[i] {
+			t.Fatalf("Action %d is %q, expected %q", i, action.Action, want[i])
+		}
+	}
+	if actions, _ := db.GetModerationActions(actions[3].Id, 10); len(actions) != 1 {
+		t.Fatalf("Unexpected actions after cursor: %+v", actions)
+	}
+}
+
+func TestReports(t *testing.T) {
+	db, _ := newTestDB(t)
+	testReports(t, db)
+}
+
+func TestSQLiteReports(t *testing.T) {
+	testReports(t, newTestSQLiteDB(t))
+}
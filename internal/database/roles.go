@@ -0,0 +1,31 @@
+package database
+
+import "errors"
+
+// Roles grant access to the admin and moderation endpoints. Each role
+// includes everything the ones before it may do.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var ErrInvalidRole = errors.New("Role must be one of user, moderator or admin")
+
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAllows reports whether role grants everything required does. An
+// unknown role allows nothing.
+func RoleAllows(role string, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
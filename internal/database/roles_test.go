@@ -0,0 +1,61 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, required string
+		want           bool
+	}{
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleUser, RoleModerator, false},
+		{"", RoleUser, false},
+		{"root", RoleUser, false},
+	}
+	for _, test := range tests {
+		if got := RoleAllows(test.role, test.required); got != test.want {
+			t.Errorf("RoleAllows(%q, %q) = %v, expected %v", test.role, test.required, got, test.want)
+		}
+	}
+}
+
+func testUserRoles(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUser {
+		t.Fatalf("New user has role %q", user.Role)
+	}
+	user, err = db.SetUserRole(user.Id, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleAdmin {
+		t.Fatalf("User has role %q after update", user.Role)
+	}
+	if user, _ := db.GetUserByEmail("a@example.com"); user.Role != RoleAdmin {
+		t.Fatalf("Stored user has role %q", user.Role)
+	}
+	if _, err := db.SetUserRole(user.Id, "root"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("Got %v, expected ErrInvalidRole", err)
+	}
+	if _, err := db.SetUserRole(100, RoleAdmin); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	db, _ := newTestDB(t)
+	testUserRoles(t, db)
+}
+
+func TestSQLiteUserRoles(t *testing.T) {
+	testUserRoles(t, newTestSQLiteDB(t))
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrEmptySearch = errors.New("Search query has no words")
+
+// SearchQuery selects chirps whose bodies match Text. Text is a list of
+// words and "quoted phrases", all of which must appear in a chirp.
+type SearchQuery struct {
+	Text string
+	// AuthorId restricts the results to one author when non-zero.
+	AuthorId int
+	// Since and Until bound the creation time of the results when set.
+	Since time.Time
+	Until time.Time
+	// ByRelevance orders the results by how well they match, best first,
+	// and pages through them by Offset. Otherwise they are ordered newest
+	// first and paged through by AfterId.
+	ByRelevance bool
+	Offset      int
+	AfterId     int
+	Limit       int
+}
+
+// tokenize splits text into lower-case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearch splits search text into its phrases, each a list of words.
+// A word outside quotes is a phrase of its own.
+func parseSearch(text string) ([][]string, error) {
+	var phrases [][]string
+	// Quotes alternate between phrases and loose words; an unterminated
+	// quote runs to the end.
+	for i, part := range strings.Split(text, `"`) {
+		words := tokenize(part)
+		if i%2 == 1 {
+			if len(words) > 0 {
+				phrases = append(phrases, words)
+			}
+			continue
+		}
+		for _, word := range words {
+			phrases = append(phrases, []string{word})
+		}
+	}
+	if len(phrases) == 0 {
+		return nil, ErrEmptySearch
+	}
+	return phrases, nil
+}
+
+// indexBody adds the words of a chirp to the inverted index.
+func (dbstruct *DBStructure) indexBody(chirp Chirp) {
+	for i, word := range tokenize(chirp.Body) {
+		postings := dbstruct.idx.words[word]
+		if postings == nil {
+			postings = make(map[int][]int)
+			dbstruct.idx.words[word] = postings
+		}
+		postings[chirp.Id] = append(postings[chirp.Id], i)
+	}
+}
+
+func (dbstruct *DBStructure) unindexBody(chirp Chirp) {
+	for _, word := range tokenize(chirp.Body) {
+		postings := dbstruct.idx.words[word]
+		delete(postings, chirp.Id)
+		if len(postings) == 0 {
+			delete(dbstruct.idx.words, word)
+		}
+	}
+}
+
+// search scores every chirp containing all the words of q and returns the
+// requested page of them.
+func (dbstruct *DBStructure) search(q SearchQuery) ([]Chirp, error) {
+	phrases, err := parseSearch(q.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the rarest word so the fewest chirps are checked.
+	words := []string{}
+	for _, phrase := range phrases {
+		words = append(words, phrase...)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return len(dbstruct.idx.words[words[i]]) < len(dbstruct.idx.words[words[j]])
+	})
+
+	type hit struct {
+		chirp Chirp
+		score float64
+	}
+	hits := []hit{}
+	for id := range dbstruct.idx.words[words[0]] {
+		chirp, _ := dbstruct.chirp(id)
+		if chirp.Hidden ||
+			q.AuthorId != 0 && chirp.AuthorId != q.AuthorId ||
+			!q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) ||
+			!q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) ||
+			!q.ByRelevance && q.AfterId != 0 && id >= q.AfterId {
+			continue
+		}
+		score, ok := dbstruct.score(id, phrases)
+		if ok {
+			hits = append(hits, hit{chirp, score})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if q.ByRelevance && hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].chirp.Id > hits[j].chirp.Id
+	})
+	if q.ByRelevance {
+		hits = hits[min(q.Offset, len(hits)):]
+	}
+	chirps := make([]Chirp, 0, min(q.Limit, len(hits)))
+	for _, hit := range hits[:min(q.Limit, len(hits))] {
+		chirps = append(chirps, hit.chirp)
+	}
+	return chirps, nil
+}
+
+// score rates how well chirp id matches phrases, summing a saturated term
+// frequency weighted by rarity over the phrases. It reports false if a
+// phrase is missing.
+func (dbstruct *DBStructure) score(id int, phrases [][]string) (float64, bool) {
+	total := 0.0
+	for _, phrase := range phrases {
+		matches := 0
+		for _, start := range dbstruct.idx.words[phrase[0]][id] {
+			if dbstruct.phraseAt(id, phrase, start) {
+				matches++
+			}
+		}
+		if matches == 0 {
+			return 0, false
+		}
+		tf := float64(matches)
+		idf := math.Log(1 + float64(len(dbstruct.Chirps))/float64(len(dbstruct.idx.words[phrase[0]])))
+		total += tf / (tf + 1.2) * idf
+	}
+	return total, true
+}
+
+// phraseAt reports whether the words of phrase appear in chirp id in order
+// from position start.
+func (dbstruct *DBStructure) phraseAt(id int, phrase []string, start int) bool {
+	for offset, word := range phrase[1:] {
+		positions := dbstruct.idx.words[word][id]
+		i := sort.SearchInts(positions, start+offset+1)
+		if i == len(positions) || positions[i] != start+offset+1 {
+			return false
+		}
+	}
+	return true
+}
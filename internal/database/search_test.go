@@ -0,0 +1,90 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	phrases, err := parseSearch(`Go "Learning, GO" rust "unterminated quote`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(phrases); got != "[[go] [learning go] [rust] [unterminated quote]]" {
+		t.Fatalf("Got phrases %s", got)
+	}
+	if _, err := parseSearch(`"" !?`); !errors.Is(err, ErrEmptySearch) {
+		t.Fatalf("Got %v, expected ErrEmptySearch", err)
+	}
+}
+
+func testSearch(t *testing.T, db Store) {
+	t.Helper()
+	bodies := []struct {
+		authorId int
+		body     string
+	}{
+		{1, "Learning Go today"},
+		{2, "Go go go!"},
+		{1, "Rust or Go, which one to go with for learning"},
+		{2, "Nothing to see here"},
+	}
+	for _, b := range bodies {
+		if _, err := db.CreateChirp(b.body, b.authorId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(q SearchQuery) string {
+		t.Helper()
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		chirps, err := db.SearchChirps(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, chirp := range chirps {
+			ids = append(ids, chirp.Id)
+		}
+		return fmt.Sprint(ids)
+	}
+	expect := func(got string, want string) {
+		t.Helper()
+		if got != want {
+			t.Fatalf("Got results %s, expected %s", got, want)
+		}
+	}
+
+	expect(search(SearchQuery{Text: "GO"}), "[3 2 1]")
+	expect(search(SearchQuery{Text: "go", ByRelevance: true, Limit: 1}), "[2]")
+	expect(search(SearchQuery{Text: "go learning"}), "[3 1]")
+	expect(search(SearchQuery{Text: `"learning go"`}), "[1]")
+	expect(search(SearchQuery{Text: "go", AuthorId: 2}), "[2]")
+	expect(search(SearchQuery{Text: "go", AfterId: 3, Limit: 1}), "[2]")
+	expect(search(SearchQuery{Text: "go", Since: time.Now().Add(time.Hour)}), "[]")
+	expect(search(SearchQuery{Text: "go", Until: time.Now().Add(time.Hour)}), "[3 2 1]")
+
+	// The index follows edits and deletes.
+	if _, err := db.UpdateChirp(4, 2, "Nothing but Go here", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteChirp(2); err != nil {
+		t.Fatal(err)
+	}
+	expect(search(SearchQuery{Text: "go"}), "[4 3 1]")
+	expect(search(SearchQuery{Text: "nothing"}), "[4]")
+	expect(search(SearchQuery{Text: "see"}), "[]")
+}
+
+func TestSearch(t *testing.T) {
+	db, _ := newTestDB(t)
+	testSearch(t, db)
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	testSearch(t, newTestSQLiteDB(t))
+}
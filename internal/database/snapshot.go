@@ -0,0 +1,182 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotGenerations is the number of previous snapshots kept next to the
+// live file as path.1 (newest) through path.N (oldest).
+const snapshotGenerations = 3
+
+// Recovery describes the repairs NewDB had to make to open the database.
+type Recovery struct {
+	// CorruptPath is where the unreadable snapshot was moved aside to.
+	CorruptPath string
+	CorruptErr  error
+	// Generation is the previous snapshot the data was restored from.
+	Generation int
+	JournalSeq int
+	// DiscardedJournalBytes counts the torn bytes dropped from the end of
+	// the journal.
+	DiscardedJournalBytes int64
+}
+
+func (r *Recovery) String() string {
+	parts := []string{}
+	if r.Generation != 0 {
+		parts = append(parts, fmt.Sprintf(
+			"snapshot was corrupt (%v), moved to %s; restored generation %d at journal seq %d",
+			r.CorruptErr, r.CorruptPath, r.Generation, r.JournalSeq,
+		))
+	}
+	if r.DiscardedJournalBytes != 0 {
+		parts = append(parts, fmt.Sprintf(
+			"discarded %d bytes of torn journal entry", r.DiscardedJournalBytes,
+		))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Recovery returns what NewDB repaired while opening the database, or nil
+// if everything was intact.
+func (db *DB) Recovery() *Recovery {
+	return db.recovery
+}
+
+func (db *DB) generationPath(gen int) string {
+	return fmt.Sprintf("%s.%d", db.path, gen)
+}
+
+// loadSnapshot reads the live snapshot into memory, creating an empty one
+// for a new database and falling back to older generations if it is
+// corrupt.
+func (db *DB) loadSnapshot() error {
+	dbstruct, err := db.loadDB()
+	if err == nil {
+		db.data = dbstruct
+		return nil
+	}
+	missing := os.IsNotExist(err)
+	if missing {
+		if _, statErr := os.Stat(db.generationPath(1)); os.IsNotExist(statErr) {
+			db.data = emptyDBStructure()
+			return db.writeDB(db.data)
+		}
+	}
+
+	for gen := 1; gen <= snapshotGenerations; gen++ {
+		dbstruct, genErr := readSnapshot(db.generationPath(gen))
+		if genErr != nil {
+			continue
+		}
+
+		recovery := &Recovery{
+			CorruptErr: err,
+			Generation: gen,
+			JournalSeq: dbstruct.JournalSeq,
+		}
+		if !missing {
+			recovery.CorruptPath = fmt.Sprintf("%s.corrupt-%d", db.path, time.Now().Unix())
+			if err := os.Rename(db.path, recovery.CorruptPath); err != nil {
+				return err
+			}
+		}
+		db.data = dbstruct
+		db.recovery = recovery
+		return db.writeDB(db.data)
+	}
+	return fmt.Errorf("no valid snapshot of %s: %w", db.path, err)
+}
+
+func (db *DB) loadDB() (DBStructure, error) {
+	return readSnapshot(db.path)
+}
+
+func readSnapshot(path string) (DBStructure, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	structure := DBStructure{}
+	err = json.Unmarshal(dat, &structure)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	if structure.Chirps == nil || structure.Users == nil || structure.Revocations == nil {
+		return DBStructure{}, errors.New("snapshot is missing tables")
+	}
+	return structure, nil
+}
+
+// writeDB atomically replaces the live snapshot: the data is written and
+// synced to a temporary file which is then renamed over the old one, after
+// the old one has been rotated into the previous generations.
+func (db *DB) writeDB(dbstruct DBStructure) error {
+	dat, err := json.Marshal(dbstruct)
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(db.path)
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.rotateGenerations(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateGenerations shifts path.1..path.N-1 up by one and hard-links the
+// live snapshot as path.1, so the live path never disappears.
+func (db *DB) rotateGenerations() error {
+	if _, err := os.Stat(db.path); os.IsNotExist(err) {
+		return nil
+	}
+	err := os.Remove(db.generationPath(snapshotGenerations))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for gen := snapshotGenerations - 1; gen >= 1; gen-- {
+		err := os.Rename(db.generationPath(gen), db.generationPath(gen+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Link(db.path, db.generationPath(1))
+}
+
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSnapshotGenerations(t *testing.T) {
+	db, _ := newTestDB(t)
+	for i := 0; i < snapshotGenerations+2; i++ {
+		if _, err := db.CreateChirp("Test", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for gen := 1; gen <= snapshotGenerations; gen++ {
+		snapshot, err := readSnapshot(db.generationPath(gen))
+		if err != nil {
+			t.Fatalf("Generation %d: %v", gen, err)
+		}
+		if want := snapshotGenerations + 2 - gen; len(snapshot.Chirps) != want {
+			t.Fatalf("Generation %d has %d chirps, expected %d", gen, len(snapshot.Chirps), want)
+		}
+	}
+	if _, err := os.Stat(db.generationPath(snapshotGenerations + 1)); !os.IsNotExist(err) {
+		t.Fatal("Too many generations were kept")
+	}
+}
+
+func TestRecoverCorruptSnapshot(t *testing.T) {
+	db, filename := newTestDB(t)
+	if _, err := db.CreateChirp("Test1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp("Test2", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash halfway through a plain, non-atomic write.
+	if err := os.WriteFile(filename, []byte(`{"chirps":{"1":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := NewDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	recovery := recovered.Recovery()
+	if recovery == nil || recovery.Generation != 1 {
+		t.Fatalf("Unexpected recovery %+v", recovery)
+	}
+	if _, err := os.Stat(recovery.CorruptPath); err != nil {
+		t.Fatal("Corrupt snapshot was not kept: ", err)
+	}
+	chirps, _ := recovered.GetChirps()
+	if len(chirps) != 1 {
+		t.Fatalf("Got %d chirps, expected 1", len(chirps))
+	}
+	if _, err := recovered.loadDB(); err != nil {
+		t.Fatal("Live snapshot was not restored: ", err)
+	}
+}
+
+func TestNoValidSnapshot(t *testing.T) {
+	_, filename := newTestDB(t)
+	if err := os.WriteFile(filename, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(filename); err == nil {
+		t.Fatal("Expected an error opening a corrupt database without generations")
+	}
+}
@@ -0,0 +1,1558 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	s, err := openSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.MigrateUp(false, io.Discard); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func openSQLiteDB(path string) (*SQLiteDB, error) {
+	dsn := "file:" + path +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)" +
+		"&_time_format=sqlite"
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serialises writers anyway; a single connection avoids
+	// SQLITE_BUSY errors between our own goroutines.
+	conn.SetMaxOpenConns(1)
+
+	s := &SQLiteDB{db: conn}
+	version, err := s.schemaVersion()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if version > latestSQLiteSchemaVersion() {
+		conn.Close()
+		return nil, fmt.Errorf("database schema version %d is newer than the latest known version %d",
+			version, latestSQLiteSchemaVersion())
+	}
+	return s, nil
+}
+
+// Close releases the underlying database connection.
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteDB) CreateChirp(body string, authorId int) (Chirp, error) {
+	return s.insertChirp(body, authorId, 0, nil)
+}
+
+func (s *SQLiteDB) CreateReply(body string, authorId int, inReplyTo int, flags []string) (Chirp, error) {
+	return s.insertChirp(body, authorId, inReplyTo, flags)
+}
+
+// insertChirp creates a chirp along with its hashtags and mentions. A
+// non-zero inReplyTo must be an existing chirp.
+func (s *SQLiteDB) insertChirp(body string, authorId int, inReplyTo int, flags []string) (Chirp, error) {
+	flagged, err := flagsValue(flags)
+	if err != nil {
+		return Chirp{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	if inReplyTo != 0 {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)`, inReplyTo).Scan(&exists)
+		if err != nil {
+			return Chirp{}, err
+		}
+		if !exists {
+			return Chirp{}, ErrChirpNotFound
+		}
+	}
+
+	now := time.Now().UTC()
+	var id int
+	err = tx.QueryRow(
+		`INSERT INTO chirps (author_id, body, in_reply_to, flags, created_at, updated_at)
+		VALUES (?, ?, NULLIF(?, 0), ?, ?, ?)
+		RETURNING id`,
+		authorId, body, inReplyTo, flagged, now, now,
+	).Scan(&id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := writeChirpEntities(tx, id, body); err != nil {
+		return Chirp{}, err
+	}
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+// writeChirpEntities replaces the stored hashtags and mentions of chirp id
+// with those parsed from body.
+func writeChirpEntities(tx *sql.Tx, id int, body string) error {
+	if _, err := tx.Exec(`DELETE FROM chirp_hashtags WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM chirp_mentions WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+
+	hashtags, names := parseEntities(body)
+	for i, tag := range hashtags {
+		_, err := tx.Exec(
+			`INSERT INTO chirp_hashtags (chirp_id, position, tag) VALUES (?, ?, ?)`, id, i, tag,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	var lookupErr error
+	mentions := resolveMentions(names, func(userId int) bool {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, userId).Scan(&exists)
+		if err != nil {
+			lookupErr = err
+		}
+		return exists
+	})
+	if lookupErr != nil {
+		return lookupErr
+	}
+	for i, mention := range mentions {
+		_, err := tx.Exec(
+			`INSERT INTO chirp_mentions (chirp_id, position, name, user_id)
+			VALUES (?, ?, ?, NULLIF(?, 0))`,
+			id, i, mention.Name, mention.UserId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanner is the common interface of *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// chirpColumns selects a chirp from the chirps table, with its hashtags and
+// mentions as JSON arrays and its replies, likes and rechirps counted
+// alongside.
+const chirpColumns = `id, author_id, body, COALESCE(in_reply_to, 0), COALESCE(rechirp_of, 0),
+	created_at, updated_at,
+	(SELECT json_group_array(tag ORDER BY position) FROM chirp_hashtags
+		WHERE chirp_hashtags.chirp_id = chirps.id),
+	(SELECT json_group_array(json_object('name', name, 'user_id', user_id) ORDER BY position)
+		FROM chirp_mentions WHERE chirp_mentions.chirp_id = chirps.id),
+	COALESCE(flags, '[]'), hidden,
+	(SELECT COUNT(*) FROM chirps AS replies WHERE replies.in_reply_to = chirps.id),
+	(SELECT COUNT(*) FROM likes WHERE likes.chirp_id = chirps.id),
+	(SELECT COUNT(*) FROM chirps AS rechirps WHERE rechirps.rechirp_of = chirps.id)`
+
+func scanChirp(row scanner) (Chirp, error) {
+	chirp := Chirp{}
+	var hashtags, mentions, flags string
+	err := row.Scan(&chirp.Id, &chirp.AuthorId, &chirp.Body, &chirp.InReplyTo, &chirp.RechirpOf,
+		&chirp.CreatedAt, &chirp.UpdatedAt, &hashtags, &mentions, &flags, &chirp.Hidden,
+		&chirp.ReplyCount, &chirp.LikeCount, &chirp.RechirpCount)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := json.Unmarshal([]byte(flags), &chirp.Flags); err != nil {
+		return Chirp{}, err
+	}
+	if err := json.Unmarshal([]byte(hashtags), &chirp.Hashtags); err != nil {
+		return Chirp{}, err
+	}
+	if err := json.Unmarshal([]byte(mentions), &chirp.Mentions); err != nil {
+		return Chirp{}, err
+	}
+	// Match the JSON store, which leaves them nil when there are none.
+	if len(chirp.Hashtags) == 0 {
+		chirp.Hashtags = nil
+	}
+	if len(chirp.Mentions) == 0 {
+		chirp.Mentions = nil
+	}
+	if len(chirp.Flags) == 0 {
+		chirp.Flags = nil
+	}
+	return chirp, nil
+}
+
+func (s *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+const userColumns = `id, email, password, is_chirpy_red, role, suspended, token_generation,
+	email_verified, pending_email, created_at, updated_at`
+
+func scanUser(row scanner) (User, error) {
+	user := User{}
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &user.Role, &user.Suspended,
+		&user.TokenGeneration, &user.EmailVerified, &user.PendingEmail, &user.CreatedAt, &user.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteDB) queryUsers(query string, args ...any) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return s.queryChirps(`SELECT ` + chirpColumns + ` FROM chirps ORDER BY id`)
+}
+
+func (s *SQLiteDB) GetChirpById(id int) (Chirp, bool, error) {
+	chirp, err := scanChirp(s.db.QueryRow(
+		`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, false, nil
+	}
+	if err != nil {
+		return Chirp{}, false, err
+	}
+	return chirp, true, nil
+}
+
+func (s *SQLiteDB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	return s.queryChirps(
+		`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? ORDER BY id`, authorId,
+	)
+}
+
+func (s *SQLiteDB) GetChirpAncestors(id int) ([]Chirp, error) {
+	if _, found, err := s.GetChirpById(id); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, ErrChirpNotFound
+	}
+	return s.queryChirps(
+		`WITH RECURSIVE ancestors (id) AS (
+			SELECT in_reply_to FROM chirps WHERE id = ?
+			UNION
+			SELECT chirps.in_reply_to FROM chirps JOIN ancestors ON chirps.id = ancestors.id
+		)
+		SELECT `+chirpColumns+` FROM chirps WHERE id IN (SELECT id FROM ancestors) ORDER BY id`, id,
+	)
+}
+
+func (s *SQLiteDB) GetChirpsPage(q ChirpQuery) ([]Chirp, error) {
+	query := `SELECT ` + chirpColumns + ` FROM chirps WHERE 1 = 1`
+	args := []any{}
+	if q.AuthorId != 0 {
+		query += ` AND author_id = ?`
+		args = append(args, q.AuthorId)
+	}
+	if q.InReplyTo != 0 {
+		query += ` AND in_reply_to = ?`
+		args = append(args, q.InReplyTo)
+	}
+	if q.Hashtag != "" {
+		query += ` AND id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)`
+		args = append(args, q.Hashtag)
+	}
+	if q.MentionedUserId != 0 {
+		query += ` AND id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)`
+		args = append(args, q.MentionedUserId)
+	}
+	if q.Flagged {
+		query += ` AND flags IS NOT NULL`
+	}
+	if !q.IncludeHidden {
+		query += ` AND hidden = 0`
+	}
+	if q.FollowedBy != 0 {
+		query += ` AND author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)`
+		args = append(args, q.FollowedBy)
+	}
+	if q.AfterId != 0 {
+		if q.Desc {
+			query += ` AND id < ?`
+		} else {
+			query += ` AND id > ?`
+		}
+		args = append(args, q.AfterId)
+	}
+	if q.Desc {
+		query += ` ORDER BY id DESC`
+	} else {
+		query += ` ORDER BY id`
+	}
+	query += ` LIMIT ?`
+	args = append(args, q.Limit)
+	return s.queryChirps(query, args...)
+}
+
+func (s *SQLiteDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	phrases, err := parseSearch(q.Text)
+	if err != nil {
+		return nil, err
+	}
+	// Every phrase is quoted, so nothing in the text is read as FTS5
+	// query syntax. The words come from tokenize and hold no quotes.
+	match := []string{}
+	for _, phrase := range phrases {
+		match = append(match, `"`+strings.Join(phrase, " ")+`"`)
+	}
+
+	query := `SELECT ` + chirpColumns + ` FROM chirps
+		JOIN (SELECT rowid, rank FROM chirps_fts WHERE chirps_fts MATCH ?) AS hits
+		ON hits.rowid = chirps.id
+		WHERE hidden = 0`
+	args := []any{strings.Join(match, " ")}
+	if q.AuthorId != 0 {
+		query += ` AND author_id = ?`
+		args = append(args, q.AuthorId)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, q.Until.UTC())
+	}
+	if q.ByRelevance {
+		query += ` ORDER BY hits.rank, id DESC LIMIT ? OFFSET ?`
+		args = append(args, q.Limit, q.Offset)
+	} else {
+		if q.AfterId != 0 {
+			query += ` AND id < ?`
+			args = append(args, q.AfterId)
+		}
+		query += ` ORDER BY id DESC LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return s.queryChirps(query, args...)
+}
+
+func (s *SQLiteDB) UpdateChirp(id int, authorId int, body string, flags []string) (Chirp, error) {
+	flagged, err := flagsValue(flags)
+	if err != nil {
+		return Chirp{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if old.AuthorId != authorId {
+		return Chirp{}, ErrNotAuthor
+	}
+	if old.RechirpOf != 0 {
+		return Chirp{}, ErrRechirpEdit
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at)
+		SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ? FROM chirp_revisions WHERE chirp_id = ?`,
+		id, old.Body, old.UpdatedAt, id,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if err := writeChirpEntities(tx, id, body); err != nil {
+		return Chirp{}, err
+	}
+	chirp, err := scanChirp(tx.QueryRow(
+		`UPDATE chirps SET body = ?, flags = ?, updated_at = ? WHERE id = ? RETURNING `+chirpColumns,
+		body, flagged, time.Now().UTC(), id,
+	))
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+func (s *SQLiteDB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	if _, found, err := s.GetChirpById(id); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, ErrChirpNotFound
+	}
+
+	rows, err := s.db.Query(
+		`SELECT revision, body, created_at FROM chirp_revisions
+		WHERE chirp_id = ? ORDER BY revision`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ChirpRevision{}
+	for rows.Next() {
+		revision := ChirpRevision{}
+		if err := rows.Scan(&revision.Revision, &revision.Body, &revision.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteChirp(id int) error {
+	_, err := s.db.Exec(`DELETE FROM chirps WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteDB) DeleteChirpByAuthor(id int, authorId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var chirpAuthorId int
+	err = tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ?`, id).Scan(&chirpAuthorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrChirpNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if chirpAuthorId != authorId {
+		return ErrNotAuthor
+	}
+	if _, err := tx.Exec(`DELETE FROM chirps WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) LikeChirp(id int, userId int) error {
+	res, err := s.db.Exec(
+		`INSERT INTO likes (chirp_id, user_id) SELECT id, ? FROM chirps WHERE id = ?
+		ON CONFLICT DO NOTHING`,
+		userId, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// Either the chirp is missing or it is already liked.
+		return s.checkChirpExists(id)
+	}
+	return nil
+}
+
+func (s *SQLiteDB) UnlikeChirp(id int, userId int) error {
+	res, err := s.db.Exec(`DELETE FROM likes WHERE chirp_id = ? AND user_id = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return s.checkChirpExists(id)
+	}
+	return nil
+}
+
+// checkChirpExists returns ErrChirpNotFound if there is no chirp id.
+func (s *SQLiteDB) checkChirpExists(id int) error {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrChirpNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) GetLikers(id int, afterId int, limit int) ([]User, error) {
+	return s.queryUsers(
+		`SELECT `+userColumns+` FROM users
+		WHERE id IN (SELECT user_id FROM likes WHERE chirp_id = ?) AND id > ?
+		ORDER BY id LIMIT ?`,
+		id, afterId, limit,
+	)
+}
+
+func (s *SQLiteDB) Rechirp(id int, userId int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	original, err := originalChirpId(tx, id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	rechirp, err := scanChirp(tx.QueryRow(
+		`SELECT `+chirpColumns+` FROM chirps WHERE rechirp_of = ? AND author_id = ?`,
+		original, userId,
+	))
+	if err == nil {
+		return rechirp, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, err
+	}
+
+	now := time.Now().UTC()
+	rechirp, err = scanChirp(tx.QueryRow(
+		`INSERT INTO chirps (author_id, body, rechirp_of, created_at, updated_at)
+		VALUES (?, '', ?, ?, ?)
+		RETURNING `+chirpColumns,
+		userId, original, now, now,
+	))
+	if err != nil {
+		return Chirp{}, err
+	}
+	return rechirp, tx.Commit()
+}
+
+func (s *SQLiteDB) Unrechirp(id int, userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	original, err := originalChirpId(tx, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM chirps WHERE rechirp_of = ? AND author_id = ?`, original, userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// originalChirpId resolves a rechirp to the chirp it shares; any other
+// chirp is its own original.
+func originalChirpId(tx *sql.Tx, id int) (int, error) {
+	var original int
+	err := tx.QueryRow(
+		`SELECT COALESCE(rechirp_of, id) FROM chirps WHERE id = ?`, id,
+	).Scan(&original)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrChirpNotFound
+	}
+	return original, err
+}
+
+// flagsValue encodes moderation flags for the flags column, which is NULL
+// for unflagged chirps.
+func flagsValue(flags []string) (any, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	dat, err := json.Marshal(flags)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+const moderationWordColumns = `id, pattern, mode, created_at`
+
+func scanModerationWord(row scanner) (ModerationWord, error) {
+	word := ModerationWord{}
+	err := row.Scan(&word.Id, &word.Pattern, &word.Mode, &word.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ModerationWord{}, ErrModerationWordNotFound
+	}
+	return word, err
+}
+
+func (s *SQLiteDB) GetModerationWords() ([]ModerationWord, error) {
+	rows, err := s.db.Query(`SELECT ` + moderationWordColumns + ` FROM moderation_words ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	words := []ModerationWord{}
+	for rows.Next() {
+		word, err := scanModerationWord(rows)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+	return words, rows.Err()
+}
+
+func (s *SQLiteDB) CreateModerationWord(pattern string, mode string) (ModerationWord, error) {
+	return s.putModerationWord(0, pattern, mode)
+}
+
+func (s *SQLiteDB) UpdateModerationWord(id int, pattern string, mode string) (ModerationWord, error) {
+	return s.putModerationWord(id, pattern, mode)
+}
+
+// putModerationWord validates and stores a moderation word, creating it if
+// id is 0.
+func (s *SQLiteDB) putModerationWord(id int, pattern string, mode string) (ModerationWord, error) {
+	pattern, err := normalizeModerationWord(pattern, mode)
+	if err != nil {
+		return ModerationWord{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ModerationWord{}, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM moderation_words WHERE pattern = ? AND id != ?)`, pattern, id,
+	).Scan(&taken)
+	if err != nil {
+		return ModerationWord{}, err
+	}
+	if taken {
+		return ModerationWord{}, ErrModerationWordExists
+	}
+
+	var row *sql.Row
+	if id == 0 {
+		row = tx.QueryRow(
+			`INSERT INTO moderation_words (pattern, mode, created_at) VALUES (?, ?, ?)
+			RETURNING `+moderationWordColumns,
+			pattern, mode, time.Now().UTC(),
+		)
+	} else {
+		row = tx.QueryRow(
+			`UPDATE moderation_words SET pattern = ?, mode = ? WHERE id = ?
+			RETURNING `+moderationWordColumns,
+			pattern, mode, id,
+		)
+	}
+	word, err := scanModerationWord(row)
+	if err != nil {
+		return ModerationWord{}, err
+	}
+	return word, tx.Commit()
+}
+
+func (s *SQLiteDB) DeleteModerationWord(id int) error {
+	res, err := s.db.Exec(`DELETE FROM moderation_words WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrModerationWordNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CreateReport(chirpId int, reporterId int, reason string) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	var exists, reported bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?),
+			EXISTS (SELECT 1 FROM reports
+				WHERE chirp_id = ? AND reporter_id = ? AND action_id IS NULL)`,
+		chirpId, chirpId, reporterId,
+	).Scan(&exists, &reported)
+	if err != nil {
+		return Report{}, err
+	}
+	if !exists {
+		return Report{}, ErrChirpNotFound
+	}
+	if reported {
+		return Report{}, ErrAlreadyReported
+	}
+
+	report, err := scanReport(tx.QueryRow(
+		`INSERT INTO reports (chirp_id, reporter_id, reason, created_at) VALUES (?, ?, ?, ?)
+		RETURNING `+reportColumns,
+		chirpId, reporterId, reason, time.Now().UTC(),
+	))
+	if err != nil {
+		return Report{}, err
+	}
+	return report, tx.Commit()
+}
+
+const reportColumns = `id, chirp_id, reporter_id, reason, created_at, COALESCE(action_id, 0)`
+
+func scanReport(row scanner) (Report, error) {
+	report := Report{}
+	err := row.Scan(&report.Id, &report.ChirpId, &report.ReporterId, &report.Reason,
+		&report.CreatedAt, &report.ActionId)
+	return report, err
+}
+
+func (s *SQLiteDB) GetReportQueue(afterChirpId int, limit int) ([]ReportedChirp, error) {
+	rows, err := s.db.Query(
+		`SELECT `+reportColumns+` FROM reports
+		WHERE action_id IS NULL AND chirp_id IN (
+			SELECT DISTINCT chirp_id FROM reports
+			WHERE action_id IS NULL AND chirp_id > ?
+			ORDER BY chirp_id LIMIT ?
+		)
+		ORDER BY chirp_id, id`,
+		afterChirpId, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []ReportedChirp{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(queue) == 0 || queue[len(queue)-1].ChirpId != report.ChirpId {
+			queue = append(queue, ReportedChirp{ChirpId: report.ChirpId})
+		}
+		entry := &queue[len(queue)-1]
+		entry.Reports = append(entry.Reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range queue {
+		chirp, found, err := s.GetChirpById(queue[i].ChirpId)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			queue[i].Chirp = &chirp
+		}
+	}
+	return queue, nil
+}
+
+func (s *SQLiteDB) ModerateChirp(chirpId int, moderatorId int, action string) (ModerationAction, error) {
+	if !validModerationAction(action) {
+		return ModerationAction{}, ErrInvalidModerationAction
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	defer tx.Rollback()
+
+	var authorId int
+	var body string
+	err = tx.QueryRow(`SELECT author_id, body FROM chirps WHERE id = ?`, chirpId).Scan(&authorId, &body)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ModerationAction{}, err
+	}
+	if !found {
+		// A chirp deleted by its author can only have its reports
+		// dismissed.
+		var reported bool
+		err := tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM reports WHERE chirp_id = ? AND action_id IS NULL)`, chirpId,
+		).Scan(&reported)
+		if err != nil {
+			return ModerationAction{}, err
+		}
+		if action != ActionDismiss || !reported {
+			return ModerationAction{}, ErrChirpNotFound
+		}
+	}
+
+	record, err := scanModerationAction(tx.QueryRow(
+		`INSERT INTO moderation_actions
+			(chirp_id, author_id, chirp_body, moderator_id, action, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING `+moderationActionColumns,
+		chirpId, authorId, body, moderatorId, action, time.Now().UTC(),
+	))
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	_, err = tx.Exec(
+		`UPDATE reports SET action_id = ? WHERE chirp_id = ? AND action_id IS NULL`, record.Id, chirpId,
+	)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	if !found {
+		return record, tx.Commit()
+	}
+	switch action {
+	case ActionDelete:
+		if _, err := tx.Exec(`DELETE FROM chirps WHERE id = ?`, chirpId); err != nil {
+			return ModerationAction{}, err
+		}
+		return record, tx.Commit()
+	case ActionSuspend:
+		_, err := tx.Exec(
+			`UPDATE users SET suspended = 1, updated_at = ? WHERE id = ?`, record.CreatedAt, authorId,
+		)
+		if err != nil {
+			return ModerationAction{}, err
+		}
+	}
+	// The chirp has been reviewed, so it leaves the flagged list too.
+	_, err = tx.Exec(
+		`UPDATE chirps SET flags = NULL, hidden = hidden OR ? WHERE id = ?`, action == ActionHide, chirpId,
+	)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	return record, tx.Commit()
+}
+
+const moderationActionColumns = `id, chirp_id, author_id, chirp_body, moderator_id, action, created_at`
+
+func scanModerationAction(row scanner) (ModerationAction, error) {
+	action := ModerationAction{}
+	err := row.Scan(&action.Id, &action.ChirpId, &action.AuthorId, &action.ChirpBody,
+		&action.ModeratorId, &action.Action, &action.CreatedAt)
+	return action, err
+}
+
+func (s *SQLiteDB) GetModerationActions(afterId int, limit int) ([]ModerationAction, error) {
+	rows, err := s.db.Query(
+		`SELECT `+moderationActionColumns+` FROM moderation_actions
+		WHERE id > ? ORDER BY id LIMIT ?`,
+		afterId, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []ModerationAction{}
+	for rows.Next() {
+		action, err := scanModerationAction(rows)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+func (s *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE)`, email,
+	).Scan(&exists)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrUserExists
+	}
+
+	now := time.Now().UTC()
+	user, err := scanUser(tx.QueryRow(
+		`INSERT INTO users (email, password, created_at, updated_at) VALUES (?, ?, ?, ?)
+		RETURNING `+userColumns,
+		email, password, now, now,
+	))
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) GetUserById(id int) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = ?`, id,
+	))
+}
+
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE email = ? COLLATE NOCASE`, email,
+	))
+}
+
+func (s *SQLiteDB) UpdateUser(id int, email string, password string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND id != ?)`, email, id,
+	).Scan(&taken)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		return User{}, ErrUserExists
+	}
+
+	user, err := scanUser(tx.QueryRow(
+		`UPDATE users SET email = ?, password = ?, updated_at = ?,
+			email_verified = email_verified AND email = ? COLLATE NOCASE
+		WHERE id = ?
+		RETURNING `+userColumns,
+		email, password, time.Now().UTC(), email, id,
+	))
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
+	}
+	return scanUser(s.db.QueryRow(
+		`UPDATE users SET role = ?, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns,
+		role, time.Now().UTC(), id,
+	))
+}
+
+func (s *SQLiteDB) UpgradeUser(id int) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?`,
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return ErrSelfFollow
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO follows (follower_id, followee_id)
+		SELECT follower.id, followee.id FROM users AS follower, users AS followee
+		WHERE follower.id = ? AND followee.id = ?
+		ON CONFLICT DO NOTHING`,
+		followerId, followeeId,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Either one of the users is missing or the follow already exists.
+		var exists bool
+		err := s.db.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM follows WHERE follower_id = ? AND followee_id = ?)`,
+			followerId, followeeId,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDB) Unfollow(followerId int, followeeId int) error {
+	_, err := s.db.Exec(
+		`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerId, followeeId,
+	)
+	return err
+}
+
+func (s *SQLiteDB) GetFollowers(userId int, afterId int, limit int) ([]User, error) {
+	return s.queryUsers(
+		`SELECT `+userColumns+` FROM users
+		WHERE id IN (SELECT follower_id FROM follows WHERE followee_id = ?) AND id > ?
+		ORDER BY id LIMIT ?`,
+		userId, afterId, limit,
+	)
+}
+
+func (s *SQLiteDB) GetFollowing(userId int, afterId int, limit int) ([]User, error) {
+	return s.queryUsers(
+		`SELECT `+userColumns+` FROM users
+		WHERE id IN (SELECT followee_id FROM follows WHERE follower_id = ?) AND id > ?
+		ORDER BY id LIMIT ?`,
+		userId, afterId, limit,
+	)
+}
+
+func (s *SQLiteDB) GetFollowCounts(userId int) (followers int, following int, err error) {
+	err = s.db.QueryRow(
+		`SELECT
+			(SELECT COUNT(*) FROM follows WHERE followee_id = ?),
+			(SELECT COUNT(*) FROM follows WHERE follower_id = ?)`,
+		userId, userId,
+	).Scan(&followers, &following)
+	return followers, following, err
+}
+
+const refreshFamilyColumns = `id, user_id, token_id, user_agent, ip, created_at, rotated_at, revoked`
+
+func scanRefreshFamily(row scanner) (RefreshFamily, error) {
+	family := RefreshFamily{}
+	err := row.Scan(&family.Id, &family.UserId, &family.TokenId, &family.UserAgent, &family.Ip,
+		&family.CreatedAt, &family.RotatedAt, &family.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshFamily{}, ErrRefreshFamilyNotFound
+	}
+	return family, err
+}
+
+func (s *SQLiteDB) CreateRefreshFamily(userId int, userAgent string, ip string) (RefreshFamily, error) {
+	family, err := newRefreshFamily(userId, userAgent, ip)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO refresh_families (`+refreshFamilyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		family.Id, family.UserId, family.TokenId, family.UserAgent, family.Ip, family.CreatedAt,
+		family.RotatedAt, family.Revoked,
+	)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+func (s *SQLiteDB) GetRefreshFamily(id string) (RefreshFamily, error) {
+	return scanRefreshFamily(s.db.QueryRow(
+		`SELECT `+refreshFamilyColumns+` FROM refresh_families WHERE id = ?`, id,
+	))
+}
+
+func (s *SQLiteDB) GetActiveRefreshFamilies(userId int) ([]RefreshFamily, error) {
+	rows, err := s.db.Query(
+		`SELECT `+refreshFamilyColumns+` FROM refresh_families
+		WHERE user_id = ? AND revoked = 0
+		ORDER BY created_at, id`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	families := []RefreshFamily{}
+	for rows.Next() {
+		family, err := scanRefreshFamily(rows)
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+	return families, rows.Err()
+}
+
+func (s *SQLiteDB) RotateRefreshToken(familyId string, tokenId string) (RefreshFamily, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	defer tx.Rollback()
+
+	family, err := scanRefreshFamily(tx.QueryRow(
+		`SELECT `+refreshFamilyColumns+` FROM refresh_families WHERE id = ?`, familyId,
+	))
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	if family.Revoked {
+		return RefreshFamily{}, ErrRefreshTokenRevoked
+	}
+	if family.TokenId != tokenId {
+		if _, err := tx.Exec(`UPDATE refresh_families SET revoked = 1 WHERE id = ?`, familyId); err != nil {
+			return RefreshFamily{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return RefreshFamily{}, err
+		}
+		return RefreshFamily{}, ErrRefreshTokenReused
+	}
+
+	next, err := newTokenId()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	family, err = scanRefreshFamily(tx.QueryRow(
+		`UPDATE refresh_families SET token_id = ?, rotated_at = ? WHERE id = ?
+		RETURNING `+refreshFamilyColumns,
+		next, time.Now().UTC(), familyId,
+	))
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeRefreshFamily(familyId string) error {
+	res, err := s.db.Exec(`UPDATE refresh_families SET revoked = 1 WHERE id = ?`, familyId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRefreshFamilyNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) RevokeUserTokens(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET token_generation = token_generation + 1 WHERE id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.Exec(`UPDATE refresh_families SET revoked = 1 WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) AdoptLegacyRefreshToken(token string, userId int, userAgent string,
+	ip string) (RefreshFamily, error) {
+	family, err := newRefreshFamily(userId, userAgent, ip)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	defer tx.Rollback()
+
+	var generation int
+	err = tx.QueryRow(`SELECT token_generation FROM users WHERE id = ?`, userId).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshFamily{}, ErrUserNotFound
+	}
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	if generation != 0 {
+		return RefreshFamily{}, ErrRefreshTokenRevoked
+	}
+	res, err := tx.Exec(
+		`INSERT INTO revocations (token, revoked_at) VALUES (?, ?) ON CONFLICT (token) DO NOTHING`,
+		token, family.CreatedAt,
+	)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	if n == 0 {
+		return RefreshFamily{}, ErrRefreshTokenRevoked
+	}
+	_, err = tx.Exec(
+		`INSERT INTO refresh_families (`+refreshFamilyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		family.Id, family.UserId, family.TokenId, family.UserAgent, family.Ip, family.CreatedAt,
+		family.RotatedAt, family.Revoked,
+	)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeLegacyRefreshToken(token string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO revocations (token, revoked_at) VALUES (?, ?) ON CONFLICT (token) DO NOTHING`,
+		token, time.Now().UTC(),
+	)
+	return err
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, hash, scope, created_at, expires_at, last_used_at`
+
+func scanApiKey(row scanner) (ApiKey, error) {
+	key := ApiKey{}
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &key.Hash, &key.Scope, &key.CreatedAt,
+		&expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ApiKey{}, ErrApiKeyNotFound
+	}
+	key.ExpiresAt = expiresAt.Time
+	key.LastUsedAt = lastUsedAt.Time
+	return key, err
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s *SQLiteDB) CreateApiKey(userId int, name string, prefix string, hash string, scope string,
+	expiresAt time.Time) (ApiKey, error) {
+	return scanApiKey(s.db.QueryRow(
+		`INSERT INTO api_keys (user_id, name, prefix, hash, scope, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING `+apiKeyColumns,
+		userId, name, prefix, hash, scope, time.Now().UTC(), nullTime(expiresAt),
+	))
+}
+
+func (s *SQLiteDB) GetApiKeys(userId int) ([]ApiKey, error) {
+	rows, err := s.db.Query(
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY id`, userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteDB) GetApiKeyByHash(hash string) (ApiKey, error) {
+	return scanApiKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hash))
+}
+
+func (s *SQLiteDB) TouchApiKey(id int, usedAt time.Time) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteApiKey(id int, userId int) error {
+	res, err := s.db.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CreatePasswordReset(userId int, hash string, expiresAt time.Time) (PasswordReset, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, userId).Scan(&exists)
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	if !exists {
+		return PasswordReset{}, ErrUserNotFound
+	}
+
+	reset := PasswordReset{
+		UserId:    userId,
+		Hash:      hash,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	_, err = s.db.Exec(
+		`INSERT OR REPLACE INTO password_resets (user_id, hash, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		reset.UserId, reset.Hash, reset.CreatedAt, reset.ExpiresAt,
+	)
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (s *SQLiteDB) ResetPassword(hash string, password string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var userId int
+	err = tx.QueryRow(
+		`DELETE FROM password_resets WHERE hash = ? AND expires_at > ? RETURNING user_id`,
+		hash, time.Now().UTC(),
+	).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrPasswordResetNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if _, err := tx.Exec(`UPDATE refresh_families SET revoked = 1 WHERE user_id = ?`, userId); err != nil {
+		return User{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM api_keys WHERE user_id = ?`, userId); err != nil {
+		return User{}, err
+	}
+	user, err := scanUser(tx.QueryRow(
+		`UPDATE users SET password = ?, token_generation = token_generation + 1, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns,
+		password, time.Now().UTC(), userId,
+	))
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) CreateEmailVerification(userId int, email string, hash string,
+	expiresAt time.Time) (EmailVerification, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	defer tx.Rollback()
+
+	var current bool
+	err = tx.QueryRow(`SELECT email = ? COLLATE NOCASE FROM users WHERE id = ?`, email, userId).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return EmailVerification{}, ErrUserNotFound
+	}
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	pending := ""
+	if !current {
+		var taken bool
+		err = tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE)`, email,
+		).Scan(&taken)
+		if err != nil {
+			return EmailVerification{}, err
+		}
+		if taken {
+			return EmailVerification{}, ErrUserExists
+		}
+		pending = email
+	}
+	if _, err := tx.Exec(`UPDATE users SET pending_email = ? WHERE id = ?`, pending, userId); err != nil {
+		return EmailVerification{}, err
+	}
+
+	verification := EmailVerification{
+		UserId:    userId,
+		Email:     email,
+		Hash:      hash,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO email_verifications (user_id, email, hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		verification.UserId, verification.Email, verification.Hash, verification.CreatedAt,
+		verification.ExpiresAt,
+	)
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	return verification, tx.Commit()
+}
+
+func (s *SQLiteDB) VerifyEmail(hash string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var userId int
+	var email string
+	err = tx.QueryRow(
+		`DELETE FROM email_verifications WHERE hash = ? AND expires_at > ? RETURNING user_id, email`,
+		hash, time.Now().UTC(),
+	).Scan(&userId, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrEmailVerificationNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userId))
+	if err != nil {
+		return User{}, err
+	}
+
+	switch {
+	case emailKey(email) == emailKey(user.Email):
+		user, err = scanUser(tx.QueryRow(
+			`UPDATE users SET email_verified = 1 WHERE id = ? RETURNING `+userColumns, userId,
+		))
+	case emailKey(email) == emailKey(user.PendingEmail):
+		var taken bool
+		err = tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND id != ?)`, email, userId,
+		).Scan(&taken)
+		if err != nil {
+			return User{}, err
+		}
+		if taken {
+			return User{}, ErrUserExists
+		}
+		user, err = scanUser(tx.QueryRow(
+			`UPDATE users SET email = pending_email, pending_email = '', email_verified = 1, updated_at = ?
+			WHERE id = ?
+			RETURNING `+userColumns,
+			time.Now().UTC(), userId,
+		))
+	default:
+		return User{}, ErrEmailVerificationNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) CancelEmailChange(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pending string
+	err = tx.QueryRow(`SELECT pending_email FROM users WHERE id = ?`, userId).Scan(&pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if pending == "" {
+		return nil
+	}
+	_, err = tx.Exec(`DELETE FROM email_verifications WHERE user_id = ? AND email = ? COLLATE NOCASE`, userId, pending)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET pending_email = '' WHERE id = ?`, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
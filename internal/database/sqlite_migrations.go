@@ -0,0 +1,460 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+type sqliteMigration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Backfill, if set, runs after Up in the same transaction, for data
+	// changes that can't be written in SQL.
+	Backfill func(tx *sql.Tx) error
+}
+
+// sqliteMigrations is the ordered registry of SQLite schema changes,
+// tracked through PRAGMA user_version. Append new migrations to the end.
+var sqliteMigrations = []sqliteMigration{
+	{
+		Version: 1,
+		Name:    "create users, chirps and revocations",
+		Up: `
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body      TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+
+CREATE TABLE IF NOT EXISTS revocations (
+	token      TEXT     PRIMARY KEY,
+	revoked_at DATETIME NOT NULL
+);`,
+		Down: `
+DROP TABLE revocations;
+DROP TABLE chirps;
+DROP TABLE users;`,
+	},
+	{
+		Version: 2,
+		Name:    "index user emails case-insensitively",
+		Up:      `CREATE UNIQUE INDEX users_email_nocase ON users (email COLLATE NOCASE);`,
+		Down:    `DROP INDEX users_email_nocase;`,
+	},
+	{
+		Version: 3,
+		Name:    "add timestamps and chirp revisions",
+		// ALTER TABLE only takes constant defaults, so existing rows are
+		// stamped with the time of the migration afterwards.
+		Up: `
+ALTER TABLE chirps ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE chirps ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+UPDATE chirps SET created_at = datetime('now'), updated_at = datetime('now');
+
+ALTER TABLE users ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE users ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+UPDATE users SET created_at = datetime('now'), updated_at = datetime('now');
+
+CREATE TABLE chirp_revisions (
+	chirp_id   INTEGER  NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	revision   INTEGER  NOT NULL,
+	body       TEXT     NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (chirp_id, revision)
+);`,
+		Down: `
+DROP TABLE chirp_revisions;
+ALTER TABLE users DROP COLUMN updated_at;
+ALTER TABLE users DROP COLUMN created_at;
+ALTER TABLE chirps DROP COLUMN updated_at;
+ALTER TABLE chirps DROP COLUMN created_at;`,
+	},
+	{
+		Version: 4,
+		Name:    "add chirp replies",
+		// Replies keep the ID of a deleted parent, as in the JSON store.
+		Up: `
+ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER;
+CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to);`,
+		Down: `
+DROP INDEX chirps_in_reply_to;
+ALTER TABLE chirps DROP COLUMN in_reply_to;`,
+	},
+	{
+		Version: 5,
+		Name:    "add follows",
+		Up: `
+CREATE TABLE follows (
+	follower_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	followee_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (follower_id, followee_id)
+);
+CREATE INDEX follows_followee_id ON follows (followee_id, follower_id);`,
+		Down: `DROP TABLE follows;`,
+	},
+	{
+		Version: 6,
+		Name:    "add likes and rechirps",
+		Up: `
+CREATE TABLE likes (
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	user_id  INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (chirp_id, user_id)
+);
+
+ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER REFERENCES chirps (id) ON DELETE CASCADE;
+CREATE UNIQUE INDEX chirps_rechirp_of ON chirps (rechirp_of, author_id)
+	WHERE rechirp_of IS NOT NULL;`,
+		Down: `
+DROP TABLE likes;
+DELETE FROM chirps WHERE rechirp_of IS NOT NULL;
+DROP INDEX chirps_rechirp_of;
+ALTER TABLE chirps DROP COLUMN rechirp_of;`,
+	},
+	{
+		Version: 7,
+		Name:    "parse hashtags and mentions",
+		Up: `
+CREATE TABLE chirp_hashtags (
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	tag      TEXT    NOT NULL,
+	PRIMARY KEY (chirp_id, position)
+);
+CREATE INDEX chirp_hashtags_tag ON chirp_hashtags (tag, chirp_id);
+
+CREATE TABLE chirp_mentions (
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	name     TEXT    NOT NULL,
+	user_id  INTEGER REFERENCES users (id) ON DELETE SET NULL,
+	PRIMARY KEY (chirp_id, position)
+);
+CREATE INDEX chirp_mentions_user_id ON chirp_mentions (user_id, chirp_id);`,
+		Down: `
+DROP TABLE chirp_mentions;
+DROP TABLE chirp_hashtags;`,
+		Backfill: parseChirpEntities,
+	},
+	{
+		Version: 8,
+		Name:    "add full-text search",
+		// The index reads bodies from chirps and the triggers keep it in
+		// step; FTS5 external content tables don't update themselves.
+		Up: `
+CREATE VIRTUAL TABLE chirps_fts USING fts5 (
+	body,
+	content = 'chirps',
+	content_rowid = 'id',
+	tokenize = 'unicode61 remove_diacritics 0'
+);
+INSERT INTO chirps_fts (chirps_fts) VALUES ('rebuild');
+
+CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+	INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+END;
+CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+	INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+END;
+CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+	INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+END;`,
+		Down: `
+DROP TRIGGER chirps_fts_update;
+DROP TRIGGER chirps_fts_delete;
+DROP TRIGGER chirps_fts_insert;
+DROP TABLE chirps_fts;`,
+	},
+	{
+		Version: 9,
+		Name:    "add moderation words",
+		// Existing deployments start with the words chirps were always
+		// checked against. Chirp flags are a JSON array, or NULL if the
+		// chirp isn't flagged.
+		Up: `
+CREATE TABLE moderation_words (
+	id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+	pattern    TEXT     NOT NULL UNIQUE,
+	mode       TEXT     NOT NULL CHECK (mode IN ('mask', 'reject', 'flag')),
+	created_at DATETIME NOT NULL
+);
+INSERT INTO moderation_words (pattern, mode, created_at) VALUES
+	('kerfuffle', 'mask', datetime('now')),
+	('sharbert', 'mask', datetime('now')),
+	('fornax', 'mask', datetime('now'));
+
+ALTER TABLE chirps ADD COLUMN flags TEXT;
+CREATE INDEX chirps_flagged ON chirps (id) WHERE flags IS NOT NULL;`,
+		Down: `
+DROP INDEX chirps_flagged;
+ALTER TABLE chirps DROP COLUMN flags;
+DROP TABLE moderation_words;`,
+	},
+	{
+		Version: 10,
+		Name:    "add reports and moderation actions",
+		// Reports and actions outlive the chirps they are about, so
+		// chirp_id is not a foreign key. A report is open while action_id
+		// is NULL, and a user can have one open report per chirp.
+		Up: `
+CREATE TABLE moderation_actions (
+	id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+	chirp_id     INTEGER  NOT NULL,
+	author_id    INTEGER  NOT NULL,
+	chirp_body   TEXT     NOT NULL,
+	moderator_id INTEGER  NOT NULL,
+	action       TEXT     NOT NULL CHECK (action IN ('dismiss', 'hide', 'delete', 'suspend')),
+	created_at   DATETIME NOT NULL
+);
+
+CREATE TABLE reports (
+	id          INTEGER  PRIMARY KEY AUTOINCREMENT,
+	chirp_id    INTEGER  NOT NULL,
+	reporter_id INTEGER  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	reason      TEXT     NOT NULL,
+	created_at  DATETIME NOT NULL,
+	action_id   INTEGER  REFERENCES moderation_actions (id)
+);
+CREATE UNIQUE INDEX reports_open ON reports (chirp_id, reporter_id) WHERE action_id IS NULL;
+
+ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+ALTER TABLE users DROP COLUMN suspended;
+ALTER TABLE chirps DROP COLUMN hidden;
+DROP TABLE reports;
+DROP TABLE moderation_actions;`,
+	},
+	{
+		Version: 11,
+		Name:    "add user roles",
+		Up: `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'
+	CHECK (role IN ('user', 'moderator', 'admin'));`,
+		Down: `ALTER TABLE users DROP COLUMN role;`,
+	},
+	{
+		Version: 12,
+		Name:    "track refresh token families",
+		// revocations stays for the refresh tokens issued before
+		// families, which are adopted into a family on their first refresh.
+		Up: `
+CREATE TABLE refresh_families (
+	id         TEXT     PRIMARY KEY,
+	user_id    INTEGER  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	token_id   TEXT     NOT NULL,
+	created_at DATETIME NOT NULL,
+	rotated_at DATETIME NOT NULL,
+	revoked    INTEGER  NOT NULL DEFAULT 0
+);
+CREATE INDEX refresh_families_user_id ON refresh_families (user_id);`,
+		Down: `
+DROP TABLE refresh_families;`,
+	},
+	{
+		Version: 13,
+		Name:    "add session details and token generations",
+		Up: `
+ALTER TABLE refresh_families ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_families ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+ALTER TABLE users DROP COLUMN token_generation;
+ALTER TABLE refresh_families DROP COLUMN ip;
+ALTER TABLE refresh_families DROP COLUMN user_agent;`,
+	},
+	{
+		Version: 14,
+		Name:    "add api keys",
+		Up: `
+CREATE TABLE api_keys (
+	id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name         TEXT     NOT NULL,
+	prefix       TEXT     NOT NULL,
+	hash         TEXT     NOT NULL UNIQUE,
+	scope        TEXT     NOT NULL,
+	created_at   DATETIME NOT NULL,
+	expires_at   DATETIME,
+	last_used_at DATETIME
+);
+CREATE INDEX api_keys_user_id ON api_keys (user_id);`,
+		Down: `DROP TABLE api_keys;`,
+	},
+	{
+		Version: 15,
+		Name:    "add password resets",
+		Up: `
+CREATE TABLE password_resets (
+	user_id    INTEGER  PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	hash       TEXT     NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);`,
+		Down: `DROP TABLE password_resets;`,
+	},
+	{
+		Version: 16,
+		Name:    "add email verifications",
+		Up: `
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN pending_email TEXT NOT NULL DEFAULT '';
+-- Existing users signed up before verification and count as verified.
+UPDATE users SET email_verified = 1;
+CREATE TABLE email_verifications (
+	user_id    INTEGER  PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	email      TEXT     NOT NULL,
+	hash       TEXT     NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);`,
+		Down: `
+DROP TABLE email_verifications;
+ALTER TABLE users DROP COLUMN pending_email;
+ALTER TABLE users DROP COLUMN email_verified;`,
+	},
+	{
+		Version:  17,
+		Name:     "resolve mentions of user ids",
+		Up:       `UPDATE chirp_mentions SET user_id = NULL;`,
+		Down:     `UPDATE chirp_mentions SET user_id = NULL;`,
+		Backfill: parseChirpEntities,
+	},
+}
+
+// parseChirpEntities stores the hashtags and mentions of existing chirps.
+func parseChirpEntities(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, body FROM chirps`)
+	if err != nil {
+		return err
+	}
+	bodies := map[int]string{}
+	for rows.Next() {
+		var id int
+		var body string
+		if err := rows.Scan(&id, &body); err != nil {
+			rows.Close()
+			return err
+		}
+		bodies[id] = body
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, body := range bodies {
+		if err := writeChirpEntities(tx, id, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func latestSQLiteSchemaVersion() int {
+	if len(sqliteMigrations) == 0 {
+		return 0
+	}
+	return sqliteMigrations[len(sqliteMigrations)-1].Version
+}
+
+func (s *SQLiteDB) schemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+func (s *SQLiteDB) MigrationStatus() ([]MigrationStatus, error) {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(sqliteMigrations))
+	for _, m := range sqliteMigrations {
+		statuses = append(statuses, MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+			Applied: m.Version <= version,
+		})
+	}
+	return statuses, nil
+}
+
+func (s *SQLiteDB) MigrateUp(dryRun bool, w io.Writer) error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range sqliteMigrations {
+		if m.Version <= version {
+			continue
+		}
+		fmt.Fprintf(w, "up %d: %s\n", m.Version, m.Name)
+		if err := s.applyMigration(m.Up, m.Backfill, m.Version, dryRun, w); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDB) MigrateDown(steps int, dryRun bool, w io.Writer) error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	for i := len(sqliteMigrations) - 1; i >= 0 && steps > 0; i-- {
+		m := sqliteMigrations[i]
+		if m.Version > version {
+			continue
+		}
+		fmt.Fprintf(w, "down %d: %s\n", m.Version, m.Name)
+		if err := s.applyMigration(m.Down, nil, m.Version-1, dryRun, w); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// applyMigration runs script and backfill, if any, and records version in a
+// single transaction, or only prints the script when dryRun is set.
+func (s *SQLiteDB) applyMigration(script string, backfill func(tx *sql.Tx) error,
+	version int, dryRun bool, w io.Writer) error {
+	if dryRun {
+		fmt.Fprintln(w, script)
+		if backfill != nil {
+			fmt.Fprintln(w, "-- followed by a backfill of existing rows")
+		}
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if backfill != nil {
+		if err := backfill(tx); err != nil {
+			return err
+		}
+	}
+	// PRAGMA doesn't accept bound parameters.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
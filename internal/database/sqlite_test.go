@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestSQLiteDB(t *testing.T) *SQLiteDB {
+	t.Helper()
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteChirps(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	first, err := db.CreateChirp("Test1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("Test2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirp, found, err := db.GetChirpById(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !reflect.DeepEqual(chirp, first) {
+		t.Fatalf("Got %+v, expected %+v", chirp, first)
+	}
+
+	if err := db.DeleteChirp(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "Test2" {
+		t.Fatalf("Unexpected chirps after delete: %+v", chirps)
+	}
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	user, err := db.CreateUser("walt@breakingbad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser("walt@breakingbad.com", "hash"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Expected ErrUserExists, got %v", err)
+	}
+
+	if err := db.UpgradeUser(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpgradeUser(user.Id + 1); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	updated, err := db.UpdateUser(user.Id, "heisenberg@breakingbad.com", "newhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.IsChirpyRed || updated.Password != "newhash" {
+		t.Fatalf("Unexpected user after update: %+v", updated)
+	}
+
+	got, err := db.GetUserByEmail("heisenberg@breakingbad.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != updated {
+		t.Fatalf("Got %+v, expected %+v", got, updated)
+	}
+}
+
+func TestSQLiteChirpIdsNotReused(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	for i := 0; i < 3; i++ {
+		if _, err := db.CreateChirp("Test", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteChirp(3); err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp("Test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 4 {
+		t.Fatalf("Got id %d, expected 4", chirp.Id)
+	}
+}
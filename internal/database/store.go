@@ -0,0 +1,227 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is the persistence layer used by the API handlers. DB keeps
+// everything in a JSON file, SQLiteDB in an embedded SQLite database.
+type Store interface {
+	CreateChirp(body string, authorId int) (Chirp, error)
+	// CreateReply creates a chirp in reply to an existing one, failing with
+	// ErrChirpNotFound if it doesn't exist, or a top-level chirp if
+	// inReplyTo is 0. The chirp is flagged for the given moderation
+	// patterns, if any.
+	CreateReply(body string, authorId int, inReplyTo int, flags []string) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpById(id int) (Chirp, bool, error)
+	GetChirpsByAuthor(authorId int) ([]Chirp, error)
+	GetChirpsPage(q ChirpQuery) ([]Chirp, error)
+	// GetChirpAncestors returns the chain of chirps a chirp replies to,
+	// starting at the root of its thread. The chain ends early at a deleted
+	// chirp.
+	GetChirpAncestors(id int) ([]Chirp, error)
+	// SearchChirps returns a page of the chirps matching q, failing with
+	// ErrEmptySearch if q.Text has no words.
+	SearchChirps(q SearchQuery) ([]Chirp, error)
+	// UpdateChirp replaces the body of a chirp and the moderation patterns
+	// it is flagged for.
+	UpdateChirp(id int, authorId int, body string, flags []string) (Chirp, error)
+	GetChirpHistory(id int) ([]ChirpRevision, error)
+	DeleteChirp(id int) error
+	DeleteChirpByAuthor(id int, authorId int) error
+	// LikeChirp and UnlikeChirp are idempotent, failing only with
+	// ErrChirpNotFound.
+	LikeChirp(id int, userId int) error
+	UnlikeChirp(id int, userId int) error
+	// GetLikers returns at most limit users who liked the chirp, ordered by
+	// ID and starting after afterId.
+	GetLikers(id int, afterId int, limit int) ([]User, error)
+	// Rechirp shares a chirp as a new chirp by userId, returning the
+	// existing rechirp if userId already shared it.
+	Rechirp(id int, userId int) (Chirp, error)
+	Unrechirp(id int, userId int) error
+
+	CreateUser(email string, password string) (User, error)
+	GetUserById(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	// UpdateUser marks the user unverified if the email changes.
+	UpdateUser(id int, email string, password string) (User, error)
+	UpgradeUser(id int) error
+	// SetUserRole fails with ErrInvalidRole for an unknown role.
+	SetUserRole(id int, role string) (User, error)
+
+	// GetModerationWords returns the moderation word list ordered by ID.
+	GetModerationWords() ([]ModerationWord, error)
+	// CreateModerationWord and UpdateModerationWord fail with
+	// ErrInvalidModerationWord for a bad pattern or mode, and with
+	// ErrModerationWordExists if another entry has the same pattern.
+	CreateModerationWord(pattern string, mode string) (ModerationWord, error)
+	UpdateModerationWord(id int, pattern string, mode string) (ModerationWord, error)
+	DeleteModerationWord(id int) error
+
+	// CreateReport files a report against a chirp, failing with
+	// ErrChirpNotFound if it doesn't exist and with ErrAlreadyReported if
+	// the reporter has an open report on it.
+	CreateReport(chirpId int, reporterId int, reason string) (Report, error)
+	// GetReportQueue returns at most limit chirps with open reports,
+	// ordered by chirp ID and starting after afterChirpId.
+	GetReportQueue(afterChirpId int, limit int) ([]ReportedChirp, error)
+	// ModerateChirp carries out a moderator's action on a chirp, closes its
+	// open reports and clears its flags, and records the action.
+	ModerateChirp(chirpId int, moderatorId int, action string) (ModerationAction, error)
+	// GetModerationActions returns at most limit recorded actions ordered
+	// by ID, starting after afterId.
+	GetModerationActions(afterId int, limit int) ([]ModerationAction, error)
+
+	// Follow makes follower follow followee. Following twice is not an
+	// error.
+	Follow(followerId int, followeeId int) error
+	Unfollow(followerId int, followeeId int) error
+	// GetFollowers and GetFollowing return at most limit users ordered by
+	// ID, starting after afterId.
+	GetFollowers(userId int, afterId int, limit int) ([]User, error)
+	GetFollowing(userId int, afterId int, limit int) ([]User, error)
+	GetFollowCounts(userId int) (followers int, following int, err error)
+
+	// CreateRefreshFamily starts a new refresh token family for a login
+	// from the given device.
+	CreateRefreshFamily(userId int, userAgent string, ip string) (RefreshFamily, error)
+	GetRefreshFamily(id string) (RefreshFamily, error)
+	// GetActiveRefreshFamilies returns the user's unrevoked families,
+	// oldest first.
+	GetActiveRefreshFamilies(userId int) ([]RefreshFamily, error)
+	// RotateRefreshToken replaces the current token of a family, failing
+	// with ErrRefreshFamilyNotFound or ErrRefreshTokenRevoked. If tokenId
+	// has already been rotated out the family is revoked and
+	// ErrRefreshTokenReused is returned.
+	RotateRefreshToken(familyId string, tokenId string) (RefreshFamily, error)
+	RevokeRefreshFamily(familyId string) error
+	// RevokeUserTokens revokes every refresh token family of a user and
+	// bumps their token generation, which invalidates their access tokens.
+	RevokeUserTokens(userId int) error
+	// AdoptLegacyRefreshToken starts a family for a refresh token issued
+	// before families and revokes the token. It fails with
+	// ErrRefreshTokenRevoked if the token was revoked or adopted before, or
+	// if the user has revoked all their tokens since.
+	AdoptLegacyRefreshToken(token string, userId int, userAgent string, ip string) (RefreshFamily, error)
+	// RevokeLegacyRefreshToken revokes a refresh token issued before
+	// families.
+	RevokeLegacyRefreshToken(token string) error
+
+	// CreateApiKey stores an API key by the hash of its secret. A zero
+	// expiresAt never expires.
+	CreateApiKey(userId int, name string, prefix string, hash string, scope string,
+		expiresAt time.Time) (ApiKey, error)
+	// GetApiKeys returns the user's API keys ordered by ID.
+	GetApiKeys(userId int) ([]ApiKey, error)
+	// GetApiKeyByHash fails with ErrApiKeyNotFound if no key has the hash.
+	GetApiKeyByHash(hash string) (ApiKey, error)
+	TouchApiKey(id int, usedAt time.Time) error
+	// DeleteApiKey fails with ErrApiKeyNotFound unless userId has key id.
+	DeleteApiKey(id int, userId int) error
+
+	// CreatePasswordReset stores the hash of a password reset token for
+	// userId, replacing any earlier one so that only the latest works.
+	CreatePasswordReset(userId int, hash string, expiresAt time.Time) (PasswordReset, error)
+	// ResetPassword consumes the password reset with the hash, sets the
+	// user's password, revokes their tokens like RevokeUserTokens and
+	// deletes their API keys. It fails with ErrPasswordResetNotFound if
+	// the reset is unknown, used or expired.
+	ResetPassword(hash string, password string) (User, error)
+
+	// CreateEmailVerification stores the hash of a token verifying email
+	// for userId, replacing any earlier one. An address other than the
+	// user's current one becomes their PendingEmail; it fails with
+	// ErrUserExists if another user has it.
+	CreateEmailVerification(userId int, email string, hash string,
+		expiresAt time.Time) (EmailVerification, error)
+	// VerifyEmail consumes the email verification with the hash and marks
+	// its address verified, switching the user over to it if it was
+	// pending. It fails with ErrEmailVerificationNotFound if the
+	// verification is unknown, used or expired, and with ErrUserExists if
+	// another user has taken the address meanwhile.
+	VerifyEmail(hash string) (User, error)
+	// CancelEmailChange drops the user's PendingEmail and the verification
+	// sent to it, if any.
+	CancelEmailChange(userId int) error
+
+	Close() error
+}
+
+// ChirpQuery selects one page of chirps in ID order. Because IDs are never
+// reused, paging by the last ID seen is stable across inserts and deletes.
+type ChirpQuery struct {
+	// AuthorId restricts the page to one author when non-zero.
+	AuthorId int
+	// InReplyTo restricts the page to direct replies to that chirp when
+	// non-zero.
+	InReplyTo int
+	// FollowedBy restricts the page to chirps by users that user follows
+	// when non-zero.
+	FollowedBy int
+	// Hashtag restricts the page to chirps tagged with it when non-empty.
+	// It must be lower-case.
+	Hashtag string
+	// MentionedUserId restricts the page to chirps mentioning that user
+	// when non-zero.
+	MentionedUserId int
+	// Flagged restricts the page to chirps flagged for review.
+	Flagged bool
+	// IncludeHidden includes chirps hidden by a moderator.
+	IncludeHidden bool
+	// AfterId is the last ID of the previous page, or 0 for the first.
+	AfterId int
+	// Desc orders the chirps newest first.
+	Desc  bool
+	Limit int
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Open returns the Store for the given driver, backed by the file at path.
+func Open(driver, path string) (Store, error) {
+	switch driver {
+	case DriverJSON:
+		return NewDB(path)
+	case DriverSQLite:
+		return NewSQLiteDB(path)
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+// Remove deletes every file the given driver keeps for the store at path.
+func Remove(driver, path string) error {
+	var paths []string
+	switch driver {
+	case DriverJSON:
+		// The journal, previous generations and any corrupt snapshots
+		// moved aside all share the path as a prefix.
+		others, err := filepath.Glob(path + ".*")
+		if err != nil {
+			return err
+		}
+		paths = append([]string{path}, others...)
+	case DriverSQLite:
+		paths = []string{path, path + "-wal", path + "-shm"}
+	default:
+		return fmt.Errorf("unknown database driver %q", driver)
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRefreshFamilyNotFound = errors.New("Refresh token family not found")
+	ErrRefreshTokenRevoked   = errors.New("Refresh token revoked")
+	// ErrRefreshTokenReused means a refresh token was presented after it
+	// had been rotated out, so it has probably been stolen.
+	ErrRefreshTokenReused = errors.New("Refresh token reused")
+)
+
+// RefreshFamily is the chain of refresh tokens descending from one login,
+// which makes it the user's session on one device. Each refresh replaces
+// TokenId, and only the current token can be refreshed. Presenting an
+// older one revokes the whole family.
+type RefreshFamily struct {
+	Id        string    `json:"id"`
+	UserId    int       `json:"user_id"`
+	TokenId   string    `json:"token_id"`
+	UserAgent string    `json:"user_agent"`
+	Ip        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	// RotatedAt is when the session was last refreshed.
+	RotatedAt time.Time `json:"rotated_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// newTokenId returns a random ID for a refresh family or token.
+func newTokenId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sortRefreshFamilies orders families oldest first.
+func sortRefreshFamilies(families []RefreshFamily) {
+	slices.SortFunc(families, func(a, b RefreshFamily) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+}
+
+// newRefreshFamily returns a new family for userId with its first token.
+func newRefreshFamily(userId int, userAgent string, ip string) (RefreshFamily, error) {
+	id, err := newTokenId()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	tokenId, err := newTokenId()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	now := time.Now().UTC()
+	return RefreshFamily{
+		Id:        id,
+		UserId:    userId,
+		TokenId:   tokenId,
+		UserAgent: userAgent,
+		Ip:        ip,
+		CreatedAt: now,
+		RotatedAt: now,
+	}, nil
+}
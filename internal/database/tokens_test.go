@@ -0,0 +1,199 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func testRefreshFamilies(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, err := db.CreateRefreshFamily(user.Id, "curl", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if family.UserId != user.Id || family.Id == "" || family.TokenId == "" {
+		t.Fatalf("Unexpected family: %+v", family)
+	}
+
+	rotated, err := db.RotateRefreshToken(family.Id, family.TokenId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Id != family.Id || rotated.TokenId == family.TokenId {
+		t.Fatalf("Token not rotated: %+v", rotated)
+	}
+
+	// Presenting the old token again revokes the family, including the
+	// token that replaced it.
+	if _, err := db.RotateRefreshToken(family.Id, family.TokenId); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenReused", err)
+	}
+	if _, err := db.RotateRefreshToken(family.Id, rotated.TokenId); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+
+	other, err := db.CreateRefreshFamily(user.Id, "curl", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeRefreshFamily(other.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeRefreshFamily(other.Id); err != nil {
+		t.Fatalf("Revoking twice: %v", err)
+	}
+	if _, err := db.RotateRefreshToken(other.Id, other.TokenId); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+
+	if _, err := db.RotateRefreshToken("missing", "token"); !errors.Is(err, ErrRefreshFamilyNotFound) {
+		t.Fatalf("Got %v, expected ErrRefreshFamilyNotFound", err)
+	}
+	if err := db.RevokeRefreshFamily("missing"); !errors.Is(err, ErrRefreshFamilyNotFound) {
+		t.Fatalf("Got %v, expected ErrRefreshFamilyNotFound", err)
+	}
+}
+
+func testSessions(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := db.CreateRefreshFamily(user.Id, "phone", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := db.CreateRefreshFamily(user.Id, "laptop", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetRefreshFamily(phone.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserAgent != "phone" || got.Ip != "10.0.0.1" {
+		t.Fatalf("Unexpected family: %+v", got)
+	}
+	if _, err := db.GetRefreshFamily("missing"); !errors.Is(err, ErrRefreshFamilyNotFound) {
+		t.Fatalf("Got %v, expected ErrRefreshFamilyNotFound", err)
+	}
+
+	families, err := db.GetActiveRefreshFamilies(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 2 || families[0].Id != phone.Id || families[1].Id != laptop.Id {
+		t.Fatalf("Unexpected families: %+v", families)
+	}
+
+	if err := db.RevokeRefreshFamily(phone.Id); err != nil {
+		t.Fatal(err)
+	}
+	families, err = db.GetActiveRefreshFamilies(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].Id != laptop.Id {
+		t.Fatalf("Unexpected families after revoking: %+v", families)
+	}
+
+	if err := db.RevokeUserTokens(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	families, err = db.GetActiveRefreshFamilies(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 0 {
+		t.Fatalf("Unexpected families after revoking all: %+v", families)
+	}
+	if _, err := db.RotateRefreshToken(laptop.Id, laptop.TokenId); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+	user, err = db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TokenGeneration != 1 {
+		t.Fatalf("Token generation is %d, expected 1", user.TokenGeneration)
+	}
+	if err := db.RevokeUserTokens(100); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db, _ := newTestDB(t)
+	testSessions(t, db)
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	testSessions(t, newTestSQLiteDB(t))
+}
+
+func TestRefreshFamilies(t *testing.T) {
+	db, _ := newTestDB(t)
+	testRefreshFamilies(t, db)
+}
+
+func TestSQLiteRefreshFamilies(t *testing.T) {
+	testRefreshFamilies(t, newTestSQLiteDB(t))
+}
+
+func testLegacyRefreshTokens(t *testing.T, db Store) {
+	t.Helper()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, err := db.AdoptLegacyRefreshToken("legacy", user.Id, "curl", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if family.UserId != user.Id || family.UserAgent != "curl" {
+		t.Fatalf("Unexpected family: %+v", family)
+	}
+	if _, err := db.RotateRefreshToken(family.Id, family.TokenId); err != nil {
+		t.Fatal(err)
+	}
+	// A token can only be adopted once.
+	if _, err := db.AdoptLegacyRefreshToken("legacy", user.Id, "curl", "127.0.0.1"); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+
+	if err := db.RevokeLegacyRefreshToken("revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeLegacyRefreshToken("revoked"); err != nil {
+		t.Fatalf("Revoking twice: %v", err)
+	}
+	if _, err := db.AdoptLegacyRefreshToken("revoked", user.Id, "curl", "127.0.0.1"); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+
+	// Revoking all of a user's tokens covers the ones from before families.
+	if err := db.RevokeUserTokens(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AdoptLegacyRefreshToken("other", user.Id, "curl", "127.0.0.1"); !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Fatalf("Got %v, expected ErrRefreshTokenRevoked", err)
+	}
+	if _, err := db.AdoptLegacyRefreshToken("other", 100, "curl", "127.0.0.1"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Got %v, expected ErrUserNotFound", err)
+	}
+}
+
+func TestLegacyRefreshTokens(t *testing.T) {
+	db, _ := newTestDB(t)
+	testLegacyRefreshTokens(t, db)
+}
+
+func TestSQLiteLegacyRefreshTokens(t *testing.T) {
+	testLegacyRefreshTokens(t, newTestSQLiteDB(t))
+}
@@ -0,0 +1,821 @@
+package database
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"time"
+)
+
+var (
+	ErrTxReadOnly = errors.New("transaction is read-only")
+	ErrClosed     = errors.New("database is closed")
+)
+
+// Tx is a transaction on a DB, handed to the callbacks of Update and View.
+// Changes are visible to later reads in the same transaction, and are
+// discarded if the callback returns an error. A Tx must not be used after
+// its callback returns.
+type Tx struct {
+	db       *DB
+	writable bool
+	ops      []mutation
+	undo     []mutation
+	// sequences is a copy of the sequences taken when the transaction
+	// started, restored on rollback.
+	sequences map[string]int
+}
+
+// Update runs fn in a read-write transaction. If fn returns nil the
+// changes are written to the journal as one entry; otherwise, or if that
+// write fails, they are rolled back and the error is returned.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.journal == nil {
+		return ErrClosed
+	}
+
+	tx := &Tx{
+		db:        db,
+		writable:  true,
+		sequences: maps.Clone(db.data.Sequences),
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	if err := db.appendJournal(tx.ops); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// View runs fn in a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return fn(&Tx{db: db})
+}
+
+// write applies m to the in-memory state and remembers how to undo it.
+func (tx *Tx) write(m mutation) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	undo := m.inverse(&tx.db.data)
+	if err := m.apply(&tx.db.data); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, m)
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i].apply(&tx.db.data)
+	}
+	tx.db.data.Sequences = tx.sequences
+	tx.ops = nil
+	tx.undo = nil
+}
+
+func (tx *Tx) Chirp(id int) (Chirp, bool) {
+	return tx.db.data.chirp(id)
+}
+
+func (tx *Tx) Chirps() []Chirp {
+	chirps := make([]Chirp, 0, len(tx.db.data.Chirps))
+	for id := range tx.db.data.Chirps {
+		chirp, _ := tx.db.data.chirp(id)
+		chirps = append(chirps, chirp)
+	}
+	return chirps
+}
+
+// ChirpsByAuthor returns the author's chirps ordered by ID.
+func (tx *Tx) ChirpsByAuthor(authorId int) []Chirp {
+	return tx.db.data.chirpsByAuthor(authorId)
+}
+
+func (tx *Tx) ChirpsPage(q ChirpQuery) []Chirp {
+	return tx.db.data.chirpPage(q)
+}
+
+func (tx *Tx) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	return tx.db.data.search(q)
+}
+
+func (tx *Tx) CreateChirp(body string, authorId int) (Chirp, error) {
+	return tx.CreateReply(body, authorId, 0, nil)
+}
+
+// CreateReply creates a chirp in reply to chirp inReplyTo, or a top-level
+// chirp if inReplyTo is 0, flagged for the given moderation patterns.
+func (tx *Tx) CreateReply(body string, authorId int, inReplyTo int, flags []string) (Chirp, error) {
+	if inReplyTo != 0 {
+		if _, found := tx.db.data.Chirps[inReplyTo]; !found {
+			return Chirp{}, ErrChirpNotFound
+		}
+	}
+	now := time.Now().UTC()
+	chirp := Chirp{
+		Id:        tx.db.data.nextId(seqChirps),
+		AuthorId:  authorId,
+		Body:      body,
+		InReplyTo: inReplyTo,
+		Flags:     chirpFlags(flags),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	chirp.parseBody(tx.db.data.userExists)
+	return chirp, tx.write(mutation{Op: opPutChirp, Chirp: &chirp})
+}
+
+// EditChirp replaces the body of a chirp and its moderation flags, and
+// records the old body in its history.
+func (tx *Tx) EditChirp(id int, body string, flags []string) (Chirp, error) {
+	chirp, found := tx.Chirp(id)
+	if !found {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, ErrRechirpEdit
+	}
+	history := tx.ChirpHistory(id)
+	history = append(history, ChirpRevision{
+		Revision:  len(history) + 1,
+		Body:      chirp.Body,
+		CreatedAt: chirp.UpdatedAt,
+	})
+	if err := tx.write(mutation{Op: opPutRevisions, Id: id, Revisions: history}); err != nil {
+		return Chirp{}, err
+	}
+
+	chirp.Body = body
+	chirp.Flags = chirpFlags(flags)
+	chirp.parseBody(tx.db.data.userExists)
+	chirp.UpdatedAt = time.Now().UTC()
+	return chirp, tx.write(mutation{Op: opPutChirp, Chirp: &chirp})
+}
+
+// ChirpHistory returns the previous revisions of a chirp, oldest first.
+func (tx *Tx) ChirpHistory(id int) []ChirpRevision {
+	revisions := tx.db.data.ChirpRevisions[id]
+	return append([]ChirpRevision{}, revisions...)
+}
+
+// DeleteChirp deletes a chirp along with its history, likes and rechirps.
+func (tx *Tx) DeleteChirp(id int) error {
+	if _, found := tx.db.data.Chirps[id]; !found {
+		return nil
+	}
+	if _, found := tx.db.data.ChirpRevisions[id]; found {
+		if err := tx.write(mutation{Op: opPutRevisions, Id: id}); err != nil {
+			return err
+		}
+	}
+	if _, found := tx.db.data.Likes[id]; found {
+		if err := tx.write(mutation{Op: opPutLikes, Id: id}); err != nil {
+			return err
+		}
+	}
+	rechirpIds := slices.Clone(tx.db.data.idx.rechirpsByOriginal[id])
+	for _, rechirpId := range rechirpIds {
+		if err := tx.DeleteChirp(rechirpId); err != nil {
+			return err
+		}
+	}
+	return tx.write(mutation{Op: opDeleteChirp, Id: id})
+}
+
+// LikeChirp records that userId likes chirp id. Liking twice is not an
+// error.
+func (tx *Tx) LikeChirp(id int, userId int) error {
+	if _, found := tx.db.data.Chirps[id]; !found {
+		return ErrChirpNotFound
+	}
+	if tx.db.data.likes(id, userId) {
+		return nil
+	}
+	return tx.write(mutation{Op: opLike, Id: id, UserId: userId})
+}
+
+func (tx *Tx) UnlikeChirp(id int, userId int) error {
+	if _, found := tx.db.data.Chirps[id]; !found {
+		return ErrChirpNotFound
+	}
+	if !tx.db.data.likes(id, userId) {
+		return nil
+	}
+	return tx.write(mutation{Op: opUnlike, Id: id, UserId: userId})
+}
+
+// Likers returns at most limit users who liked chirp id, ordered by ID and
+// starting after afterId.
+func (tx *Tx) Likers(id int, afterId int, limit int) []User {
+	return tx.db.data.usersAfter(tx.db.data.Likes[id], afterId, limit)
+}
+
+// Rechirp shares chirp id on behalf of userId, returning the new rechirp
+// or the one userId made before. Rechirping a rechirp shares its original.
+func (tx *Tx) Rechirp(id int, userId int) (Chirp, error) {
+	original, found := tx.Chirp(id)
+	if !found {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if original.RechirpOf != 0 {
+		id = original.RechirpOf
+	}
+	if rechirp, found := tx.db.data.rechirpBy(id, userId); found {
+		return rechirp, nil
+	}
+	now := time.Now().UTC()
+	rechirp := Chirp{
+		Id:        tx.db.data.nextId(seqChirps),
+		AuthorId:  userId,
+		RechirpOf: id,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return rechirp, tx.write(mutation{Op: opPutChirp, Chirp: &rechirp})
+}
+
+// Unrechirp deletes userId's rechirp of chirp id, if there is one.
+func (tx *Tx) Unrechirp(id int, userId int) error {
+	original, found := tx.db.data.Chirps[id]
+	if !found {
+		return ErrChirpNotFound
+	}
+	if original.RechirpOf != 0 {
+		id = original.RechirpOf
+	}
+	rechirp, found := tx.db.data.rechirpBy(id, userId)
+	if !found {
+		return nil
+	}
+	return tx.DeleteChirp(rechirp.Id)
+}
+
+// chirpFlags returns flags, or nil if there are none so that unflagged
+// chirps compare equal.
+func chirpFlags(flags []string) []string {
+	if len(flags) == 0 {
+		return nil
+	}
+	return flags
+}
+
+// ModerationWords returns the moderation word list ordered by ID.
+func (tx *Tx) ModerationWords() []ModerationWord {
+	words := make([]ModerationWord, 0, len(tx.db.data.ModerationWords))
+	for _, word := range tx.db.data.ModerationWords {
+		words = append(words, word)
+	}
+	slices.SortFunc(words, func(a, b ModerationWord) int { return a.Id - b.Id })
+	return words
+}
+
+// PutModerationWord validates and stores word, creating it if its ID is 0.
+func (tx *Tx) PutModerationWord(word ModerationWord) (ModerationWord, error) {
+	pattern, err := normalizeModerationWord(word.Pattern, word.Mode)
+	if err != nil {
+		return ModerationWord{}, err
+	}
+	word.Pattern = pattern
+	for _, other := range tx.db.data.ModerationWords {
+		if other.Pattern == pattern && other.Id != word.Id {
+			return ModerationWord{}, ErrModerationWordExists
+		}
+	}
+	if word.Id == 0 {
+		word.Id = tx.db.data.nextId(seqModerationWords)
+		word.CreatedAt = time.Now().UTC()
+	} else {
+		word.CreatedAt = tx.db.data.ModerationWords[word.Id].CreatedAt
+	}
+	return word, tx.write(mutation{Op: opPutModWord, ModerationWord: &word})
+}
+
+func (tx *Tx) DeleteModerationWord(id int) error {
+	if _, found := tx.db.data.ModerationWords[id]; !found {
+		return ErrModerationWordNotFound
+	}
+	return tx.write(mutation{Op: opDeleteModWord, Id: id})
+}
+
+// CreateReport files a report by reporterId against chirp chirpId.
+func (tx *Tx) CreateReport(chirpId int, reporterId int, reason string) (Report, error) {
+	if _, found := tx.db.data.Chirps[chirpId]; !found {
+		return Report{}, ErrChirpNotFound
+	}
+	for _, id := range tx.db.data.idx.openReports[chirpId] {
+		if tx.db.data.Reports[id].ReporterId == reporterId {
+			return Report{}, ErrAlreadyReported
+		}
+	}
+	report := Report{
+		Id:         tx.db.data.nextId(seqReports),
+		ChirpId:    chirpId,
+		ReporterId: reporterId,
+		Reason:     reason,
+		CreatedAt:  time.Now().UTC(),
+	}
+	return report, tx.write(mutation{Op: opPutReport, Report: &report})
+}
+
+// ReportQueue returns at most limit chirps with open reports, ordered by
+// chirp ID and starting after afterChirpId.
+func (tx *Tx) ReportQueue(afterChirpId int, limit int) []ReportedChirp {
+	chirpIds := []int{}
+	for chirpId := range tx.db.data.idx.openReports {
+		if chirpId > afterChirpId {
+			chirpIds = append(chirpIds, chirpId)
+		}
+	}
+	slices.Sort(chirpIds)
+
+	queue := make([]ReportedChirp, 0, min(limit, len(chirpIds)))
+	for _, chirpId := range chirpIds[:min(limit, len(chirpIds))] {
+		entry := ReportedChirp{ChirpId: chirpId}
+		if chirp, found := tx.Chirp(chirpId); found {
+			entry.Chirp = &chirp
+		}
+		for _, id := range tx.db.data.idx.openReports[chirpId] {
+			entry.Reports = append(entry.Reports, tx.db.data.Reports[id])
+		}
+		queue = append(queue, entry)
+	}
+	return queue
+}
+
+// ModerateChirp carries out action on chirp chirpId for moderatorId and
+// records it. Every open report on the chirp is closed by the action. A
+// chirp deleted by its author can only have its reports dismissed.
+func (tx *Tx) ModerateChirp(chirpId int, moderatorId int, action string) (ModerationAction, error) {
+	if !validModerationAction(action) {
+		return ModerationAction{}, ErrInvalidModerationAction
+	}
+	chirp, found := tx.db.data.Chirps[chirpId]
+	if !found && (action != ActionDismiss || len(tx.db.data.idx.openReports[chirpId]) == 0) {
+		return ModerationAction{}, ErrChirpNotFound
+	}
+
+	record := ModerationAction{
+		Id:          tx.db.data.nextId(seqModActions),
+		ChirpId:     chirpId,
+		AuthorId:    chirp.AuthorId,
+		ChirpBody:   chirp.Body,
+		ModeratorId: moderatorId,
+		Action:      action,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := tx.write(mutation{Op: opPutModAction, ModerationAction: &record}); err != nil {
+		return ModerationAction{}, err
+	}
+	reportIds := slices.Clone(tx.db.data.idx.openReports[chirpId])
+	for _, id := range reportIds {
+		report := tx.db.data.Reports[id]
+		report.ActionId = record.Id
+		if err := tx.write(mutation{Op: opPutReport, Report: &report}); err != nil {
+			return ModerationAction{}, err
+		}
+	}
+	if !found {
+		return record, nil
+	}
+
+	switch action {
+	case ActionDelete:
+		return record, tx.DeleteChirp(chirpId)
+	case ActionSuspend:
+		author, found := tx.User(chirp.AuthorId)
+		if !found {
+			return ModerationAction{}, ErrUserNotFound
+		}
+		author.Suspended = true
+		author.UpdatedAt = record.CreatedAt
+		if err := tx.write(mutation{Op: opPutUser, User: &author}); err != nil {
+			return ModerationAction{}, err
+		}
+	case ActionHide:
+		chirp.Hidden = true
+	}
+	// The chirp has been reviewed, so it leaves the flagged list too.
+	chirp.Flags = nil
+	return record, tx.write(mutation{Op: opPutChirp, Chirp: &chirp})
+}
+
+// ModerationActions returns at most limit recorded actions ordered by ID,
+// starting after afterId.
+func (tx *Tx) ModerationActions(afterId int, limit int) []ModerationAction {
+	actions := []ModerationAction{}
+	for id, action := range tx.db.data.ModerationActions {
+		if id > afterId {
+			actions = append(actions, action)
+		}
+	}
+	slices.SortFunc(actions, func(a, b ModerationAction) int { return a.Id - b.Id })
+	return actions[:min(limit, len(actions))]
+}
+
+func (tx *Tx) User(id int) (User, bool) {
+	user, found := tx.db.data.Users[id]
+	return user, found
+}
+
+// UserByEmail looks up a user by email, ignoring case.
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+	return tx.db.data.userByEmail(email)
+}
+
+func (tx *Tx) CreateUser(email string, password string) (User, error) {
+	if _, found := tx.UserByEmail(email); found {
+		return User{}, ErrUserExists
+	}
+	now := time.Now().UTC()
+	user := User{
+		Id:        tx.db.data.nextId(seqUsers),
+		Email:     email,
+		Password:  password,
+		Role:      RoleUser,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return user, tx.write(mutation{Op: opPutUser, User: &user})
+}
+
+// PutUser replaces the stored user with the same ID.
+func (tx *Tx) PutUser(user User) error {
+	if _, found := tx.db.data.Users[user.Id]; !found {
+		return ErrUserNotFound
+	}
+	if other, found := tx.UserByEmail(user.Email); found && other.Id != user.Id {
+		return ErrUserExists
+	}
+	return tx.write(mutation{Op: opPutUser, User: &user})
+}
+
+// Follow makes follower follow followee, failing with ErrUserNotFound if
+// either doesn't exist.
+func (tx *Tx) Follow(followerId int, followeeId int) error {
+	if followerId == followeeId {
+		return ErrSelfFollow
+	}
+	if _, found := tx.User(followerId); !found {
+		return ErrUserNotFound
+	}
+	if _, found := tx.User(followeeId); !found {
+		return ErrUserNotFound
+	}
+	if tx.db.data.follows(followerId, followeeId) {
+		return nil
+	}
+	return tx.write(mutation{Op: opFollow, Id: followerId, Followee: followeeId})
+}
+
+func (tx *Tx) Unfollow(followerId int, followeeId int) error {
+	if !tx.db.data.follows(followerId, followeeId) {
+		return nil
+	}
+	return tx.write(mutation{Op: opUnfollow, Id: followerId, Followee: followeeId})
+}
+
+func (tx *Tx) Followers(userId int, afterId int, limit int) []User {
+	return tx.db.data.usersAfter(tx.db.data.idx.followers[userId], afterId, limit)
+}
+
+func (tx *Tx) Following(userId int, afterId int, limit int) []User {
+	return tx.db.data.usersAfter(tx.db.data.Follows[userId], afterId, limit)
+}
+
+func (tx *Tx) FollowCounts(userId int) (followers int, following int) {
+	return len(tx.db.data.idx.followers[userId]), len(tx.db.data.Follows[userId])
+}
+
+func (tx *Tx) RefreshFamily(id string) (RefreshFamily, bool) {
+	family, ok := tx.db.data.RefreshFamilies[id]
+	return family, ok
+}
+
+// ActiveRefreshFamilies returns the user's unrevoked families, oldest
+// first.
+func (tx *Tx) ActiveRefreshFamilies(userId int) []RefreshFamily {
+	families := make([]RefreshFamily, 0, len(tx.db.data.idx.activeFamilies[userId]))
+	for id := range tx.db.data.idx.activeFamilies[userId] {
+		families = append(families, tx.db.data.RefreshFamilies[id])
+	}
+	sortRefreshFamilies(families)
+	return families
+}
+
+// CreateRefreshFamily starts a new refresh token family for a login.
+func (tx *Tx) CreateRefreshFamily(userId int, userAgent string, ip string) (RefreshFamily, error) {
+	family, err := newRefreshFamily(userId, userAgent, ip)
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	if err := tx.write(mutation{Op: opPutRefreshFamily, RefreshFamily: &family}); err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+// RotateRefreshToken replaces the current token of a family. If tokenId
+// has already been rotated out the family is revoked and
+// ErrRefreshTokenReused is returned; the revocation still has to be
+// committed.
+func (tx *Tx) RotateRefreshToken(familyId string, tokenId string) (RefreshFamily, error) {
+	family, found := tx.RefreshFamily(familyId)
+	if !found {
+		return RefreshFamily{}, ErrRefreshFamilyNotFound
+	}
+	if family.Revoked {
+		return RefreshFamily{}, ErrRefreshTokenRevoked
+	}
+	if family.TokenId != tokenId {
+		family.Revoked = true
+		if err := tx.write(mutation{Op: opPutRefreshFamily, RefreshFamily: &family}); err != nil {
+			return RefreshFamily{}, err
+		}
+		return RefreshFamily{}, ErrRefreshTokenReused
+	}
+
+	next, err := newTokenId()
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	family.TokenId = next
+	family.RotatedAt = time.Now().UTC()
+	if err := tx.write(mutation{Op: opPutRefreshFamily, RefreshFamily: &family}); err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, nil
+}
+
+// RevokeRefreshFamily revokes every token of a family. Revoking it twice
+// is not an error.
+func (tx *Tx) RevokeRefreshFamily(familyId string) error {
+	family, found := tx.RefreshFamily(familyId)
+	if !found {
+		return ErrRefreshFamilyNotFound
+	}
+	if family.Revoked {
+		return nil
+	}
+	family.Revoked = true
+	return tx.write(mutation{Op: opPutRefreshFamily, RefreshFamily: &family})
+}
+
+// RevokeUserTokens revokes every refresh token family of a user and bumps
+// their token generation, which invalidates their access tokens.
+func (tx *Tx) RevokeUserTokens(userId int) error {
+	user, found := tx.User(userId)
+	if !found {
+		return ErrUserNotFound
+	}
+	for _, family := range tx.ActiveRefreshFamilies(userId) {
+		family.Revoked = true
+		if err := tx.write(mutation{Op: opPutRefreshFamily, RefreshFamily: &family}); err != nil {
+			return err
+		}
+	}
+	user.TokenGeneration++
+	return tx.PutUser(user)
+}
+
+// AdoptLegacyRefreshToken starts a family for a refresh token from before
+// families and revokes the token, so it can only be adopted once. Tokens
+// that were revoked, or whose user has since revoked all their tokens,
+// fail with ErrRefreshTokenRevoked.
+func (tx *Tx) AdoptLegacyRefreshToken(token string, userId int, userAgent string, ip string) (RefreshFamily, error) {
+	user, found := tx.User(userId)
+	if !found {
+		return RefreshFamily{}, ErrUserNotFound
+	}
+	if _, revoked := tx.db.data.Revocations[token]; revoked || user.TokenGeneration != 0 {
+		return RefreshFamily{}, ErrRefreshTokenRevoked
+	}
+	if err := tx.RevokeLegacyRefreshToken(token); err != nil {
+		return RefreshFamily{}, err
+	}
+	return tx.CreateRefreshFamily(userId, userAgent, ip)
+}
+
+// RevokeLegacyRefreshToken revokes a refresh token from before families.
+func (tx *Tx) RevokeLegacyRefreshToken(token string) error {
+	if _, revoked := tx.db.data.Revocations[token]; revoked {
+		return nil
+	}
+	now := time.Now().UTC()
+	return tx.write(mutation{Op: opRevokeToken, Token: token, RevokedAt: &now})
+}
+
+// CreateApiKey stores a new API key for userId.
+func (tx *Tx) CreateApiKey(userId int, name string, prefix string, hash string, scope string,
+	expiresAt time.Time) (ApiKey, error) {
+	key := ApiKey{
+		Id:        tx.db.data.nextId(seqApiKeys),
+		UserId:    userId,
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scope:     scope,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	return key, tx.write(mutation{Op: opPutApiKey, ApiKey: &key})
+}
+
+// ApiKeys returns the user's API keys ordered by ID.
+func (tx *Tx) ApiKeys(userId int) []ApiKey {
+	keys := make([]ApiKey, 0, len(tx.db.data.idx.apiKeysByUser[userId]))
+	for _, id := range tx.db.data.idx.apiKeysByUser[userId] {
+		keys = append(keys, tx.db.data.ApiKeys[id])
+	}
+	return keys
+}
+
+func (tx *Tx) ApiKeyByHash(hash string) (ApiKey, bool) {
+	id, found := tx.db.data.idx.apiKeysByHash[hash]
+	if !found {
+		return ApiKey{}, false
+	}
+	return tx.db.data.ApiKeys[id], true
+}
+
+// TouchApiKey records that an API key was used at usedAt.
+func (tx *Tx) TouchApiKey(id int, usedAt time.Time) error {
+	key, found := tx.db.data.ApiKeys[id]
+	if !found {
+		return ErrApiKeyNotFound
+	}
+	key.LastUsedAt = usedAt
+	return tx.write(mutation{Op: opPutApiKey, ApiKey: &key})
+}
+
+// DeleteApiKey revokes one of userId's API keys.
+func (tx *Tx) DeleteApiKey(id int, userId int) error {
+	if key, found := tx.db.data.ApiKeys[id]; !found || key.UserId != userId {
+		return ErrApiKeyNotFound
+	}
+	return tx.write(mutation{Op: opDeleteApiKey, Id: id})
+}
+
+// CreatePasswordReset stores a password reset for userId, replacing any
+// earlier one.
+func (tx *Tx) CreatePasswordReset(userId int, hash string, expiresAt time.Time) (PasswordReset, error) {
+	if _, found := tx.User(userId); !found {
+		return PasswordReset{}, ErrUserNotFound
+	}
+	reset := PasswordReset{
+		UserId:    userId,
+		Hash:      hash,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	return reset, tx.write(mutation{Op: opPutPassReset, PasswordReset: &reset})
+}
+
+// PasswordResetByHash looks up an outstanding password reset, expired or
+// not.
+func (tx *Tx) PasswordResetByHash(hash string) (PasswordReset, bool) {
+	userId, found := tx.db.data.idx.passwordResetsByHash[hash]
+	if !found {
+		return PasswordReset{}, false
+	}
+	return tx.db.data.PasswordResets[userId], true
+}
+
+// ResetPassword consumes the password reset with the hash, sets the
+// user's password, revokes their tokens and deletes their API keys.
+func (tx *Tx) ResetPassword(hash string, password string) (User, error) {
+	reset, found := tx.PasswordResetByHash(hash)
+	if !found || !time.Now().Before(reset.ExpiresAt) {
+		return User{}, ErrPasswordResetNotFound
+	}
+	if err := tx.write(mutation{Op: opDeletePassReset, Id: reset.UserId}); err != nil {
+		return User{}, err
+	}
+	user, found := tx.User(reset.UserId)
+	if !found {
+		return User{}, ErrUserNotFound
+	}
+	user.Password = password
+	user.UpdatedAt = time.Now().UTC()
+	if err := tx.PutUser(user); err != nil {
+		return User{}, err
+	}
+	if err := tx.RevokeUserTokens(user.Id); err != nil {
+		return User{}, err
+	}
+	for _, key := range tx.ApiKeys(user.Id) {
+		if err := tx.write(mutation{Op: opDeleteApiKey, Id: key.Id}); err != nil {
+			return User{}, err
+		}
+	}
+	user, _ = tx.User(user.Id)
+	return user, nil
+}
+
+// CreateEmailVerification stores a verification of email for userId,
+// replacing any earlier one. An address other than the user's current one
+// becomes their pending email.
+func (tx *Tx) CreateEmailVerification(userId int, email string, hash string,
+	expiresAt time.Time) (EmailVerification, error) {
+	user, found := tx.User(userId)
+	if !found {
+		return EmailVerification{}, ErrUserNotFound
+	}
+	pending := ""
+	if emailKey(email) != emailKey(user.Email) {
+		if _, taken := tx.UserByEmail(email); taken {
+			return EmailVerification{}, ErrUserExists
+		}
+		pending = email
+	}
+	if user.PendingEmail != pending {
+		user.PendingEmail = pending
+		if err := tx.PutUser(user); err != nil {
+			return EmailVerification{}, err
+		}
+	}
+
+	verification := EmailVerification{
+		UserId:    userId,
+		Email:     email,
+		Hash:      hash,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	return verification, tx.write(mutation{Op: opPutEmailVerif, EmailVerification: &verification})
+}
+
+// EmailVerificationByHash looks up an outstanding email verification,
+// expired or not.
+func (tx *Tx) EmailVerificationByHash(hash string) (EmailVerification, bool) {
+	userId, found := tx.db.data.idx.emailVerificationsByHash[hash]
+	if !found {
+		return EmailVerification{}, false
+	}
+	return tx.db.data.EmailVerifications[userId], true
+}
+
+// VerifyEmail consumes the email verification with the hash and marks its
+// address verified, switching the user over to it if it was pending.
+func (tx *Tx) VerifyEmail(hash string) (User, error) {
+	verification, found := tx.EmailVerificationByHash(hash)
+	if !found || !time.Now().Before(verification.ExpiresAt) {
+		return User{}, ErrEmailVerificationNotFound
+	}
+	user, found := tx.User(verification.UserId)
+	if !found {
+		return User{}, ErrUserNotFound
+	}
+	switch emailKey(verification.Email) {
+	case emailKey(user.Email):
+	case emailKey(user.PendingEmail):
+		user.Email = user.PendingEmail
+		user.PendingEmail = ""
+		user.UpdatedAt = time.Now().UTC()
+	default:
+		return User{}, ErrEmailVerificationNotFound
+	}
+	user.EmailVerified = true
+	if err := tx.write(mutation{Op: opDeleteEmailVerif, Id: user.Id}); err != nil {
+		return User{}, err
+	}
+	return user, tx.PutUser(user)
+}
+
+// CancelEmailChange drops the user's pending email along with the
+// verification sent to it.
+func (tx *Tx) CancelEmailChange(userId int) error {
+	user, found := tx.User(userId)
+	if !found {
+		return ErrUserNotFound
+	}
+	if user.PendingEmail == "" {
+		return nil
+	}
+	verification, found := tx.db.data.EmailVerifications[userId]
+	if found && emailKey(verification.Email) == emailKey(user.PendingEmail) {
+		if err := tx.write(mutation{Op: opDeleteEmailVerif, Id: userId}); err != nil {
+			return err
+		}
+	}
+	user.PendingEmail = ""
+	return tx.PutUser(user)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestUpdateRollback(t *testing.T) {
+	db, _ := newTestDB(t)
+	user, err := db.CreateUser("walt@breakingbad.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateChirp("Test", user.Id); err != nil {
+			return err
+		}
+		user.Email = "heisenberg@breakingbad.com"
+		if err := tx.PutUser(user); err != nil {
+			return err
+		}
+		if _, found := tx.UserByEmail("heisenberg@breakingbad.com"); !found {
+			t.Error("Transaction does not see its own writes")
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Got %v, expected the callback's error", err)
+	}
+
+	chirps, _ := db.GetChirps()
+	if len(chirps) != 0 {
+		t.Fatalf("Got %d chirps after rollback, expected 0", len(chirps))
+	}
+	if _, err := db.GetUserByEmail("walt@breakingbad.com"); err != nil {
+		t.Fatal("User change was not rolled back: ", err)
+	}
+	chirp, err := db.CreateChirp("Test", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 1 {
+		t.Fatalf("Got chirp id %d after rollback, expected 1", chirp.Id)
+	}
+}
+
+func TestUpdateWritesOneJournalEntry(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 3; i++ {
+			if _, err := tx.CreateChirp("Test", 1); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteChirp(2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat, err := os.ReadFile(db.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(dat, []byte("\n")); lines != 1 {
+		t.Fatalf("Journal has %d entries, expected 1", lines)
+	}
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.View(func(tx *Tx) error {
+		_, err := tx.CreateChirp("Test", 1)
+		return err
+	})
+	if !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("Got %v, expected ErrTxReadOnly", err)
+	}
+}
+
+func TestDeleteChirpByAuthor(t *testing.T) {
+	db, _ := newTestDB(t)
+	chirp, err := db.CreateChirp("Test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteChirpByAuthor(chirp.Id, 2); !errors.Is(err, ErrNotAuthor) {
+		t.Fatalf("Got %v, expected ErrNotAuthor", err)
+	}
+	if err := db.DeleteChirpByAuthor(chirp.Id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteChirpByAuthor(chirp.Id, 1); !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("Got %v, expected ErrChirpNotFound", err)
+	}
+}
@@ -0,0 +1,270 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFrom = "Chirpy <noreply@example.com>"
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	msg := Message{To: "a@example.com", Subject: "Hello", Body: "Line one\nLine two\n"}
+	dat, err := msg.format(testFrom, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: Chirpy <noreply@example.com>\r\n" +
+		"To: a@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"Date: Sun, 18 Oct 2026 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Line one\r\nLine two\r\n"
+	if string(dat) != want {
+		t.Fatalf("Got %q, expected %q", dat, want)
+	}
+
+	tests := []struct {
+		name string
+		from string
+		msg  Message
+	}{
+		{"to", testFrom, Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hello"}},
+		{"subject", testFrom, Message{To: "a@example.com", Subject: "Hello\nBcc: b@example.com"}},
+		{"subject with CR", testFrom, Message{To: "a@example.com", Subject: "Hello\rBcc: b@example.com"}},
+		{"from", testFrom + "\r\nBcc: b@example.com", Message{To: "a@example.com", Subject: "Hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.format(tt.from, date); err == nil {
+				t.Fatal("Line break in header accepted")
+			}
+		})
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := NewFileMailer(dir, testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Path() != dir {
+		t.Fatalf("Got %q, expected %q", m.Path(), dir)
+	}
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		if err := m.Send(Message{To: to, Subject: "Hello", Body: "Hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Send(Message{To: "a@example.com", Subject: "Hello\nBcc: c@example.com"}); err == nil {
+		t.Fatal("Line break in header accepted")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Got %d files, expected 2", len(files))
+	}
+	dat, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(dat, []byte("From: "+testFrom+"\r\n")) || !bytes.HasSuffix(dat, []byte("\r\n\r\nHi")) {
+		t.Fatalf("Unexpected email: %q", dat)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := &MemoryMailer{}
+	if len(m.Messages()) != 0 {
+		t.Fatal("Expected no messages")
+	}
+	first := Message{To: "a@example.com", Subject: "First"}
+	second := Message{To: "b@example.com", Subject: "Second"}
+	for _, msg := range []Message{first, second} {
+		if err := m.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := m.Messages()
+	if len(messages) != 2 || messages[0] != first || messages[1] != second {
+		t.Fatalf("Got %+v, expected [%+v %+v]", messages, first, second)
+	}
+	// The result is a copy.
+	messages[0].Subject = "Changed"
+	if m.Messages()[0] != first {
+		t.Fatal("Messages returned the mailer's own slice")
+	}
+}
+
+func TestNewSMTPMailer(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		from    string
+		wantErr bool
+	}{
+		{"valid", "smtp.example.com:587", testFrom, false},
+		{"bare from address", "smtp.example.com:587", "noreply@example.com", false},
+		{"invalid from", "smtp.example.com:587", "Chirpy", true},
+		{"no port", "smtp.example.com", testFrom, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSMTPMailer(tt.addr, tt.from, "", "")
+			if tt.wantErr && err == nil {
+				t.Fatal("Got no error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// smtpSession is what a client sent to the fake SMTP server.
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// fakeSMTPServer accepts one connection on a local port and plays the
+// server side of a plain SMTP session, offering PLAIN authentication. It
+// returns the address and a channel receiving the session once it ends.
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		text := textproto.NewConn(conn)
+		session := smtpSession{}
+		defer func() { sessions <- session }()
+
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			session.commands = append(session.commands, line)
+			switch verb, _, _ := strings.Cut(line, " "); strings.ToUpper(verb) {
+			case "EHLO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				text.PrintfLine("235 Authenticated")
+			case "DATA":
+				text.PrintfLine("354 Go ahead")
+				dat, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(dat)
+				text.PrintfLine("250 Queued")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func TestSMTPMailer(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		wantAuth string
+	}{
+		{"without auth", "", ""},
+		{"with auth", "chirpy", "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00chirpy\x00secret"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, sessions := fakeSMTPServer(t)
+			m, err := NewSMTPMailer(addr, testFrom, tt.username, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.Send(Message{To: "Ann <a@example.com>", Subject: "Hello", Body: "Hi\n"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := <-sessions
+
+			auth := ""
+			for _, command := range session.commands {
+				if strings.HasPrefix(command, "AUTH") {
+					auth = command
+				}
+			}
+			if auth != tt.wantAuth {
+				t.Fatalf("Got %q, expected %q", auth, tt.wantAuth)
+			}
+			for _, want := range []string{"MAIL FROM:<noreply@example.com>", "RCPT TO:<a@example.com>"} {
+				found := false
+				for _, command := range session.commands {
+					found = found || strings.HasPrefix(command, want)
+				}
+				if !found {
+					t.Fatalf("No %q in %q", want, session.commands)
+				}
+			}
+			if !strings.Contains(session.data, "To: Ann <a@example.com>\n") ||
+				!strings.Contains(session.data, "Subject: Hello\n") || !strings.HasSuffix(session.data, "\nHi\n") {
+				t.Fatalf("Unexpected email: %q", session.data)
+			}
+		})
+	}
+}
+
+func TestSMTPMailerRejects(t *testing.T) {
+	// Nothing listens here, so reaching the server would fail too; these
+	// must fail before connecting.
+	m, err := NewSMTPMailer("127.0.0.1:1", testFrom, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"invalid recipient", Message{To: "not an address", Subject: "Hello"}},
+		{"line break in header", Message{To: "a@example.com", Subject: "Hello\r\nBcc: b@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.Send(tt.msg)
+			if err == nil {
+				t.Fatal("Got no error")
+			}
+			if strings.Contains(err.Error(), "connection refused") {
+				t.Fatalf("Got %v, expected to fail before connecting", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Joad/chirpy/internal/auth"
+)
+
+// jwks publishes the public keys tokens are verified with, so that other
+// services can verify them without the signing keys.
+func (cfg *apiConfig) jwks(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+	// Verifiers may cache the keys for a while; new keys are published
+	// before they start signing.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, response{Keys: cfg.jwtKeys.JWKS()})
+}
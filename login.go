@@ -2,24 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
 )
 
+// refreshTokenTTL is how long a refresh token stays valid. Every refresh
+// hands out a new one, so a session lasts as long as it keeps being used.
+const refreshTokenTTL = 60 * 24 * time.Hour
+
 func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		// Scope optionally limits the tokens to some scopes, space
+		// separated, for handing them to a third party.
+		Scope string `json:"scope"`
 	}
 	type response struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		Id            int       `json:"id"`
+		Email         string    `json:"email"`
+		IsChirpyRed   bool      `json:"is_chirpy_red"`
+		EmailVerified bool      `json:"email_verified"`
+		Role          string    `json:"role"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+		Token         string    `json:"token"`
+		RefreshToken  string    `json:"refresh_token"`
+		Scope         string    `json:"scope"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -29,8 +45,18 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode params")
 		return
 	}
+	requested := strings.Fields(params.Scope)
+	if len(requested) == 0 {
+		requested = auth.AllScopes
+	}
+	for _, scope := range requested {
+		if !slices.Contains(auth.AllScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Invalid scope "+scope)
+			return
+		}
+	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	user, err := cfg.db.GetUserByEmail(lookupEmail(params.Email))
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Not allowed")
 		return
@@ -40,23 +66,39 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusUnauthorized, "Not allowed")
 		return
 	}
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Account suspended")
+		return
+	}
 
 	now := time.Now().UTC()
 	expiresIn := 1 * time.Hour
 	expiresAt := now.Add(expiresIn)
 
-	tokenString, err := auth.MakeJWT(user.Id, now, expiresAt,
-		auth.AccessType, cfg.jwtSecret)
+	// Scopes the user's role doesn't allow are left out rather than
+	// refused.
+	scope := grantScopes(requested, user.Role)
+	tokenString, err := auth.MakeJWT(user.Id, auth.Claims{
+		Scope:      scope,
+		Role:       user.Role,
+		Generation: user.TokenGeneration,
+	}, now, expiresAt, cfg.jwtKeys)
 	if err != nil {
 		log.Println("Error signing token, ", err)
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	expiresIn = 60 * 24 * time.Hour
-	expiresAt = now.Add(expiresIn)
-	refreshTokenString, err := auth.MakeJWT(user.Id, now, expiresAt,
-		auth.RefreshType, cfg.jwtSecret)
+	family, err := cfg.db.CreateRefreshFamily(user.Id, r.UserAgent(), clientIp(r))
+	if err != nil {
+		log.Println("Error creating refresh token family: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	// The refresh token carries the scopes requested rather than those
+	// granted, so a role change takes effect on the next refresh.
+	refreshTokenString, err := auth.MakeRefreshJWT(user.Id, family.Id, family.TokenId,
+		strings.Join(requested, " "), now, now.Add(refreshTokenTTL), cfg.jwtKeys)
 	if err != nil {
 		log.Println("Error signing token, ", err)
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
@@ -64,17 +106,28 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Id:           user.Id,
-		Email:        user.Email,
-		IsChirpyRed:  user.IsChirpyRed,
-		Token:        tokenString,
-		RefreshToken: refreshTokenString,
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Token:         tokenString,
+		RefreshToken:  refreshTokenString,
+		Scope:         scope,
 	})
 }
 
+// refresh trades a refresh token for a new access token and a new refresh
+// token, which replaces it. Presenting a refresh token that has already
+// been replaced revokes its whole family. A refresh token from before
+// families is adopted into a new one.
 func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
@@ -83,37 +136,104 @@ func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	revoked, err := cfg.db.IsTokenRevoked(token)
+	claims, err := auth.ValidateRefreshToken(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	id, err := claims.UserId()
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid id")
+		return
+	}
+	// The new token carries the user's current role, so role changes take
+	// effect on the next refresh.
+	user, err := cfg.db.GetUserById(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error with db")
+		log.Println("Error getting user: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Account suspended")
 		return
 	}
 
-	if revoked {
+	var family database.RefreshFamily
+	if claims.Legacy() {
+		family, err = cfg.db.AdoptLegacyRefreshToken(token, user.Id, r.UserAgent(), clientIp(r))
+	} else {
+		family, err = cfg.db.RotateRefreshToken(claims.Family, claims.ID)
+	}
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused, revoked token family %s of user %d", claims.Family, user.Id)
+		respondWithError(w, http.StatusUnauthorized, "Token revoked")
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenRevoked) || errors.Is(err, database.ErrRefreshFamilyNotFound) {
 		respondWithError(w, http.StatusUnauthorized, "Token revoked")
 		return
 	}
+	if err != nil {
+		log.Println("Error rotating refresh token: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
 
-	tokenString, err := auth.RefreshToken(token, cfg.jwtSecret)
+	now := time.Now().UTC()
+	scope := grantScopes(claims.Scopes(), user.Role)
+	tokenString, err := auth.MakeJWT(user.Id, auth.Claims{
+		Scope:      scope,
+		Role:       user.Role,
+		Generation: user.TokenGeneration,
+	}, now, now.Add(time.Hour), cfg.jwtKeys)
+	if err != nil {
+		log.Println("Error signing token, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	refreshTokenString, err := auth.MakeRefreshJWT(user.Id, family.Id, family.TokenId, claims.Scope,
+		now, now.Add(refreshTokenTTL), cfg.jwtKeys)
 	if err != nil {
-		log.Println("Error refreshing token, ", err)
+		log.Println("Error signing token, ", err)
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: tokenString,
+		Token:        tokenString,
+		RefreshToken: refreshTokenString,
+		Scope:        scope,
 	})
 }
 
+// revokeToken revokes the family of the refresh token, ending the session
+// it belongs to, or just the token if it is from before families.
 func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Bearer required")
 		return
 	}
+	claims, err := auth.ValidateRefreshToken(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
 
-	err = cfg.db.RevokeToken(token, time.Now().UTC())
+	if claims.Legacy() {
+		err = cfg.db.RevokeLegacyRefreshToken(token)
+	} else {
+		err = cfg.db.RevokeRefreshFamily(claims.Family)
+	}
+	if errors.Is(err, database.ErrRefreshFamilyNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error revoking token")
 		return
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+const defaultMailFrom = "Chirpy <noreply@localhost>"
+
+// newMailer sends email through the SMTP server at MAIL_SMTP_ADDR if set,
+// authenticating as MAIL_SMTP_USERNAME with MAIL_SMTP_PASSWORD. Otherwise
+// emails are written to files in MAIL_DIR, so that local development works
+// without a mail server. The files hold live reset and verification
+// links, so only debug mode falls back to ./mail when MAIL_DIR is unset.
+// MAIL_FROM is the sender.
+func newMailer(debug bool) (mail.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+	if addr := os.Getenv("MAIL_SMTP_ADDR"); addr != "" {
+		return mail.NewSMTPMailer(addr, from, os.Getenv("MAIL_SMTP_USERNAME"), os.Getenv("MAIL_SMTP_PASSWORD"))
+	}
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" && !debug {
+		return nil, errors.New("MAIL_SMTP_ADDR or MAIL_DIR must be set outside debug mode")
+	}
+	if dir == "" {
+		dir = "mail"
+	}
+	mailer, err := mail.NewFileMailer(dir, from)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Writing emails to %s\n", mailer.Path())
+	return mailer, nil
+}
+
+// sendMail sends msg in the background, so that responses neither wait
+// for the mail server nor take longer when an email is sent.
+func (cfg *apiConfig) sendMail(msg mail.Message) {
+	go func() {
+		if err := cfg.mailer.Send(msg); err != nil {
+			log.Println("Error sending email: ", err)
+		}
+	}()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+func TestNewMailer(t *testing.T) {
+	t.Setenv("MAIL_SMTP_ADDR", "")
+	t.Setenv("MAIL_DIR", "")
+	if _, err := newMailer(false); err == nil {
+		t.Fatal("Fell back to the file mailer outside debug mode")
+	}
+
+	dir := filepath.Join(t.TempDir(), "mail")
+	t.Setenv("MAIL_DIR", dir)
+	mailer, err := newMailer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileMailer, ok := mailer.(*mail.FileMailer); !ok || fileMailer.Path() != dir {
+		t.Fatalf("Got %#v, expected a file mailer writing to %s", mailer, dir)
+	}
+}
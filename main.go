@@ -6,39 +6,91 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/Joad/chirpy/internal/auth"
 	"github.com/Joad/chirpy/internal/database"
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	const root = "."
+	// root holds the files served under /app, and nothing else.
+	const root = "public"
 	const port = "8080"
-	const path = "database.json"
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	driver := flag.String("db", database.DriverJSON, "Database driver: json or sqlite")
 	flag.Parse()
+
+	path := "database.json"
+	if *driver == database.DriverSQLite {
+		path = "database.db"
+	}
+	if flag.Arg(0) == "migrate" {
+		err := runMigrate(*driver, path, flag.Args()[1:])
+		if err != nil {
+			log.Fatal("Error migrating database: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "role" {
+		err := runRole(*driver, path, flag.Args()[1:])
+		if err != nil {
+			log.Fatal("Error setting role: ", err)
+		}
+		return
+	}
 	if *dbg {
-		err := os.Remove(path)
-		if err != nil && !os.IsNotExist(err) {
+		err := database.Remove(*driver, path)
+		if err != nil {
 			log.Fatal("Error removing database", err)
 			return
 		}
 	}
-	db, err := database.NewDB(path)
+	db, err := database.Open(*driver, path)
 	if err != nil {
 		log.Fatal("Error creating database: ", err)
 		return
 	}
+	if jsonDB, ok := db.(*database.DB); ok && jsonDB.Recovery() != nil {
+		log.Printf("Recovered database: %s\n", jsonDB.Recovery())
+	}
+	jwtKeys, err := auth.LoadKeyring(os.Getenv("JWT_KEYS"), os.Getenv("JWT_SECRET"))
+	if err != nil {
+		log.Fatal("Error loading JWT keys: ", err)
+		return
+	}
+	mailer, err := newMailer(*dbg)
+	if err != nil {
+		log.Fatal("Error setting up mail: ", err)
+		return
+	}
+	publicUrl := os.Getenv("PUBLIC_URL")
+	if publicUrl == "" {
+		publicUrl = "http://localhost:" + port
+	}
+	requireVerifiedEmail := false
+	if policy := os.Getenv("REQUIRE_VERIFIED_EMAIL"); policy != "" {
+		requireVerifiedEmail, err = strconv.ParseBool(policy)
+		if err != nil {
+			log.Fatal("Invalid REQUIRE_VERIFIED_EMAIL: ", err)
+			return
+		}
+	}
 	apiCfg := &apiConfig{
 		db:        db,
-		jwtSecret: os.Getenv("JWT_SECRET"),
+		jwtKeys:   jwtKeys,
 		polkaKey:  os.Getenv("POLKA_KEY"),
+		mailer:    mailer,
+		publicUrl: strings.TrimSuffix(publicUrl, "/"),
+
+		requireVerifiedEmail: requireVerifiedEmail,
 	}
 
 	r := chi.NewRouter()
@@ -49,28 +101,86 @@ func main() {
 
 	rApi := chi.NewRouter()
 	rApi.Get("/metrics", apiCfg.writeMetrics())
-	rApi.Handle("/reset", apiCfg.reset())
 	rApi.Get("/healthz", healthz)
 
-	rApi.Post("/chirps", apiCfg.postChirp)
 	rApi.Get("/chirps", apiCfg.getChirps)
-	rApi.Get("/chirps/{chirpid}", apiCfg.getChirp)
-	rApi.Delete("/chirps/{chirpid}", apiCfg.deleteChirp)
+	rApi.With(apiCfg.middlewareOptionalAuth).Get("/chirps/{chirpid}", apiCfg.getChirp)
+	rApi.With(apiCfg.middlewareOptionalAuth).Get("/chirps/{chirpid}/history", apiCfg.getChirpHistory)
+	rApi.Get("/chirps/{chirpid}/thread", apiCfg.getChirpThread)
+	rApi.With(apiCfg.middlewareOptionalAuth).Get("/chirps/{chirpid}/likers", apiCfg.getLikers)
 
 	rApi.Post("/users", apiCfg.postUsers)
-	rApi.Put("/users", apiCfg.updateUser)
+	rApi.Post("/users/verify", apiCfg.verifyEmail)
+	rApi.Get("/users/{userid}/followers", apiCfg.getFollowers)
+	rApi.Get("/users/{userid}/following", apiCfg.getFollowing)
+	rApi.Get("/users/{userid}/mentions", apiCfg.getMentions)
+	rApi.Get("/hashtags/{tag}/chirps", apiCfg.getHashtagChirps)
+	rApi.Get("/search", apiCfg.searchChirps)
 
 	rApi.Post("/login", apiCfg.login)
 	rApi.Post("/refresh", apiCfg.refresh)
 	rApi.Post("/revoke", apiCfg.revokeToken)
+	rApi.Post("/password/forgot", apiCfg.forgotPassword)
+	rApi.Post("/password/reset", apiCfg.resetPassword)
 
 	rApi.Post("/polka/webhooks", apiCfg.polkaWebhook)
 
+	rApi.Group(func(r chi.Router) {
+		r.Use(apiCfg.middlewareRequireAuth)
+		r.Get("/timeline", apiCfg.getTimeline)
+		r.Get("/sessions", apiCfg.getSessions)
+		r.Get("/tokens", apiCfg.getApiKeys)
+
+		r.Group(func(r chi.Router) {
+			r.Use(apiCfg.middlewareRequireScope(auth.ScopeChirpsWrite))
+			r.Delete("/chirps/{chirpid}", apiCfg.deleteChirp)
+			r.Post("/chirps/{chirpid}/like", apiCfg.likeChirp)
+			r.Delete("/chirps/{chirpid}/like", apiCfg.unlikeChirp)
+			r.Delete("/chirps/{chirpid}/rechirp", apiCfg.unrechirp)
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiCfg.middlewareRequireVerifiedEmail)
+				r.Post("/chirps", apiCfg.postChirp)
+				r.Put("/chirps/{chirpid}", apiCfg.updateChirp)
+				r.Patch("/chirps/{chirpid}", apiCfg.updateChirp)
+				r.Post("/chirps/{chirpid}/rechirp", apiCfg.rechirp)
+				r.Post("/chirps/{chirpid}/report", apiCfg.reportChirp)
+			})
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(apiCfg.middlewareRequireScope(auth.ScopeUsersWrite))
+			r.Put("/users", apiCfg.updateUser)
+			r.Post("/users/verify/resend", apiCfg.resendVerification)
+			r.Post("/users/{userid}/follow", apiCfg.follow)
+			r.Delete("/users/{userid}/follow", apiCfg.unfollow)
+			r.Delete("/sessions/{sessionid}", apiCfg.deleteSession)
+			r.Post("/sessions/revoke-all", apiCfg.revokeAllSessions)
+			r.Post("/tokens", apiCfg.createApiKey)
+			r.Delete("/tokens/{tokenid}", apiCfg.deleteApiKey)
+		})
+
+		r.With(apiCfg.middlewareRequireRole(database.RoleAdmin), apiCfg.middlewareRequireScope(auth.ScopeAdmin)).
+			Handle("/reset", apiCfg.reset())
+	})
+
 	rAdmin := chi.NewRouter()
+	rAdmin.Use(apiCfg.middlewareRequireAuth, apiCfg.middlewareRequireRole(database.RoleAdmin),
+		apiCfg.middlewareRequireScope(auth.ScopeAdmin))
 	rAdmin.Get("/metrics", apiCfg.htmlMetrics())
+	rAdmin.Put("/users/{userid}/role", apiCfg.setUserRole)
+	rAdmin.Get("/moderation/words", apiCfg.getModerationWords)
+	rAdmin.Post("/moderation/words", apiCfg.createModerationWord)
+	rAdmin.Put("/moderation/words/{wordid}", apiCfg.updateModerationWord)
+	rAdmin.Delete("/moderation/words/{wordid}", apiCfg.deleteModerationWord)
+	rAdmin.Get("/moderation/flagged", apiCfg.getFlaggedChirps)
+	rAdmin.Get("/moderation/reports", apiCfg.getReportQueue)
+	rAdmin.Post("/moderation/chirps/{chirpid}/actions", apiCfg.moderateChirp)
+	rAdmin.Get("/moderation/actions", apiCfg.getModerationActions)
 
 	r.Mount("/api", rApi)
 	r.Mount("/admin", rAdmin)
+	r.Get("/.well-known/jwks.json", apiCfg.jwks)
 
 	mux := middlewareCors(r)
 
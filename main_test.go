@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+// newTestConfig returns a config backed by a fresh JSON database, which
+// signs tokens with a fixed secret and keeps emails in memory.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	keys, err := auth.NewKeyring(auth.NewHMACKey("", []byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		db:        db,
+		jwtKeys:   keys,
+		mailer:    &mail.MemoryMailer{},
+		publicUrl: "http://localhost:8080",
+	}
+}
+
+// serve sends a request to handler, with token as its bearer token unless
+// it is empty, and returns the status code. The response is decoded into
+// out unless it is nil.
+func serve(t *testing.T, handler http.Handler, method, path, body, token string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("Decoding %s %s response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+type testTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// createTestUser signs up a user with the password "password" and logs
+// them in.
+func createTestUser(t *testing.T, cfg *apiConfig, email string) testTokens {
+	t.Helper()
+	body := `{"email":"` + email + `","password":"password"}`
+	if code := serve(t, http.HandlerFunc(cfg.postUsers), "POST", "/api/users", body, "", nil); code != http.StatusCreated {
+		t.Fatalf("Creating user: got %d, expected %d", code, http.StatusCreated)
+	}
+	return loginTestUser(t, cfg, email, "password")
+}
+
+func loginTestUser(t *testing.T, cfg *apiConfig, email, password string) testTokens {
+	t.Helper()
+	tokens := testTokens{}
+	body := `{"email":"` + email + `","password":"` + password + `"}`
+	if code := serve(t, http.HandlerFunc(cfg.login), "POST", "/api/login", body, "", &tokens); code != http.StatusOK {
+		t.Fatalf("Logging in: got %d, expected %d", code, http.StatusOK)
+	}
+	return tokens
+}
+
+// createTestUserWithRole is createTestUser for a user with the given
+// role.
+func createTestUserWithRole(t *testing.T, cfg *apiConfig, email, role string) testTokens {
+	t.Helper()
+	createTestUser(t, cfg, email)
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.SetUserRole(user.Id, role); err != nil {
+		t.Fatal(err)
+	}
+	return loginTestUser(t, cfg, email, "password")
+}
+
+// waitForMail waits for the email to the given address with the given
+// subject, as emails are sent in the background, and returns the token in
+// the link it carries.
+func waitForMail(t *testing.T, cfg *apiConfig, to, subject string) (mail.Message, string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, msg := range cfg.mailer.(*mail.MemoryMailer).Messages() {
+			if msg.To != to || msg.Subject != subject {
+				continue
+			}
+			_, query, found := strings.Cut(msg.Body, "?token=")
+			if !found {
+				t.Fatalf("No token in %q", msg.Body)
+			}
+			query, _, _ = strings.Cut(query, "\n")
+			token, err := url.QueryUnescape(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msg, token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No email to %s about %q", to, subject)
+	return mail.Message{}, ""
+}
@@ -5,14 +5,22 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/Joad/chirpy/internal/auth"
 	"github.com/Joad/chirpy/internal/database"
+	"github.com/Joad/chirpy/internal/mail"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	db             *database.DB
-	jwtSecret      string
+	db             database.Store
+	jwtKeys        *auth.Keyring
 	polkaKey       string
+	mailer         mail.Mailer
+	// publicUrl is where the site is served from, for links in emails.
+	publicUrl string
+	// requireVerifiedEmail keeps users from posting, editing, rechirping
+	// and reporting until they have verified their email.
+	requireVerifiedEmail bool
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
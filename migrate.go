@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+)
+
+const migrateUsage = "usage: chirpy migrate [-dry-run] status|up|down [steps]"
+
+// runMigrate implements `chirpy migrate status|up|down`.
+func runMigrate(driver, path string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print the changes instead of applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := database.OpenMigrator(driver, path)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch fs.Arg(0) {
+	case "status":
+		statuses, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%4d  %-8s %s\n", status.Version, state, status.Name)
+		}
+		return nil
+	case "up":
+		return migrator.MigrateUp(*dryRun, os.Stdout)
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			steps, err = strconv.Atoi(fs.Arg(1))
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", fs.Arg(1))
+			}
+		}
+		return migrator.MigrateDown(steps, *dryRun, os.Stdout)
+	}
+	return errors.New(migrateUsage)
+}
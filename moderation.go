@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+// moderatedChirp is a chirp as moderators see it, with the patterns it was
+// flagged for and whether it is hidden.
+type moderatedChirp struct {
+	Chirp
+	Flags  []string `json:"flags,omitempty"`
+	Hidden bool     `json:"hidden"`
+}
+
+func newModeratedChirp(chirp database.Chirp) moderatedChirp {
+	return moderatedChirp{
+		Chirp:  newChirp(chirp),
+		Flags:  chirp.Flags,
+		Hidden: chirp.Hidden,
+	}
+}
+
+func (cfg *apiConfig) getModerationWords(w http.ResponseWriter, r *http.Request) {
+	words, err := cfg.db.GetModerationWords()
+	if err != nil {
+		log.Println("Error getting moderation words: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, words)
+}
+
+func (cfg *apiConfig) createModerationWord(w http.ResponseWriter, r *http.Request) {
+	cfg.putModerationWord(w, r, http.StatusCreated, cfg.db.CreateModerationWord)
+}
+
+func (cfg *apiConfig) updateModerationWord(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "wordid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid word id")
+		return
+	}
+	cfg.putModerationWord(w, r, http.StatusOK, func(pattern, mode string) (database.ModerationWord, error) {
+		return cfg.db.UpdateModerationWord(id, pattern, mode)
+	})
+}
+
+// putModerationWord decodes a word from the request, stores it with put and
+// responds with the stored word.
+func (cfg *apiConfig) putModerationWord(w http.ResponseWriter, r *http.Request, code int,
+	put func(pattern, mode string) (database.ModerationWord, error)) {
+	type params struct {
+		Pattern string `json:"pattern"`
+		Mode    string `json:"mode"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	toValidate := params{}
+	if err := decoder.Decode(&toValidate); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+
+	word, err := put(toValidate.Pattern, toValidate.Mode)
+	if errors.Is(err, database.ErrInvalidModerationWord) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrModerationWordExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrModerationWordNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error saving moderation word: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, code, word)
+}
+
+func (cfg *apiConfig) deleteModerationWord(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "wordid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid word id")
+		return
+	}
+	err = cfg.db.DeleteModerationWord(id)
+	if errors.Is(err, database.ErrModerationWordNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting moderation word: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// getFlaggedChirps returns one page of the chirps flagged for review.
+func (cfg *apiConfig) getFlaggedChirps(w http.ResponseWriter, r *http.Request) {
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbChirps, err := cfg.db.GetChirpsPage(database.ChirpQuery{
+		Flagged:       true,
+		IncludeHidden: true,
+		AfterId:       cursor.AfterId,
+		Desc:          cursor.Desc,
+		Limit:         limit + 1,
+	})
+	if err != nil {
+		log.Println("Error getting flagged chirps: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(dbChirps) > limit {
+		dbChirps = dbChirps[:limit]
+		setNextLink(w, r, pageCursor{
+			AfterId: dbChirps[limit-1].Id,
+			Desc:    cursor.Desc,
+		})
+	}
+
+	chirps := make([]moderatedChirp, 0, len(dbChirps))
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, newModeratedChirp(chirp))
+	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// pageCursor marks the end of a page. Clients only ever see it encoded,
+// as an opaque string.
+type pageCursor struct {
+	AfterId int  `json:"after,omitempty"`
+	Desc    bool `json:"desc,omitempty"`
+	// Offset counts the results already seen, for orderings that can't
+	// resume after an ID, like search relevance.
+	Offset int `json:"offset,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	dat, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, err
+	}
+	c := pageCursor{}
+	if err := json.Unmarshal(dat, &c); err != nil {
+		return pageCursor{}, err
+	}
+	if c.AfterId < 1 && c.Offset < 1 || c.AfterId < 0 || c.Offset < 0 {
+		return pageCursor{}, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// parsePage reads the limit and cursor query parameters. Without a cursor
+// the order comes from the sort parameter.
+func parsePage(r *http.Request) (pageCursor, int, error) {
+	limit := defaultPageLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return pageCursor{}, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return pageCursor{}, 0, errors.New("invalid cursor")
+		}
+		return c, limit, nil
+	}
+	return pageCursor{Desc: r.URL.Query().Get("sort") == "desc"}, limit, nil
+}
+
+// setNextLink points the Link header at the page following next, keeping
+// the request's other query parameters.
+func setNextLink(w http.ResponseWriter, r *http.Request, next pageCursor) {
+	query := r.URL.Query()
+	query.Set("cursor", next.encode())
+	query.Del("sort")
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, query.Encode()))
+}
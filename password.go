@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+// passwordResetTTL is how long a password reset link works.
+const passwordResetTTL = time.Hour
+
+// forgotPassword emails a password reset link to the address given, if it
+// belongs to a user. The response is the same either way, so it can't be
+// used to find out who has an account.
+func (cfg *apiConfig) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(lookupEmail(params.Email))
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithJSON(w, http.StatusAccepted, struct{}{})
+		return
+	}
+	if err != nil {
+		log.Println("Error getting user: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	token, hash, err := auth.MakeOneTimeToken()
+	if err != nil {
+		log.Println("Error making reset token: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if _, err := cfg.db.CreatePasswordReset(user.Id, hash, time.Now().UTC().Add(passwordResetTTL)); err != nil {
+		log.Println("Error creating password reset: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	link := cfg.publicUrl + "/app/reset-password.html?token=" + url.QueryEscape(token)
+	cfg.sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account.\n\n"+
+			"To choose a new password, follow this link within %d minutes:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.\n", int(passwordResetTTL.Minutes()), link),
+	})
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// resetPassword sets a new password with a token from forgotPassword,
+// which reset-password.html posts. It logs the user out everywhere and
+// deletes their API keys, in case the account was taken over.
+func (cfg *apiConfig) resetPassword(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password required")
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		log.Println("Error hashing password: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+		return
+	}
+	_, err = cfg.db.ResetPassword(auth.HashOneTimeToken(params.Token), hashedPassword)
+	if errors.Is(err, database.ErrPasswordResetNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		log.Println("Error resetting password: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/mail"
+)
+
+func TestPasswordReset(t *testing.T) {
+	cfg := newTestConfig(t)
+	tokens := createTestUser(t, cfg, "a@example.com")
+	user, err := cfg.db.GetUserByEmail("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, prefix, hash, err := auth.MakeApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.CreateApiKey(user.Id, "key", prefix, hash, auth.ScopeChirpsWrite, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	forgot := http.HandlerFunc(cfg.forgotPassword)
+	reset := http.HandlerFunc(cfg.resetPassword)
+	// Unknown addresses get the same answer.
+	if code := serve(t, forgot, "POST", "/api/password/forgot", `{"email":"b@example.com"}`, "", nil); code != http.StatusAccepted {
+		t.Fatalf("Got %d, expected %d", code, http.StatusAccepted)
+	}
+	if code := serve(t, forgot, "POST", "/api/password/forgot", `{"email":"a@example.com"}`, "", nil); code != http.StatusAccepted {
+		t.Fatalf("Got %d, expected %d", code, http.StatusAccepted)
+	}
+	msg, token := waitForMail(t, cfg, "a@example.com", "Reset your Chirpy password")
+	if !strings.Contains(msg.Body, cfg.publicUrl+"/app/reset-password.html?token=") {
+		t.Fatalf("Unexpected link in %q", msg.Body)
+	}
+	// The link leads to a page /app serves.
+	if _, err := os.Stat("public/reset-password.html"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range cfg.mailer.(*mail.MemoryMailer).Messages() {
+		if msg.To == "b@example.com" {
+			t.Fatal("Emailed an unknown address")
+		}
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"wrong token", `{"token":"wrong","password":"new"}`, http.StatusBadRequest},
+		{"no password", `{"token":"` + token + `","password":""}`, http.StatusBadRequest},
+		{"reset", `{"token":"` + token + `","password":"new"}`, http.StatusOK},
+		{"token used", `{"token":"` + token + `","password":"newer"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code := serve(t, reset, "POST", "/api/password/reset", tt.body, "", nil); code != tt.want {
+			t.Fatalf("%s: got %d, expected %d", tt.name, code, tt.want)
+		}
+	}
+
+	// Everything issued before the reset stops working.
+	sessions := cfg.middlewareRequireAuth(http.HandlerFunc(cfg.getSessions))
+	for _, token := range []string{tokens.Token, key} {
+		if code := serve(t, sessions, "GET", "/api/sessions", "", token, nil); code != http.StatusUnauthorized {
+			t.Fatalf("Got %d, expected %d", code, http.StatusUnauthorized)
+		}
+	}
+	if code := serve(t, http.HandlerFunc(cfg.refresh), "POST", "/api/refresh", "", tokens.RefreshToken, nil); code != http.StatusUnauthorized {
+		t.Fatalf("Got %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	body := `{"email":"a@example.com","password":"password"}`
+	if code := serve(t, http.HandlerFunc(cfg.login), "POST", "/api/login", body, "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("Got %d, expected %d", code, http.StatusUnauthorized)
+	}
+	fresh := loginTestUser(t, cfg, "a@example.com", "new")
+	if code := serve(t, sessions, "GET", "/api/sessions", "", fresh.Token, nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const maxReportReasonLength = 500
+
+// reportChirp files the caller's report against a chirp.
+func (cfg *apiConfig) reportChirp(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Reason string `json:"reason"`
+	}
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	caller, _ := currentUser(r)
+	userId := caller.Id
+
+	decoder := json.NewDecoder(r.Body)
+	toValidate := params{}
+	if err := decoder.Decode(&toValidate); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+	reason := strings.TrimSpace(toValidate.Reason)
+	if reason == "" {
+		respondWithError(w, http.StatusBadRequest, "Reason required")
+		return
+	}
+	if len(reason) > maxReportReasonLength {
+		respondWithError(w, http.StatusBadRequest, "Reason is too long")
+		return
+	}
+
+	report, err := cfg.db.CreateReport(chirpid, userId, reason)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	if errors.Is(err, database.ErrAlreadyReported) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error creating report: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+// getReportQueue returns one page of the chirps with open reports, ordered
+// by chirp ID, each with its reports. A chirp its author has since deleted
+// is null.
+func (cfg *apiConfig) getReportQueue(w http.ResponseWriter, r *http.Request) {
+	type reportedChirp struct {
+		ChirpId int               `json:"chirp_id"`
+		Chirp   *moderatedChirp   `json:"chirp"`
+		Reports []database.Report `json:"reports"`
+	}
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// One extra chirp tells us whether there is a next page.
+	queue, err := cfg.db.GetReportQueue(cursor.AfterId, limit+1)
+	if err != nil {
+		log.Println("Error getting report queue: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if len(queue) > limit {
+		queue = queue[:limit]
+		setNextLink(w, r, pageCursor{AfterId: queue[limit-1].ChirpId})
+	}
+
+	resp := make([]reportedChirp, 0, len(queue))
+	for _, entry := range queue {
+		item := reportedChirp{ChirpId: entry.ChirpId, Reports: entry.Reports}
+		if entry.Chirp != nil {
+			chirp := newModeratedChirp(*entry.Chirp)
+			item.Chirp = &chirp
+		}
+		resp = append(resp, item)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// moderateChirp carries out a moderator's action on a chirp, closing its
+// open reports.
+func (cfg *apiConfig) moderateChirp(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Action string `json:"action"`
+	}
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+
+	caller, _ := currentUser(r)
+	moderatorId := caller.Id
+
+	decoder := json.NewDecoder(r.Body)
+	toValidate := params{}
+	if err := decoder.Decode(&toValidate); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+
+	action, err := cfg.db.ModerateChirp(chirpid, moderatorId, toValidate.Action)
+	if errors.Is(err, database.ErrInvalidModerationAction) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error moderating chirp: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, action)
+}
+
+// getModerationActions returns one page of the moderation log, oldest
+// first.
+func (cfg *apiConfig) getModerationActions(w http.ResponseWriter, r *http.Request) {
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	actions, err := cfg.db.GetModerationActions(cursor.AfterId, limit+1)
+	if err != nil {
+		log.Println("Error getting moderation actions: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if len(actions) > limit {
+		actions = actions[:limit]
+		setNextLink(w, r, pageCursor{AfterId: actions[limit-1].Id})
+	}
+	respondWithJSON(w, http.StatusOK, actions)
+}
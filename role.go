@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const roleUsage = "usage: chirpy role <email> user|moderator|admin"
+
+// runRole implements `chirpy role <email> <role>`, which is how the first
+// admin is made.
+func runRole(driver, path string, args []string) error {
+	if len(args) != 2 {
+		return errors.New(roleUsage)
+	}
+	db, err := database.Open(driver, path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	user, err := db.GetUserByEmail(args[0])
+	if err != nil {
+		return err
+	}
+	user, err = db.SetUserRole(user.Id, args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now %s\n", user.Email, user.Role)
+	return nil
+}
+
+// setUserRole lets an admin change another user's role.
+func (cfg *apiConfig) setUserRole(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Role string `json:"role"`
+	}
+	type response struct {
+		Id   int    `json:"id"`
+		Role string `json:"role"`
+	}
+	userId, err := strconv.Atoi(chi.URLParam(r, "userid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	// Admins can't demote themselves, so there is always one left.
+	if caller, _ := currentUser(r); caller.Id == userId {
+		respondWithError(w, http.StatusBadRequest, "Can't change your own role")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	toValidate := params{}
+	if err := decoder.Decode(&toValidate); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode params")
+		return
+	}
+
+	user, err := cfg.db.SetUserRole(userId, toValidate.Role)
+	if errors.Is(err, database.ErrInvalidRole) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error setting role: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Id: user.Id, Role: user.Role})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestMiddlewareRequireRole(t *testing.T) {
+	cfg := newTestConfig(t)
+	user := createTestUser(t, cfg, "user@example.com")
+	moderator := createTestUserWithRole(t, cfg, "moderator@example.com", database.RoleModerator)
+	admin := createTestUserWithRole(t, cfg, "admin@example.com", database.RoleAdmin)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, struct{}{})
+	})
+	tests := []struct {
+		name  string
+		token string
+		role  string
+		want  int
+	}{
+		{"no token", "", database.RoleUser, http.StatusUnauthorized},
+		{"invalid token", "invalid", database.RoleUser, http.StatusUnauthorized},
+		{"refresh token", user.RefreshToken, database.RoleUser, http.StatusUnauthorized},
+		{"user", user.Token, database.RoleUser, http.StatusOK},
+		{"user as moderator", user.Token, database.RoleModerator, http.StatusForbidden},
+		{"moderator", moderator.Token, database.RoleModerator, http.StatusOK},
+		{"moderator as admin", moderator.Token, database.RoleAdmin, http.StatusForbidden},
+		{"admin", admin.Token, database.RoleAdmin, http.StatusOK},
+		{"admin as moderator", admin.Token, database.RoleModerator, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := cfg.middlewareRequireAuth(cfg.middlewareRequireRole(tt.role)(ok))
+			if code := serve(t, handler, "GET", "/", "", tt.token, nil); code != tt.want {
+				t.Fatalf("Got %d, expected %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	cfg := newTestConfig(t)
+	admin := createTestUserWithRole(t, cfg, "admin@example.com", database.RoleAdmin)
+	createTestUser(t, cfg, "user@example.com")
+	user, err := cfg.db.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := cfg.db.GetUserByEmail("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.With(cfg.middlewareRequireAuth).Put("/admin/users/{userid}/role", cfg.setUserRole)
+
+	tests := []struct {
+		name   string
+		userId int
+		body   string
+		want   int
+	}{
+		{"promote", user.Id, `{"role":"moderator"}`, http.StatusOK},
+		{"invalid role", user.Id, `{"role":"root"}`, http.StatusBadRequest},
+		{"unknown user", user.Id + 100, `{"role":"user"}`, http.StatusNotFound},
+		{"self", self.Id, `{"role":"user"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/admin/users/" + strconv.Itoa(tt.userId) + "/role"
+			if code := serve(t, r, "PUT", path, tt.body, admin.Token, nil); code != tt.want {
+				t.Fatalf("Got %d, expected %d", code, tt.want)
+			}
+		})
+	}
+	user, err = cfg.db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != database.RoleModerator {
+		t.Fatalf("Got %q, expected %q", user.Role, database.RoleModerator)
+	}
+}
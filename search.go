@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Joad/chirpy/internal/database"
+)
+
+// searchChirps returns one page of the chirps matching the q parameter.
+// Results are ordered by relevance unless sort=recent is given, and can be
+// narrowed with author_id, since and until.
+func (cfg *apiConfig) searchChirps(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := database.SearchQuery{
+		Text: params.Get("q"),
+		// One extra chirp tells us whether there is a next page.
+		Limit: limit + 1,
+	}
+	switch {
+	case cursor.Offset > 0:
+		query.ByRelevance = true
+		query.Offset = cursor.Offset
+	case cursor.AfterId > 0:
+		query.AfterId = cursor.AfterId
+	case params.Get("sort") == "recent":
+		// Newest first is the default order of a SearchQuery.
+	case params.Get("sort") == "" || params.Get("sort") == "relevance":
+		query.ByRelevance = true
+	default:
+		respondWithError(w, http.StatusBadRequest, "sort must be relevance or recent")
+		return
+	}
+
+	if s := params.Get("author_id"); s != "" {
+		query.AuthorId, err = strconv.Atoi(s)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author id")
+			return
+		}
+	}
+	if query.Since, err = parseSearchTime(params.Get("since")); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid since")
+		return
+	}
+	if query.Until, err = parseSearchTime(params.Get("until")); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid until")
+		return
+	}
+
+	dbChirps, err := cfg.db.SearchChirps(query)
+	if errors.Is(err, database.ErrEmptySearch) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Error searching chirps: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(dbChirps) > limit {
+		dbChirps = dbChirps[:limit]
+		next := pageCursor{AfterId: dbChirps[limit-1].Id}
+		if query.ByRelevance {
+			next = pageCursor{Offset: query.Offset + limit}
+		}
+		setNextLink(w, r, next)
+	}
+
+	chirps := make([]Chirp, 0, len(dbChirps))
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, newChirp(chirp))
+	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+// parseSearchTime reads a date filter given either as a date or as an
+// RFC 3339 time. Empty means unset.
+func parseSearchTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
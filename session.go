@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+// session is a login on one device, backed by a refresh token family.
+type session struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	Ip         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func newSession(family database.RefreshFamily) session {
+	return session{
+		Id:         family.Id,
+		UserAgent:  family.UserAgent,
+		Ip:         family.Ip,
+		CreatedAt:  family.CreatedAt,
+		LastUsedAt: family.RotatedAt,
+	}
+}
+
+// clientIp returns the address the request came from, without the port.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getSessions lists the caller's sessions that can still be refreshed,
+// oldest first.
+func (cfg *apiConfig) getSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	families, err := cfg.db.GetActiveRefreshFamilies(caller.Id)
+	if err != nil {
+		log.Println("Error getting sessions: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	sessions := make([]session, 0, len(families))
+	for _, family := range families {
+		// The refresh token of an idle session has expired.
+		if time.Since(family.RotatedAt) > refreshTokenTTL {
+			continue
+		}
+		sessions = append(sessions, newSession(family))
+	}
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// deleteSession logs the caller out of one session. Access tokens already
+// issued to it stay valid until they expire.
+func (cfg *apiConfig) deleteSession(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	family, err := cfg.db.GetRefreshFamily(chi.URLParam(r, "sessionid"))
+	if err != nil && !errors.Is(err, database.ErrRefreshFamilyNotFound) {
+		log.Println("Error getting session: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	// Other users' sessions are reported as missing too.
+	if err != nil || family.UserId != caller.Id || family.Revoked {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err := cfg.db.RevokeRefreshFamily(family.Id); err != nil {
+		log.Println("Error revoking session: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// revokeAllSessions logs the caller out everywhere: every refresh token
+// is revoked, and every access token, including the one used for this
+// request, stops working.
+func (cfg *apiConfig) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := currentUser(r)
+	if err := cfg.db.RevokeUserTokens(caller.Id); err != nil {
+		log.Println("Error revoking sessions: ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
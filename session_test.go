@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRevokeAllSessions(t *testing.T) {
+	cfg := newTestConfig(t)
+	tokens := createTestUser(t, cfg, "a@example.com")
+	other := loginTestUser(t, cfg, "a@example.com", "password")
+
+	sessions := cfg.middlewareRequireAuth(http.HandlerFunc(cfg.getSessions))
+	if code := serve(t, sessions, "GET", "/api/sessions", "", other.Token, nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+
+	revokeAll := cfg.middlewareRequireAuth(http.HandlerFunc(cfg.revokeAllSessions))
+	if code := serve(t, revokeAll, "POST", "/api/sessions/revoke-all", "", tokens.Token, nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+
+	// Access tokens issued before are still signed and unexpired, but no
+	// longer of the user's current generation.
+	for _, token := range []string{tokens.Token, other.Token} {
+		if code := serve(t, sessions, "GET", "/api/sessions", "", token, nil); code != http.StatusUnauthorized {
+			t.Fatalf("Got %d, expected %d", code, http.StatusUnauthorized)
+		}
+	}
+	refresh := http.HandlerFunc(cfg.refresh)
+	if code := serve(t, refresh, "POST", "/api/refresh", "", other.RefreshToken, nil); code != http.StatusUnauthorized {
+		t.Fatalf("Got %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	fresh := loginTestUser(t, cfg, "a@example.com", "password")
+	if code := serve(t, sessions, "GET", "/api/sessions", "", fresh.Token, nil); code != http.StatusOK {
+		t.Fatalf("Got %d, expected %d", code, http.StatusOK)
+	}
+}
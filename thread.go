@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Joad/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxThreadDepth is how many levels of replies a thread includes below
+	// the requested chirp. Deeper replies are fetched through the thread of
+	// the reply they answer.
+	maxThreadDepth = 3
+	// nestedReplyLimit caps the replies shown under each reply; only the
+	// direct replies to the requested chirp are paginated.
+	nestedReplyLimit = 5
+)
+
+type threadNode struct {
+	Chirp
+	Replies []threadNode `json:"replies,omitempty"`
+}
+
+type thread struct {
+	Ancestors []Chirp      `json:"ancestors"`
+	Chirp     Chirp        `json:"chirp"`
+	Replies   []threadNode `json:"replies"`
+}
+
+// getChirpThread returns a chirp with the chirps it replies to, root
+// first, and a page of the replies below it. The Link header carries the
+// cursor for the next page of direct replies.
+func (cfg *apiConfig) getChirpThread(w http.ResponseWriter, r *http.Request) {
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpid"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id")
+		return
+	}
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, found, err := cfg.db.GetChirpById(chirpid)
+	if err != nil {
+		log.Println("Error retrieving chirp, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if !found || chirp.Hidden {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	dbAncestors, err := cfg.db.GetChirpAncestors(chirpid)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Println("Error getting chirp ancestors, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	dbReplies, err := cfg.db.GetChirpsPage(database.ChirpQuery{
+		InReplyTo: chirpid,
+		AfterId:   cursor.AfterId,
+		Desc:      cursor.Desc,
+		// One extra reply tells us whether there is a next page.
+		Limit: limit + 1,
+	})
+	if err != nil {
+		log.Println("Error getting replies, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+	if len(dbReplies) > limit {
+		dbReplies = dbReplies[:limit]
+		setNextLink(w, r, pageCursor{
+			AfterId: dbReplies[limit-1].Id,
+			Desc:    cursor.Desc,
+		})
+	}
+	replies, err := cfg.replyTree(dbReplies, maxThreadDepth-1)
+	if err != nil {
+		log.Println("Error getting replies, ", err)
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	ancestors := make([]Chirp, 0, len(dbAncestors))
+	for _, ancestor := range dbAncestors {
+		if !ancestor.Hidden {
+			ancestors = append(ancestors, newChirp(ancestor))
+		}
+	}
+	respondWithJSON(w, http.StatusOK, thread{
+		Ancestors: ancestors,
+		Chirp:     newChirp(chirp),
+		Replies:   replies,
+	})
+}
+
+// replyTree wraps chirps in thread nodes, filling in the first replies to
+// each down to depth more levels.
+func (cfg *apiConfig) replyTree(chirps []database.Chirp, depth int) ([]threadNode, error) {
+	nodes := make([]threadNode, 0, len(chirps))
+	for _, chirp := range chirps {
+		node := threadNode{Chirp: newChirp(chirp)}
+		if depth > 0 && chirp.ReplyCount > 0 {
+			replies, err := cfg.db.GetChirpsPage(database.ChirpQuery{
+				InReplyTo: chirp.Id,
+				Limit:     nestedReplyLimit,
+			})
+			if err != nil {
+				return nil, err
+			}
+			node.Replies, err = cfg.replyTree(replies, depth-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -2,22 +2,59 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Joad/chirpy/internal/auth"
+	"github.com/Joad/chirpy/internal/database"
 )
 
+// publicUser is the view of a user shown to other users, as in follower
+// lists; emails stay private.
+type publicUser struct {
+	Id          int  `json:"id"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+}
+
+// respondWithUserPage responds with count and up to limit of users, which
+// were fetched with one extra user to tell whether there is a next page.
+// The Link header carries the cursor for it.
+func respondWithUserPage(w http.ResponseWriter, r *http.Request, count int,
+	users []database.User, limit int) {
+	type response struct {
+		Count int          `json:"count"`
+		Users []publicUser `json:"users"`
+	}
+	if len(users) > limit {
+		users = users[:limit]
+		setNextLink(w, r, pageCursor{AfterId: users[limit-1].Id})
+	}
+
+	resp := response{
+		Count: count,
+		Users: make([]publicUser, 0, len(users)),
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, publicUser{Id: user.Id, IsChirpyRed: user.IsChirpyRed})
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
 func (cfg *apiConfig) postUsers(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 	type response struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id            int       `json:"id"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		IsChirpyRed   bool      `json:"is_chirpy_red"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -28,6 +65,11 @@ func (cfg *apiConfig) postUsers(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode params")
 		return
 	}
+	email, err := normalizeEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
@@ -35,17 +77,24 @@ func (cfg *apiConfig) postUsers(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
 	}
 
-	user, err := cfg.db.CreateUser(params.Email, hashedPassword)
+	user, err := cfg.db.CreateUser(email, hashedPassword)
 	if err != nil {
 		log.Println("Error creating user: ", err)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
 		return
 	}
+	// The user can ask for another link if this one fails.
+	if err := cfg.sendVerification(user.Id, user.Email); err != nil {
+		log.Println("Error sending verification: ", err)
+	}
 
 	respondWithJSON(w, http.StatusCreated, response{
-		Id:          user.Id,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		IsChirpyRed:   user.IsChirpyRed,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
 	})
 }
 
@@ -55,8 +104,12 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	type response struct {
-		Id    int    `json:"id"`
-		Email string `json:"email"`
+		Id            int       `json:"id"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		PendingEmail  string    `json:"pending_email,omitempty"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -67,24 +120,34 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Bearer required")
-		return
-	}
+	caller, _ := currentUser(r)
+	id := caller.Id
 
-	subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	email, err := normalizeEmail(params.Email)
 	if err != nil {
-		log.Println("Error validating jwt: ", err)
-		respondWithError(w, http.StatusUnauthorized, "Error with token")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	id, err := strconv.Atoi(subject)
-	if err != nil {
-		log.Println("Error getting user id: ", err)
-		respondWithError(w, http.StatusInternalServerError, "Error getting user id")
-		return
+	// A new address only replaces the current one once it is verified.
+	if !strings.EqualFold(email, caller.Email) {
+		err := cfg.sendVerification(id, email)
+		if errors.Is(err, database.ErrUserExists) {
+			respondWithError(w, http.StatusConflict, "Email already in use")
+			return
+		}
+		if err != nil {
+			log.Println("Error sending verification: ", err)
+			respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+		email = caller.Email
+	} else if caller.PendingEmail != "" {
+		// Sending the current address again takes back a change.
+		if err := cfg.db.CancelEmailChange(id); err != nil {
+			log.Println("Error cancelling email change: ", err)
+			respondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
 	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
@@ -93,7 +156,7 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
 	}
 
-	user, err := cfg.db.UpdateUser(id, params.Email, hashedPassword)
+	user, err := cfg.db.UpdateUser(id, email, hashedPassword)
 	if err != nil {
 		log.Println("Error updating user: ", err)
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
@@ -101,7 +164,11 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Id:    user.Id,
-		Email: user.Email,
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		PendingEmail:  user.PendingEmail,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
 	})
 }